@@ -0,0 +1,647 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/forjoin92/depot/logging"
+	"github.com/forjoin92/depot/raftnode"
+	"github.com/forjoin92/depot/tracing"
+)
+
+// EnvPrefix prefixes the environment variable of every setting, e.g. the
+// snapshotThreshold flag is DEPOT_SNAPSHOT_THRESHOLD
+const EnvPrefix = "DEPOT_"
+
+// Config is the effective depot configuration. Settings are read from the
+// defaults, a JSON config file, environment variables and command line flags,
+// each overriding the previous one.
+type Config struct {
+	Node    NodeConfig    `json:"node"`
+	Raft    RaftConfig    `json:"raft"`
+	Storage StorageConfig `json:"storage"`
+	API     APIConfig     `json:"api"`
+	Shards  ShardConfig   `json:"shards"`
+
+	Replication ReplicationConfig `json:"replication"`
+	Log         LogConfig         `json:"log"`
+	Trace       TraceConfig       `json:"trace"`
+
+	// command line only settings, not read from the config file
+	ConfigFile  string `json:"-"`
+	PrintConfig bool   `json:"-"`
+	Recover     string `json:"-"`
+
+	// name and args are kept to load the config again on reload
+	name string
+	args []string
+}
+
+type NodeConfig struct {
+	ID              string   `json:"id"`
+	BindAddr        string   `json:"bind"`
+	AdvertiseAddr   string   `json:"advertise"`
+	Cluster         string   `json:"cluster"`
+	Bootstrap       bool     `json:"bootstrap"`
+	Join            string   `json:"join"`
+	Leave           bool     `json:"leave"`
+	ShutdownTimeout Duration `json:"shutdown_timeout"`
+	// Mux serves the api on the raft bind address, the api address and
+	// ports are then unused
+	Mux bool `json:"mux"`
+	// Zone is the failure zone of the node
+	Zone string `json:"zone"`
+}
+
+type RaftConfig struct {
+	HeartbeatTimeout   Duration `json:"heartbeat_timeout"`
+	ElectionTimeout    Duration `json:"election_timeout"`
+	CommitTimeout      Duration `json:"commit_timeout"`
+	LeaderLeaseTimeout Duration `json:"leader_lease_timeout"`
+	MaxAppendEntries   int      `json:"max_append_entries"`
+	SnapshotInterval   Duration `json:"snapshot_interval"`
+	SnapshotThreshold  uint64   `json:"snapshot_threshold"`
+	TrailingLogs       uint64   `json:"trailing_logs"`
+	ApplyTimeout       Duration `json:"apply_timeout"`
+	ReadyMaxLag        uint64   `json:"ready_max_lag"`
+	SlowPeerLag        uint64   `json:"slow_peer_lag"`
+	TransportMaxPool   int      `json:"transport_max_pool"`
+	TransportTimeout   Duration `json:"transport_timeout"`
+	// TLSCert, TLSKey and TLSCA enable mutual TLS between raft peers
+	TLSCert           string `json:"tls_cert"`
+	TLSKey            string `json:"tls_key"`
+	TLSCA             string `json:"tls_ca"`
+	TLSVerifyServerID bool   `json:"tls_verify_server_id"`
+}
+
+type StorageConfig struct {
+	DataDir        string `json:"data_dir"`
+	SnapshotPath   string `json:"snapshot_path"`
+	RaftDBPath     string `json:"raft_db_path"`
+	SnapshotRetain int    `json:"snapshot_retain"`
+	// LogStore is the raft log backend: bolt, segment or memory (tests only)
+	LogStore     string `json:"log_store"`
+	LogCacheSize int    `json:"log_cache_size"`
+	SegmentSize  int64  `json:"segment_size"`
+}
+
+type APIConfig struct {
+	Addr string `json:"addr"`
+	Port string `json:"port"`
+	// Advertise is the api address the other members forward requests to,
+	// defaults to Addr:Port, or to the raft advertise address with mux
+	Advertise string `json:"advertise"`
+	// TLSEnabled serves the api over https on HTTPSPort as well
+	TLSEnabled bool   `json:"tls_enabled"`
+	HTTPSPort  string `json:"https_port"`
+	TLSCert    string `json:"tls_cert"`
+	TLSKey     string `json:"tls_key"`
+	// TLSClientCA requires https clients to present a certificate it signed
+	TLSClientCA string `json:"tls_client_ca"`
+	// TLSRequired redirects plain GET requests to https and refuses the others
+	TLSRequired bool `json:"tls_required"`
+	// MaxValueSize is the largest value in bytes the v1 api accepts
+	MaxValueSize int64 `json:"max_value_size"`
+	// MaxBackupSize is the largest backup in bytes /admin/restore accepts
+	MaxBackupSize int64 `json:"max_backup_size"`
+}
+
+// ShardConfig lists the data raft groups run by this node. When it is empty
+// the node runs a single group holding every key, otherwise the main group
+// only stores the routing table. Groups are only configured in the file.
+type ShardConfig struct {
+	Groups []GroupConfig `json:"groups"`
+}
+
+type GroupConfig struct {
+	Name          string `json:"name"`
+	BindAddr      string `json:"bind"`
+	AdvertiseAddr string `json:"advertise"`
+	// Cluster is the id=address list used when the group is bootstrapped
+	Cluster string `json:"cluster"`
+}
+
+// ReplicationConfig configures asynchronous replication to a standby cluster
+type ReplicationConfig struct {
+	// Targets is a comma separated list of the standby members' API addresses
+	Targets string `json:"targets"`
+	// Prefixes is a comma separated list of key prefixes to replicate
+	Prefixes string `json:"prefixes"`
+	// Checkpoint defaults to replication.checkpoint in the data directory
+	Checkpoint string   `json:"checkpoint"`
+	Interval   Duration `json:"interval"`
+}
+
+// LogConfig configures the log lines of the node
+type LogConfig struct {
+	// Level is debug, info, warn or error
+	Level string `json:"level"`
+	// Format is text or json
+	Format string `json:"format"`
+}
+
+// TraceConfig configures request tracing. Spans are appended to File as JSON
+// lines when it is set, otherwise the last RingSize spans are kept in memory
+// and served on /debug/traces. A RingSize of 0 turns tracing off.
+type TraceConfig struct {
+	File     string `json:"file"`
+	RingSize int    `json:"ring_size"`
+}
+
+// Default returns the default configuration, the raft values are the
+// hashicorp/raft production defaults
+func Default() *Config {
+	return &Config{
+		Node: NodeConfig{
+			BindAddr:        "127.0.0.1:30401",
+			ShutdownTimeout: Duration(10 * time.Second),
+		},
+		Raft: RaftConfig{
+			HeartbeatTimeout:   Duration(1000 * time.Millisecond),
+			ElectionTimeout:    Duration(1000 * time.Millisecond),
+			CommitTimeout:      Duration(50 * time.Millisecond),
+			LeaderLeaseTimeout: Duration(500 * time.Millisecond),
+			MaxAppendEntries:   64,
+			SnapshotInterval:   Duration(120 * time.Second),
+			SnapshotThreshold:  8192,
+			TrailingLogs:       10240,
+			ApplyTimeout:       Duration(10 * time.Second),
+			ReadyMaxLag:        1000,
+			SlowPeerLag:        1000,
+			TransportMaxPool:   3,
+			TransportTimeout:   Duration(10 * time.Second),
+		},
+		Storage: StorageConfig{
+			SnapshotRetain: 3,
+			LogStore:       raftnode.LogStoreBolt,
+			LogCacheSize:   512,
+			SegmentSize:    64 * 1024 * 1024,
+		},
+		API: APIConfig{
+			Addr:          "127.0.0.1",
+			Port:          "9001",
+			MaxValueSize:  1024 * 1024,
+			MaxBackupSize: 1024 * 1024 * 1024,
+		},
+		Replication: ReplicationConfig{
+			Interval: Duration(time.Second),
+		},
+		Log: LogConfig{
+			Level:  "info",
+			Format: logging.FormatText,
+		},
+		Trace: TraceConfig{
+			RingSize: 4096,
+		},
+	}
+}
+
+// Load builds the configuration from the defaults, the config file given by
+// -config or DEPOT_CONFIG, environment variables and args, then validates it.
+func Load(name string, args []string) (*Config, error) {
+	// first pass only finds the config file, flags are applied again last
+	scratch := Default()
+	scratch.ConfigFile = os.Getenv(EnvPrefix + "CONFIG")
+	fs := newFlagSet(name, scratch)
+	fs.SetOutput(ioutil.Discard)
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			newFlagSet(name, Default()).Usage()
+		}
+		return nil, err
+	}
+
+	c := Default()
+	if scratch.ConfigFile != "" {
+		if err := c.loadFile(scratch.ConfigFile); err != nil {
+			return nil, err
+		}
+	}
+
+	fs = newFlagSet(name, c)
+	if err := applyEnv(fs); err != nil {
+		return nil, err
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	c.name, c.args = name, args
+	return c, nil
+}
+
+func (c *Config) loadFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Failed to read config file (%s): (%v)", path, err)
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json", "":
+		dec := json.NewDecoder(strings.NewReader(string(data)))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(c); err != nil {
+			return fmt.Errorf("Failed to parse config file (%s): (%v)", path, err)
+		}
+	default:
+		return fmt.Errorf("unsupported config file format (%s), use JSON", path)
+	}
+	return nil
+}
+
+// applyEnv sets every flag which has a matching DEPOT_ environment variable
+func applyEnv(fs *flag.FlagSet) error {
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil {
+			return
+		}
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok {
+			return
+		}
+		if serr := fs.Set(f.Name, value); serr != nil {
+			err = fmt.Errorf("invalid value %q for %s: %v", value, envName(f.Name), serr)
+		}
+	})
+	return err
+}
+
+// envName maps a flag name such as snapshotThreshold to DEPOT_SNAPSHOT_THRESHOLD
+func envName(flagName string) string {
+	var b strings.Builder
+	b.WriteString(EnvPrefix)
+	runes := []rune(flagName)
+	for i, r := range runes {
+		if r == '-' {
+			b.WriteByte('_')
+			continue
+		}
+		// start a new word on lower->Upper and on the last upper of an acronym (DBPath)
+		if i > 0 && unicode.IsUpper(r) && (unicode.IsLower(runes[i-1]) ||
+			(i+1 < len(runes) && unicode.IsLower(runes[i+1]) && unicode.IsUpper(runes[i-1]))) {
+			b.WriteByte('_')
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
+
+func newFlagSet(name string, c *Config) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+
+	fs.StringVar(&c.ConfigFile, "config", c.ConfigFile, "JSON config file")
+	fs.BoolVar(&c.PrintConfig, "print-config", c.PrintConfig, "print the effective config and exit")
+	fs.StringVar(&c.Recover, "recover", c.Recover, "offline recovery: rewrite the raft configuration in the data directory to the peers in this peers.json file and exit")
+
+	// node
+	fs.StringVar(&c.Node.ID, "id", c.Node.ID, "Node id, generated and stored in the data directory if empty")
+	fs.StringVar(&c.Node.BindAddr, "bind", c.Node.BindAddr, "raft bind address")
+	fs.StringVar(&c.Node.AdvertiseAddr, "advertise", c.Node.AdvertiseAddr, "raft address advertised to peers, defaults to bind address")
+	fs.StringVar(&c.Node.Cluster, "cluster", c.Node.Cluster, "Comma separated cluster peers as id=address pairs")
+	fs.BoolVar(&c.Node.Bootstrap, "bootstrap", c.Node.Bootstrap, "bootstrap a brand new cluster from -cluster")
+	fs.StringVar(&c.Node.Join, "join", c.Node.Join, "Comma separated API addresses of existing members to join through")
+	fs.BoolVar(&c.Node.Leave, "leave", c.Node.Leave, "leave the cluster on shutdown")
+	fs.Var(&c.Node.ShutdownTimeout, "shutdownTimeout", "time to wait for in-flight requests on shutdown")
+	fs.BoolVar(&c.Node.Mux, "mux", c.Node.Mux, "serve raft and the http api on the bind address")
+	fs.StringVar(&c.Node.Zone, "zone", c.Node.Zone, "failure zone of the node, voters are spread across zones")
+
+	// raft
+	fs.Var(&c.Raft.HeartbeatTimeout, "heartbeatTimeout", "raft heartbeat timeout")
+	fs.Var(&c.Raft.ElectionTimeout, "electionTimeout", "raft election timeout")
+	fs.Var(&c.Raft.CommitTimeout, "commitTimeout", "raft commit timeout")
+	fs.Var(&c.Raft.LeaderLeaseTimeout, "leaderLeaseTimeout", "raft leader lease timeout")
+	fs.IntVar(&c.Raft.MaxAppendEntries, "maxAppendEntries", c.Raft.MaxAppendEntries, "max log entries sent in one append request")
+	fs.Var(&c.Raft.SnapshotInterval, "snapshotInterval", "how often to check whether a snapshot should be taken")
+	fs.Uint64Var(&c.Raft.SnapshotThreshold, "snapshotThreshold", c.Raft.SnapshotThreshold, "number of new log entries that triggers a snapshot")
+	fs.Uint64Var(&c.Raft.TrailingLogs, "trailingLogs", c.Raft.TrailingLogs, "number of log entries kept after a snapshot")
+	fs.Var(&c.Raft.ApplyTimeout, "applyTimeout", "time a write waits to be committed")
+	fs.Uint64Var(&c.Raft.ReadyMaxLag, "readyMaxLag", c.Raft.ReadyMaxLag, "committed entries a node may still have to apply and be ready")
+	fs.Uint64Var(&c.Raft.SlowPeerLag, "slowPeerLag", c.Raft.SlowPeerLag, "log entries a peer may miss before the leader warns about it")
+	fs.IntVar(&c.Raft.TransportMaxPool, "transportMaxPool", c.Raft.TransportMaxPool, "pooled raft connections per peer")
+	fs.Var(&c.Raft.TransportTimeout, "transportTimeout", "raft RPC io timeout")
+	fs.StringVar(&c.Raft.TLSCert, "raftCert", c.Raft.TLSCert, "raft peer TLS certificate file")
+	fs.StringVar(&c.Raft.TLSKey, "raftKey", c.Raft.TLSKey, "raft peer TLS key file")
+	fs.StringVar(&c.Raft.TLSCA, "raftCA", c.Raft.TLSCA, "CA file used to verify raft peer certificates")
+	fs.BoolVar(&c.Raft.TLSVerifyServerID, "raftVerifyServerID", c.Raft.TLSVerifyServerID, "require raft peer certificates to name the peer's server id")
+
+	// storage
+	fs.StringVar(&c.Storage.DataDir, "dataDir", c.Storage.DataDir, "data directory")
+	fs.StringVar(&c.Storage.SnapshotPath, "snapshotPath", c.Storage.SnapshotPath, "raft snapshot path")
+	fs.StringVar(&c.Storage.RaftDBPath, "raftDBPath", c.Storage.RaftDBPath, "raft raftDB path")
+	fs.IntVar(&c.Storage.SnapshotRetain, "snapshotRetain", c.Storage.SnapshotRetain, "number of snapshots kept on disk")
+	fs.StringVar(&c.Storage.LogStore, "logStore", c.Storage.LogStore, "raft log store: bolt, segment or memory")
+	fs.IntVar(&c.Storage.LogCacheSize, "logCacheSize", c.Storage.LogCacheSize, "number of recent raft log entries cached in memory")
+	fs.Int64Var(&c.Storage.SegmentSize, "segmentSize", c.Storage.SegmentSize, "size of a segment file of the segment log store")
+
+	// api
+	fs.StringVar(&c.API.Addr, "testAddr", c.API.Addr, "http api addr")
+	fs.StringVar(&c.API.Port, "testPort", c.API.Port, "http api port")
+	fs.StringVar(&c.API.Advertise, "apiAdvertise", c.API.Advertise, "api address advertised to the other members, the https one when TLS is enabled")
+	fs.BoolVar(&c.API.TLSEnabled, "tlsEnabled", c.API.TLSEnabled, "http api served over TLS")
+	fs.StringVar(&c.API.HTTPSPort, "httpsPort", c.API.HTTPSPort, "https api port")
+	fs.StringVar(&c.API.TLSCert, "tlsCert", c.API.TLSCert, "https api certificate file")
+	fs.StringVar(&c.API.TLSKey, "tlsKey", c.API.TLSKey, "https api key file")
+	fs.StringVar(&c.API.TLSClientCA, "tlsClientCA", c.API.TLSClientCA, "CA file used to verify https api client certificates")
+	fs.BoolVar(&c.API.TLSRequired, "tlsRequired", c.API.TLSRequired, "refuse plain http api requests")
+	fs.Int64Var(&c.API.MaxValueSize, "maxValueSize", c.API.MaxValueSize, "largest value in bytes accepted by the v1 api")
+	fs.Int64Var(&c.API.MaxBackupSize, "maxBackupSize", c.API.MaxBackupSize, "largest backup in bytes accepted by /admin/restore")
+
+	// replication
+	fs.StringVar(&c.Replication.Targets, "replicateTo", c.Replication.Targets, "Comma separated API addresses of a standby cluster to replicate to")
+	fs.StringVar(&c.Replication.Prefixes, "replicatePrefixes", c.Replication.Prefixes, "Comma separated key prefixes to replicate, all keys if empty")
+	fs.StringVar(&c.Replication.Checkpoint, "replicateCheckpoint", c.Replication.Checkpoint, "replication checkpoint file")
+	fs.Var(&c.Replication.Interval, "replicateInterval", "replication poll interval")
+
+	// log
+	fs.StringVar(&c.Log.Level, "logLevel", c.Log.Level, "log level: debug, info, warn or error")
+	fs.StringVar(&c.Log.Format, "logFormat", c.Log.Format, "log format: text or json")
+
+	// trace
+	fs.StringVar(&c.Trace.File, "traceFile", c.Trace.File, "file the request trace spans are appended to, kept in memory if empty")
+	fs.IntVar(&c.Trace.RingSize, "traceRingSize", c.Trace.RingSize, "number of trace spans kept in memory, 0 disables tracing")
+
+	return fs
+}
+
+// Validate reports every invalid setting at once
+func (c *Config) Validate() error {
+	var errs []string
+	add := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Sprintf(format, args...))
+	}
+
+	if _, _, err := net.SplitHostPort(c.Node.BindAddr); err != nil {
+		add("bind: invalid address %q: %v", c.Node.BindAddr, err)
+	}
+	if c.Node.AdvertiseAddr != "" {
+		if _, _, err := net.SplitHostPort(c.Node.AdvertiseAddr); err != nil {
+			add("advertise: invalid address %q: %v", c.Node.AdvertiseAddr, err)
+		}
+	}
+	if _, err := raftnode.ParseCluster(c.Node.Cluster); err != nil {
+		add("cluster: %v", err)
+	}
+	if c.Node.Bootstrap && c.Node.Join != "" {
+		add("bootstrap and join are mutually exclusive")
+	}
+	if c.Node.ShutdownTimeout <= 0 {
+		add("shutdownTimeout: must be positive")
+	}
+
+	r := c.Raft
+	if r.HeartbeatTimeout < Duration(5*time.Millisecond) {
+		add("heartbeatTimeout: must be at least 5ms")
+	}
+	if r.ElectionTimeout < r.HeartbeatTimeout {
+		add("electionTimeout: must not be less than heartbeatTimeout")
+	}
+	if r.CommitTimeout < Duration(time.Millisecond) {
+		add("commitTimeout: must be at least 1ms")
+	}
+	if r.LeaderLeaseTimeout < Duration(5*time.Millisecond) || r.LeaderLeaseTimeout > r.HeartbeatTimeout {
+		add("leaderLeaseTimeout: must be between 5ms and heartbeatTimeout")
+	}
+	if r.MaxAppendEntries <= 0 || r.MaxAppendEntries > 1024 {
+		add("maxAppendEntries: must be between 1 and 1024")
+	}
+	if r.SnapshotInterval < Duration(5*time.Millisecond) {
+		add("snapshotInterval: must be at least 5ms")
+	}
+	if r.SnapshotThreshold == 0 {
+		add("snapshotThreshold: must be positive")
+	}
+	if r.ApplyTimeout <= 0 {
+		add("applyTimeout: must be positive")
+	}
+	if r.ReadyMaxLag == 0 {
+		add("readyMaxLag: must be positive")
+	}
+	if r.SlowPeerLag == 0 {
+		add("slowPeerLag: must be positive")
+	}
+	if r.TransportMaxPool <= 0 {
+		add("transportMaxPool: must be positive")
+	}
+	if r.TransportTimeout <= 0 {
+		add("transportTimeout: must be positive")
+	}
+	if r.TLSCert != "" || r.TLSKey != "" || r.TLSCA != "" {
+		if r.TLSCert == "" || r.TLSKey == "" || r.TLSCA == "" {
+			add("raftCert, raftKey and raftCA: must be set together")
+		}
+	} else if r.TLSVerifyServerID {
+		add("raftVerifyServerID: requires raft TLS")
+	}
+
+	groups := make(map[string]bool)
+	for i, g := range c.Shards.Groups {
+		if g.Name == "" || strings.ContainsAny(g.Name, `/\`) {
+			add("shards.groups[%d]: invalid name %q", i, g.Name)
+		}
+		if groups[g.Name] {
+			add("shards.groups[%d]: duplicate name %q", i, g.Name)
+		}
+		groups[g.Name] = true
+		if _, _, err := net.SplitHostPort(g.BindAddr); err != nil {
+			add("shards.groups[%d]: invalid bind address %q: %v", i, g.BindAddr, err)
+		}
+		if g.BindAddr == c.Node.BindAddr {
+			add("shards.groups[%d]: bind address %q is used by the metadata group", i, g.BindAddr)
+		}
+		if _, err := raftnode.ParseCluster(g.Cluster); err != nil {
+			add("shards.groups[%d]: cluster: %v", i, err)
+		}
+	}
+
+	if c.Replication.Targets != "" && c.Replication.Interval <= 0 {
+		add("replicateInterval: must be positive")
+	}
+	if c.Replication.Targets != "" && len(c.Shards.Groups) > 0 {
+		add("replicateTo: replication of sharded nodes is not supported")
+	}
+
+	if c.Storage.SnapshotRetain <= 0 {
+		add("snapshotRetain: must be positive")
+	}
+	switch c.Storage.LogStore {
+	case raftnode.LogStoreBolt, raftnode.LogStoreSegment, raftnode.LogStoreMemory:
+	default:
+		add("logStore: unknown log store %q", c.Storage.LogStore)
+	}
+	if c.Storage.LogCacheSize <= 0 {
+		add("logCacheSize: must be positive")
+	}
+	if c.Storage.SegmentSize <= 0 {
+		add("segmentSize: must be positive")
+	}
+
+	if c.API.Addr == "" {
+		add("testAddr: must not be empty")
+	}
+	if port, err := strconv.Atoi(c.API.Port); err != nil || port <= 0 || port > 65535 {
+		add("testPort: invalid port %q", c.API.Port)
+	}
+	if c.API.TLSEnabled && !c.Node.Mux {
+		if port, err := strconv.Atoi(c.API.HTTPSPort); err != nil || port <= 0 || port > 65535 {
+			add("httpsPort: invalid port %q", c.API.HTTPSPort)
+		} else if c.API.HTTPSPort == c.API.Port {
+			add("httpsPort: must differ from testPort")
+		}
+	}
+	if c.API.TLSEnabled {
+		if c.API.TLSCert == "" || c.API.TLSKey == "" {
+			add("tlsCert and tlsKey: required with tlsEnabled")
+		}
+	} else if c.API.TLSRequired {
+		add("tlsRequired: requires tlsEnabled")
+	}
+	if c.API.Advertise != "" {
+		if _, _, err := net.SplitHostPort(c.API.Advertise); err != nil {
+			add("apiAdvertise: %v", err)
+		}
+	}
+	if c.API.MaxValueSize <= 0 {
+		add("maxValueSize: must be positive")
+	}
+	if c.API.MaxBackupSize <= 0 {
+		add("maxBackupSize: must be positive")
+	}
+
+	if _, err := logging.ParseLevel(c.Log.Level); err != nil {
+		add("logLevel: %v", err)
+	}
+	if c.Log.Format != logging.FormatText && c.Log.Format != logging.FormatJSON {
+		add("logFormat: unknown log format %q, expected text or json", c.Log.Format)
+	}
+
+	if c.Trace.RingSize < 0 {
+		add("traceRingSize: must not be negative")
+	}
+
+	if len(errs) > 0 {
+		return errors.New("invalid config:\n  " + strings.Join(errs, "\n  "))
+	}
+	return nil
+}
+
+// RaftNode returns the raftnode config
+func (c *Config) RaftNode() *raftnode.Config {
+	return &raftnode.Config{
+		ID:            c.Node.ID,
+		BindAddr:      c.Node.BindAddr,
+		AdvertiseAddr: c.Node.AdvertiseAddr,
+		Cluster:       c.Node.Cluster,
+		Bootstrap:     c.Node.Bootstrap,
+		Zone:          c.Node.Zone,
+		APIAddr:       c.APIAdvertiseAddr(),
+
+		DataDir:      c.Storage.DataDir,
+		SnapshotPath: c.Storage.SnapshotPath,
+		RaftDBPath:   c.Storage.RaftDBPath,
+		LogStore:     c.Storage.LogStore,
+		LogCacheSize: c.Storage.LogCacheSize,
+		SegmentSize:  c.Storage.SegmentSize,
+
+		HeartbeatTimeout:   time.Duration(c.Raft.HeartbeatTimeout),
+		ElectionTimeout:    time.Duration(c.Raft.ElectionTimeout),
+		CommitTimeout:      time.Duration(c.Raft.CommitTimeout),
+		LeaderLeaseTimeout: time.Duration(c.Raft.LeaderLeaseTimeout),
+		MaxAppendEntries:   c.Raft.MaxAppendEntries,
+		SnapshotInterval:   time.Duration(c.Raft.SnapshotInterval),
+		SnapshotThreshold:  c.Raft.SnapshotThreshold,
+		TrailingLogs:       c.Raft.TrailingLogs,
+		SnapshotRetain:     c.Storage.SnapshotRetain,
+		ApplyTimeout:       time.Duration(c.Raft.ApplyTimeout),
+		ReadyMaxLag:        c.Raft.ReadyMaxLag,
+		SlowPeerLag:        c.Raft.SlowPeerLag,
+		TransportMaxPool:   c.Raft.TransportMaxPool,
+		TransportTimeout:   time.Duration(c.Raft.TransportTimeout),
+
+		TLSCertFile:       c.Raft.TLSCert,
+		TLSKeyFile:        c.Raft.TLSKey,
+		TLSCAFile:         c.Raft.TLSCA,
+		TLSVerifyServerID: c.Raft.TLSVerifyServerID,
+	}
+}
+
+// APIAdvertiseAddr is the api address advertised to the other members, the
+// https one when TLS is enabled as the members then talk https to each other
+func (c *Config) APIAdvertiseAddr() string {
+	switch {
+	case c.API.Advertise != "":
+		return c.API.Advertise
+	case c.Node.Mux && c.Node.AdvertiseAddr != "":
+		return c.Node.AdvertiseAddr
+	case c.Node.Mux:
+		return c.Node.BindAddr
+	case c.API.TLSEnabled:
+		return net.JoinHostPort(c.API.Addr, c.API.HTTPSPort)
+	}
+	return net.JoinHostPort(c.API.Addr, c.API.Port)
+}
+
+// GroupNode returns the raftnode config of a data group. The group shares the
+// node id and keeps its state in a groups/<name> directory below dataDir.
+func (c *Config) GroupNode(g GroupConfig, id, dataDir string) *raftnode.Config {
+	rc := c.RaftNode()
+	rc.ID = id
+	rc.BindAddr = g.BindAddr
+	rc.AdvertiseAddr = g.AdvertiseAddr
+	rc.Cluster = g.Cluster
+	rc.DataDir = filepath.Join(dataDir, "groups", g.Name)
+	rc.Logger = logging.Default().With("group", g.Name)
+	if rc.SnapshotPath != "" {
+		rc.SnapshotPath = filepath.Join(rc.SnapshotPath, "groups", g.Name)
+	}
+	if rc.RaftDBPath != "" {
+		rc.RaftDBPath = filepath.Join(rc.RaftDBPath, "groups", g.Name)
+	}
+	return rc
+}
+
+// Logger returns a logger writing to w with the configured level and format
+func (c *Config) Logger(w io.Writer) (*logging.Logger, error) {
+	level, err := logging.ParseLevel(c.Log.Level)
+	if err != nil {
+		return nil, err
+	}
+	return logging.New(w, level, c.Log.Format)
+}
+
+// Tracer returns the tracer of the trace settings, nil when tracing is off
+func (c *Config) Tracer() (*tracing.Tracer, error) {
+	if c.Trace.File != "" {
+		exporter, err := tracing.OpenFile(c.Trace.File)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to open trace file (%s): (%v)", c.Trace.File, err)
+		}
+		return tracing.New(exporter), nil
+	}
+	if c.Trace.RingSize == 0 {
+		return nil, nil
+	}
+	return tracing.New(tracing.NewRing(c.Trace.RingSize)), nil
+}
+
+// String returns the config as indented JSON
+func (c *Config) String() string {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err.Error()
+	}
+	return string(data)
+}
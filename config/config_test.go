@@ -0,0 +1,107 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadPrecedence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "depot-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "depot.json")
+	ioutil.WriteFile(path, []byte(`{
+		"node": {"id": "file-id", "bind": "127.0.0.1:30411"},
+		"raft": {"snapshot_threshold": 100, "snapshot_interval": "1m"},
+		"api": {"port": "9011"}
+	}`), 0600)
+
+	os.Setenv("DEPOT_SNAPSHOT_THRESHOLD", "200")
+	os.Setenv("DEPOT_TEST_PORT", "9012")
+	defer os.Unsetenv("DEPOT_SNAPSHOT_THRESHOLD")
+	defer os.Unsetenv("DEPOT_TEST_PORT")
+
+	c, err := Load("depot", []string{"-config", path, "-testPort", "9013"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Node.ID != "file-id" || c.Node.BindAddr != "127.0.0.1:30411" {
+		t.Fatalf("file values not applied: %+v", c.Node)
+	}
+	if time.Duration(c.Raft.SnapshotInterval) != time.Minute {
+		t.Fatalf("expected snapshot interval 1m, got %s", c.Raft.SnapshotInterval)
+	}
+	if c.Raft.SnapshotThreshold != 200 {
+		t.Fatalf("expected env to override file, got %d", c.Raft.SnapshotThreshold)
+	}
+	if c.API.Port != "9013" {
+		t.Fatalf("expected flag to override env, got %s", c.API.Port)
+	}
+	if c.Raft.TrailingLogs != Default().Raft.TrailingLogs {
+		t.Fatalf("expected default trailing logs, got %d", c.Raft.TrailingLogs)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	_, err := Load("depot", []string{"-bind", "nope", "-snapshotThreshold", "0", "-bootstrap", "-join", "127.0.0.1:9001", "-tlsEnabled", "-raftCert", "node.crt", "-logLevel", "loud"})
+	if err == nil {
+		t.Fatal("expected validation error")
+	}
+	for _, want := range []string{"bind:", "snapshotThreshold:", "mutually exclusive", "httpsPort:", "tlsCert and tlsKey:", "raftCert, raftKey and raftCA:", "logLevel:"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("expected %q in %v", want, err)
+		}
+	}
+}
+
+func TestEnvName(t *testing.T) {
+	for flag, env := range map[string]string{
+		"id":                "DEPOT_ID",
+		"snapshotThreshold": "DEPOT_SNAPSHOT_THRESHOLD",
+		"raftDBPath":        "DEPOT_RAFT_DB_PATH",
+		"print-config":      "DEPOT_PRINT_CONFIG",
+		"raftCA":            "DEPOT_RAFT_CA",
+		"tlsClientCA":       "DEPOT_TLS_CLIENT_CA",
+	} {
+		if got := envName(flag); got != env {
+			t.Fatalf("envName(%s) = %s, want %s", flag, got, env)
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "depot-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "depot.json")
+	ioutil.WriteFile(path, []byte(`{"raft": {"snapshot_threshold": 100}}`), 0600)
+	c, err := Load("depot", []string{"-config", path})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ioutil.WriteFile(path, []byte(`{"node": {"bind": "127.0.0.1:30499"}, "raft": {"snapshot_threshold": 500}}`), 0600)
+	next, result, err := c.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Applied) != 1 || result.Applied[0] != "raft.snapshot_threshold" {
+		t.Fatalf("bad applied settings: %v", result.Applied)
+	}
+	if len(result.RestartRequired) != 1 || result.RestartRequired[0] != "node.bind" {
+		t.Fatalf("bad restart required settings: %v", result.RestartRequired)
+	}
+	if next.Raft.SnapshotThreshold != 500 || next.Node.BindAddr != c.Node.BindAddr {
+		t.Fatalf("bad reloaded config: %+v", next)
+	}
+}
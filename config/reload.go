@@ -0,0 +1,99 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// liveSettings are the settings which can change without a restart, keyed by
+// their path in the config file
+var liveSettings = map[string]func(dst, src *Config){
+	"node.leave":              func(dst, src *Config) { dst.Node.Leave = src.Node.Leave },
+	"node.shutdown_timeout":   func(dst, src *Config) { dst.Node.ShutdownTimeout = src.Node.ShutdownTimeout },
+	"raft.snapshot_interval":  func(dst, src *Config) { dst.Raft.SnapshotInterval = src.Raft.SnapshotInterval },
+	"raft.snapshot_threshold": func(dst, src *Config) { dst.Raft.SnapshotThreshold = src.Raft.SnapshotThreshold },
+	"raft.apply_timeout":      func(dst, src *Config) { dst.Raft.ApplyTimeout = src.Raft.ApplyTimeout },
+	"log.level":               func(dst, src *Config) { dst.Log.Level = src.Log.Level },
+}
+
+// ReloadResult lists the settings changed by a reload
+type ReloadResult struct {
+	// Applied settings are live in the returned config
+	Applied []string `json:"applied"`
+	// RestartRequired settings changed in the sources but keep their old value
+	// until the process is restarted
+	RestartRequired []string `json:"restart_required"`
+}
+
+// Reload loads the config again from the same file, environment and args. It
+// returns a copy of c with the settings that can change live updated; the
+// caller is responsible for pushing them to the running node.
+func (c *Config) Reload() (*Config, *ReloadResult, error) {
+	n, err := Load(c.name, c.args)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	changed, err := diff(c, n)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	next := *c
+	result := &ReloadResult{Applied: []string{}, RestartRequired: []string{}}
+	for _, key := range changed {
+		if apply, ok := liveSettings[key]; ok {
+			apply(&next, n)
+			result.Applied = append(result.Applied, key)
+		} else {
+			result.RestartRequired = append(result.RestartRequired, key)
+		}
+	}
+	return &next, result, nil
+}
+
+// diff returns the sorted paths of the settings that differ between a and b
+func diff(a, b *Config) ([]string, error) {
+	fa, err := flatten(a)
+	if err != nil {
+		return nil, err
+	}
+	fb, err := flatten(b)
+	if err != nil {
+		return nil, err
+	}
+	var changed []string
+	for key, va := range fa {
+		if !reflect.DeepEqual(va, fb[key]) {
+			changed = append(changed, key)
+		}
+	}
+	for key := range fb {
+		if _, ok := fa[key]; !ok {
+			changed = append(changed, key)
+		}
+	}
+	sort.Strings(changed)
+	return changed, nil
+}
+
+// flatten maps a config to "section.setting" paths using its JSON form
+func flatten(c *Config) (map[string]interface{}, error) {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	var sections map[string]map[string]interface{}
+	if err := json.Unmarshal(data, &sections); err != nil {
+		return nil, err
+	}
+	flat := make(map[string]interface{})
+	for section, settings := range sections {
+		for key, value := range settings {
+			flat[fmt.Sprintf("%s.%s", section, key)] = value
+		}
+	}
+	return flat, nil
+}
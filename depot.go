@@ -1,39 +1,311 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
 
+	"github.com/forjoin92/depot/config"
+	"github.com/forjoin92/depot/logging"
+	"github.com/forjoin92/depot/mux"
 	"github.com/forjoin92/depot/raftnode"
+	"github.com/forjoin92/depot/replication"
 	"github.com/forjoin92/depot/service"
+	"github.com/forjoin92/depot/shard"
+	"github.com/forjoin92/depot/tracing"
 )
 
 func main() {
-	cluster := flag.String("cluster", "127.0.0.1:30401", "Comma separated cluster peers")
-	id := flag.String("id", "127.0.0.1:30401", "Node id")
-	snapshotPath := flag.String("snapshotPath", "", "raft snapshot path")
-	raftDBPath := flag.String("raftDBPath", "", "raft raftDB path")
-	testAddr := flag.String("testAddr", "127.0.0.1", "test addr")
-	testPort := flag.String("testPort", "9001", "test port")
-	dataDir := flag.String("dataDir", "", "data directory")
-	flag.Parse()
+	cfg, err := config.Load(os.Args[0], os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if cfg.PrintConfig {
+		fmt.Println(cfg)
+		return
+	}
+
+	// 日志写到stderr，标准库log的输出也转成结构化日志
+	logger, err := cfg.Logger(os.Stderr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	logging.SetDefault(logger)
+	log.SetFlags(0)
+	log.SetOutput(logger.Writer())
+
+	// 请求跟踪，span写到文件或者保存在内存中
+	tracer, err := cfg.Tracer()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// 离线恢复丢失多数节点的集群
+	if cfg.Recover != "" {
+		recoverCluster(cfg.RaftNode(), cfg.Recover)
+		return
+	}
+
+	// raft和http api共用bind端口
+	rc := cfg.RaftNode()
+	rc.Tracer = tracer
+	var m *mux.Mux
+	if cfg.Node.Mux {
+		m, err = mux.Listen(cfg.Node.BindAddr)
+		if err != nil {
+			panic(err)
+		}
+		go m.Serve()
+		rc.Mux = m
+	}
 
 	// 新建raft节点
-	node, err := raftnode.NewRaftNode(*id, *cluster, *snapshotPath, *raftDBPath, *dataDir)
+	node, err := raftnode.NewRaftNode(rc)
 	if err != nil {
 		panic(err)
 	}
 
 	// http服务，提供keyvalue的增删改查和增删节点
-	httpServer, err := service.NewHTTPServer(node, *testAddr, *testPort, false, false)
+	httpServer, err := service.NewHTTPServer(node, cfg.API.Addr, cfg.API.Port, cfg.API.TLSEnabled, cfg.API.TLSRequired)
 	if err != nil {
 		panic(err)
 	}
+	if m != nil {
+		httpServer.SetMux(m)
+	}
+	httpServer.SetMaxValueSize(cfg.API.MaxValueSize)
+	httpServer.SetMaxBackupSize(cfg.API.MaxBackupSize)
+	if cfg.API.TLSEnabled {
+		if err := httpServer.SetTLS(cfg.API.HTTPSPort, cfg.API.TLSCert, cfg.API.TLSKey, cfg.API.TLSClientCA); err != nil {
+			panic(err)
+		}
+	}
+	// 加入已有集群，依次重试种子节点直到被接受
+	var joiner *service.Joiner
+	if cfg.Node.Join != "" {
+		if node.HasExistingState() {
+			node.Logger().Warn("Node has existing raft state, ignoring -join")
+		} else {
+			joiner = service.NewJoiner(node, service.SplitSeeds(cfg.Node.Join))
+			httpServer.SetJoiner(joiner)
+		}
+	}
+
+	// 分片：每个数据raft组负责一段key，路由表保存在本节点的raft组中
+	var shards *shard.Host
+	if len(cfg.Shards.Groups) > 0 {
+		shards, err = newShards(cfg, node, tracer)
+		if err != nil {
+			panic(err)
+		}
+		httpServer.SetShards(shards)
+	}
+
+	// 异步复制到备用集群
+	var agent *replication.Agent
+	if cfg.Replication.Targets != "" {
+		agent, err = newReplication(cfg, node, httpServer)
+		if err != nil {
+			panic(err)
+		}
+		httpServer.SetReplication(agent)
+	}
+
+	// SIGHUP和/admin/reload重新加载配置
+	reloader := &reloader{cfg: cfg, node: node, shards: shards, api: httpServer, logger: logger}
+	httpServer.SetReloader(reloader.Reload)
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	stop := make(chan struct{})
+
 	var wg sync.WaitGroup
 	wg.Add(1)
 	go func() {
 		httpServer.Serve()
 		wg.Done()
 	}()
+	// 向leader上报本节点的版本和支持的命令
+	go httpServer.ReportInfo(stop)
+	if joiner != nil {
+		go joiner.Run(stop)
+	}
+	if agent != nil {
+		go agent.Run(stop)
+	}
+
+	for sig := range sigCh {
+		if sig == syscall.SIGHUP {
+			reloader.Reload()
+			continue
+		}
+		node.Logger().Info("Shutting down", "signal", sig)
+		break
+	}
+	close(stop)
+	cfg = reloader.Config()
+
+	// 停止接收请求，等待处理中的请求完成
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.Node.ShutdownTimeout))
+	if err := httpServer.Shutdown(ctx); err != nil {
+		node.Logger().Error("Failed to shutdown http server", "err", err)
+	}
+	cancel()
 	wg.Wait()
+
+	if cfg.Node.Leave {
+		if err := httpServer.Leave(); err != nil {
+			node.Logger().Error("Failed to leave cluster", "err", err)
+		}
+	}
+	if shards != nil {
+		shards.Close()
+	}
+	if err := node.Close(); err != nil {
+		node.Logger().Error("Failed to close node", "err", err)
+		os.Exit(1)
+	}
+	if m != nil {
+		m.Close()
+	}
+	if err := tracer.Close(); err != nil {
+		node.Logger().Error("Failed to close trace file", "err", err)
+	}
+	node.Logger().Info("Node stopped")
+}
+
+func newShards(cfg *config.Config, meta *raftnode.RaftNode, tracer *tracing.Tracer) (*shard.Host, error) {
+	groups := make(map[string]*raftnode.RaftNode)
+	for _, g := range cfg.Shards.Groups {
+		rc := cfg.GroupNode(g, meta.ID(), meta.DataDir())
+		rc.Tracer = tracer.With("group", g.Name)
+		node, err := raftnode.NewRaftNode(rc)
+		if err != nil {
+			for _, started := range groups {
+				started.Close()
+			}
+			return nil, fmt.Errorf("Failed to start group %s: (%v)", g.Name, err)
+		}
+		groups[g.Name] = node
+	}
+	return shard.NewHost(meta, groups)
+}
+
+func newReplication(cfg *config.Config, node *raftnode.RaftNode, api *service.HTTPServer) (*replication.Agent, error) {
+	checkpoint := cfg.Replication.Checkpoint
+	if checkpoint == "" {
+		checkpoint = filepath.Join(node.DataDir(), "replication.checkpoint")
+	}
+	var prefixes []string
+	if cfg.Replication.Prefixes != "" {
+		prefixes = strings.Split(cfg.Replication.Prefixes, ",")
+	}
+	// the standby cluster is reached like the other members
+	client, scheme := api.PeerClient()
+	return replication.NewAgent(node, replication.Config{
+		Targets:        strings.Split(cfg.Replication.Targets, ","),
+		Prefixes:       prefixes,
+		CheckpointPath: checkpoint,
+		Interval:       time.Duration(cfg.Replication.Interval),
+		Client:         client,
+		Scheme:         scheme,
+	})
+}
+
+func recoverCluster(config *raftnode.Config, peersPath string) {
+	fmt.Println(raftnode.RecoverWarning)
+	fmt.Println()
+
+	configuration, err := raftnode.ReadPeersFile(peersPath)
+	if err != nil {
+		logging.Default().Error("Failed to read peers file", "path", peersPath, "err", err)
+		os.Exit(1)
+	}
+	if err := raftnode.Recover(config, configuration); err != nil {
+		logging.Default().Error("Failed to recover cluster", "err", err)
+		os.Exit(1)
+	}
+
+	fmt.Println("Recovered raft configuration:")
+	for _, server := range configuration.Servers {
+		fmt.Printf("  %s=%s (%s)\n", server.ID, server.Address, server.Suffrage)
+	}
+}
+
+// reloader 重新加载配置，并把可以在运行时修改的设置应用到节点
+type reloader struct {
+	sync.Mutex
+	cfg  *config.Config
+	node *raftnode.RaftNode
+	// shards holds the data groups, nil when the keyspace is not sharded
+	shards *shard.Host
+	api    *service.HTTPServer
+	logger *logging.Logger
+}
+
+// nodes returns the node's own raft group and every data group
+func (r *reloader) nodes() []*raftnode.RaftNode {
+	nodes := []*raftnode.RaftNode{r.node}
+	if r.shards != nil {
+		for _, name := range r.shards.Groups() {
+			if group, ok := r.shards.Group(name); ok {
+				nodes = append(nodes, group)
+			}
+		}
+	}
+	return nodes
+}
+
+func (r *reloader) Config() *config.Config {
+	r.Lock()
+	defer r.Unlock()
+	return r.cfg
+}
+
+func (r *reloader) Reload() (*config.ReloadResult, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	next, result, err := r.cfg.Reload()
+	if err != nil {
+		r.logger.Error("Failed to reload config", "err", err)
+		return nil, err
+	}
+	r.cfg = next
+	// the data groups share the raft settings of the node
+	for _, node := range r.nodes() {
+		node.SetSnapshotPolicy(time.Duration(next.Raft.SnapshotInterval), next.Raft.SnapshotThreshold)
+		node.SetApplyTimeout(time.Duration(next.Raft.ApplyTimeout))
+	}
+	// the loggers of the groups share the output and so the level
+	if level, err := logging.ParseLevel(next.Log.Level); err == nil {
+		r.logger.SetLevel(level)
+	}
+	// certificates renewed in place are picked up without a restart
+	for _, node := range r.nodes() {
+		if err := node.ReloadTLS(); err != nil {
+			r.logger.Error("Failed to reload raft TLS certificate", "err", err)
+		}
+	}
+	if err := r.api.ReloadTLS(); err != nil {
+		r.logger.Error("Failed to reload api TLS certificate", "err", err)
+	}
+
+	r.logger.Info("Reloaded config", "applied", strings.Join(result.Applied, ","))
+	if len(result.RestartRequired) > 0 {
+		r.logger.Warn("Config changes need a restart to take effect", "settings", strings.Join(result.RestartRequired, ","))
+	}
+	return result, nil
 }
@@ -0,0 +1,100 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// levelTags are the level markers written by hashicorp/raft and the other
+// libraries using its "[LEVEL] component: message" convention
+var levelTags = map[string]Level{
+	"[TRACE]": LevelDebug,
+	"[DEBUG]": LevelDebug,
+	"[INFO]":  LevelInfo,
+	"[WARN]":  LevelWarn,
+	"[ERR]":   LevelError,
+	"[ERROR]": LevelError,
+}
+
+// Writer returns a writer turning each line written to it into a log record,
+// so libraries logging to an io.Writer or a *log.Logger go through l. A
+// "[LEVEL]" marker sets the level of the line, info otherwise, anything before
+// it (the standard log timestamp) is dropped and a leading "component:" is
+// moved to the component field.
+func (l *Logger) Writer() io.Writer {
+	return &lineWriter{logger: l}
+}
+
+// StdLogger returns a *log.Logger writing through l
+func (l *Logger) StdLogger() *log.Logger {
+	return log.New(l.Writer(), "", 0)
+}
+
+// stdTimestamp is the prefix written by a *log.Logger with log.LstdFlags
+var stdTimestamp = regexp.MustCompile(`^\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2}(\.\d+)? `)
+
+type lineWriter struct {
+	logger *Logger
+
+	sync.Mutex
+	buf []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		line := string(w.buf[:i])
+		w.buf = w.buf[i+1:]
+		w.logLine(line)
+	}
+	return len(p), nil
+}
+
+func (w *lineWriter) logLine(line string) {
+	level, at, end := LevelInfo, -1, 0
+	for tag, l := range levelTags {
+		if i := strings.Index(line, tag); i >= 0 && (at < 0 || i < at) {
+			level, at, end = l, i, i+len(tag)
+		}
+	}
+	if at >= 0 {
+		line = line[end:]
+	} else {
+		line = stdTimestamp.ReplaceAllString(line, "")
+	}
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return
+	}
+	if i := strings.Index(line, ": "); i > 0 && !strings.ContainsAny(line[:i], " \t") {
+		w.logger.Log(level, line[i+2:], "component", line[:i])
+		return
+	}
+	w.logger.Log(level, line)
+}
+
+type contextKey struct{}
+
+// NewContext returns a context carrying l
+func NewContext(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, l)
+}
+
+// FromContext returns the logger of ctx, the default logger when it has none
+func FromContext(ctx context.Context) *Logger {
+	if l, ok := ctx.Value(contextKey{}).(*Logger); ok {
+		return l
+	}
+	return Default()
+}
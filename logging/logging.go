@@ -0,0 +1,249 @@
+// Package logging writes leveled, structured log lines as text or JSON.
+//
+// A Logger carries key/value fields, With returns a child logger adding
+// more of them, e.g. the node id or the id of the request being served.
+// Loggers derived from the same root share its output and level.
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Level int32
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return fmt.Sprintf("level(%d)", int32(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel parses debug, info, warn or error
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	if strings.EqualFold(s, "warning") {
+		return LevelWarn, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q, expected debug, info, warn or error", s)
+}
+
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// output is shared by a root logger and every logger derived from it
+type output struct {
+	sync.Mutex
+	w      io.Writer
+	format string
+	level  int32
+	now    func() time.Time
+}
+
+type Logger struct {
+	out *output
+	// fields are the key/value pairs added to every line
+	fields []interface{}
+}
+
+// New returns a logger writing lines of level and above to w in the given
+// format, text or json
+func New(w io.Writer, level Level, format string) (*Logger, error) {
+	if format != FormatText && format != FormatJSON {
+		return nil, fmt.Errorf("unknown log format %q, expected text or json", format)
+	}
+	return &Logger{out: &output{w: w, format: format, level: int32(level), now: time.Now}}, nil
+}
+
+var (
+	defaultMu sync.Mutex
+	std       = &Logger{out: &output{w: os.Stderr, format: FormatText, level: int32(LevelInfo), now: time.Now}}
+)
+
+// Default returns the process wide logger, used by components which are not
+// given one
+func Default() *Logger {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	return std
+}
+
+// SetDefault replaces the process wide logger
+func SetDefault(l *Logger) {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	std = l
+}
+
+// Discard returns a logger which writes nothing
+func Discard() *Logger {
+	return &Logger{out: &output{w: ioutil.Discard, format: FormatText, level: int32(LevelError + 1), now: time.Now}}
+}
+
+// With returns a logger adding the key/value pairs to every line
+func (l *Logger) With(kv ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(append(fields, l.fields...), kv...)
+	return &Logger{out: l.out, fields: fields}
+}
+
+// SetLevel changes the level of l and of every logger sharing its output
+func (l *Logger) SetLevel(level Level) {
+	atomic.StoreInt32(&l.out.level, int32(level))
+}
+
+func (l *Logger) Level() Level {
+	return Level(atomic.LoadInt32(&l.out.level))
+}
+
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.Level()
+}
+
+func (l *Logger) Debug(msg string, kv ...interface{}) { l.Log(LevelDebug, msg, kv...) }
+func (l *Logger) Info(msg string, kv ...interface{})  { l.Log(LevelInfo, msg, kv...) }
+func (l *Logger) Warn(msg string, kv ...interface{})  { l.Log(LevelWarn, msg, kv...) }
+func (l *Logger) Error(msg string, kv ...interface{}) { l.Log(LevelError, msg, kv...) }
+
+// Log writes msg with the logger's fields followed by kv, given as
+// alternating keys and values
+func (l *Logger) Log(level Level, msg string, kv ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	fields := l.fields
+	if len(kv) > 0 {
+		fields = append(append(make([]interface{}, 0, len(fields)+len(kv)), fields...), kv...)
+	}
+
+	var buf bytes.Buffer
+	now := l.out.now().UTC()
+	if l.out.format == FormatJSON {
+		writeJSON(&buf, now, level, msg, fields)
+	} else {
+		writeText(&buf, now, level, msg, fields)
+	}
+
+	l.out.Lock()
+	defer l.out.Unlock()
+	l.out.w.Write(buf.Bytes())
+}
+
+const timeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+func writeText(buf *bytes.Buffer, now time.Time, level Level, msg string, fields []interface{}) {
+	buf.WriteString(now.Format(timeFormat))
+	buf.WriteByte(' ')
+	buf.WriteString(strings.ToUpper(level.String()))
+	buf.WriteByte(' ')
+	buf.WriteString(msg)
+	eachField(fields, func(key string, value interface{}) {
+		buf.WriteByte(' ')
+		buf.WriteString(key)
+		buf.WriteByte('=')
+		buf.WriteString(quoteText(textValue(value)))
+	})
+	buf.WriteByte('\n')
+}
+
+func writeJSON(buf *bytes.Buffer, now time.Time, level Level, msg string, fields []interface{}) {
+	buf.WriteString(`{"time":`)
+	buf.WriteString(strconv.Quote(now.Format(timeFormat)))
+	buf.WriteString(`,"level":`)
+	buf.WriteString(strconv.Quote(level.String()))
+	buf.WriteString(`,"msg":`)
+	writeJSONValue(buf, msg)
+	eachField(fields, func(key string, value interface{}) {
+		buf.WriteByte(',')
+		writeJSONValue(buf, key)
+		buf.WriteByte(':')
+		writeJSONValue(buf, jsonValue(value))
+	})
+	buf.WriteString("}\n")
+}
+
+// eachField calls fn for every key/value pair, a missing last value is
+// reported as such rather than dropped
+func eachField(fields []interface{}, fn func(key string, value interface{})) {
+	for i := 0; i < len(fields); i += 2 {
+		key := fmt.Sprint(fields[i])
+		if i+1 == len(fields) {
+			fn(key, "(missing)")
+			break
+		}
+		fn(key, fields[i+1])
+	}
+}
+
+func textValue(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	case []byte:
+		return string(v)
+	}
+	return fmt.Sprint(v)
+}
+
+// quoteText quotes values that would otherwise break the key=value layout
+func quoteText(s string) string {
+	if s == "" {
+		return `""`
+	}
+	for _, r := range s {
+		if r <= ' ' || r == '=' || r == '"' || r == 0x7f {
+			return strconv.Quote(s)
+		}
+	}
+	return s
+}
+
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case time.Duration:
+		return v.String()
+	case fmt.Stringer:
+		return v.String()
+	case []byte:
+		return string(v)
+	}
+	return v
+}
+
+func writeJSONValue(buf *bytes.Buffer, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprint(v))
+	}
+	buf.Write(data)
+}
@@ -0,0 +1,91 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestLogger(t *testing.T, format string) (*Logger, *bytes.Buffer) {
+	var buf bytes.Buffer
+	l, err := New(&buf, LevelInfo, format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.out.now = func() time.Time { return time.Date(2020, 1, 2, 3, 4, 5, 6e6, time.UTC) }
+	return l, &buf
+}
+
+func TestText(t *testing.T) {
+	l, buf := newTestLogger(t, FormatText)
+	l.With("node_id", "n1").Error("Failed to apply", "err", errors.New("disk full"), "key", "a b", "index", 7)
+	l.Debug("hidden")
+
+	want := "2020-01-02T03:04:05.006Z ERROR Failed to apply node_id=n1 err=\"disk full\" key=\"a b\" index=7\n"
+	if buf.String() != want {
+		t.Fatalf("got %q, want %q", buf.String(), want)
+	}
+}
+
+func TestJSON(t *testing.T) {
+	l, buf := newTestLogger(t, FormatJSON)
+	l.With("node_id", "n1", "request_id", "r1").Info("Moved range", "keys", 3, "backoff", 2*time.Second)
+
+	want := `{"time":"2020-01-02T03:04:05.006Z","level":"info","msg":"Moved range","node_id":"n1","request_id":"r1","keys":3,"backoff":"2s"}` + "\n"
+	if buf.String() != want {
+		t.Fatalf("got %s, want %s", buf.String(), want)
+	}
+	var v map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSetLevel(t *testing.T) {
+	l, buf := newTestLogger(t, FormatText)
+	child := l.With("group", "g1")
+	child.Debug("before")
+	l.SetLevel(LevelDebug)
+	child.Debug("after")
+	if strings.Contains(buf.String(), "before") || !strings.Contains(buf.String(), "DEBUG after group=g1") {
+		t.Fatalf("unexpected output %q", buf.String())
+	}
+
+	if _, err := ParseLevel("loud"); err == nil {
+		t.Fatal("expected an error for an unknown level")
+	}
+	if _, err := New(&bytes.Buffer{}, LevelInfo, "xml"); err == nil {
+		t.Fatal("expected an error for an unknown format")
+	}
+}
+
+func TestWriter(t *testing.T) {
+	l, buf := newTestLogger(t, FormatText)
+	l.SetLevel(LevelDebug)
+	w := l.With("node_id", "n1").Writer()
+	// raft writes through a *log.Logger with log.LstdFlags, lines may be split
+	w.Write([]byte("2020/01/02 03:04:05 [WARN] raft: Heartbeat timeout from \"\" reached"))
+	w.Write([]byte(", starting election\n2020/01/02 03:04:05 [ERR] raft-net: Failed to decode incoming command: EOF\n"))
+	w.Write([]byte("2020/01/02 03:04:05 no level here\n"))
+
+	want := "2020-01-02T03:04:05.006Z WARN Heartbeat timeout from \"\" reached, starting election node_id=n1 component=raft\n" +
+		"2020-01-02T03:04:05.006Z ERROR Failed to decode incoming command: EOF node_id=n1 component=raft-net\n" +
+		"2020-01-02T03:04:05.006Z INFO no level here node_id=n1\n"
+	if buf.String() != want {
+		t.Fatalf("got %q, want %q", buf.String(), want)
+	}
+}
+
+func TestContext(t *testing.T) {
+	l, _ := newTestLogger(t, FormatText)
+	if FromContext(NewContext(context.Background(), l)) != l {
+		t.Fatal("expected the logger of the context")
+	}
+	if FromContext(context.Background()) != Default() {
+		t.Fatal("expected the default logger")
+	}
+}
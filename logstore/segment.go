@@ -0,0 +1,476 @@
+package logstore
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/raft"
+)
+
+const (
+	// DefaultSegmentSize is the size after which a new segment file is started
+	DefaultSegmentSize = 64 * 1024 * 1024
+
+	segmentExt = ".seg"
+	// firstIndexFile records the first index kept after the log was compacted
+	// in the middle of a segment
+	firstIndexFile = "first-index"
+
+	// a record is a 4 byte payload length and a 4 byte crc32 followed by the
+	// payload: index, term, type and data
+	recordHeaderSize  = 8
+	payloadHeaderSize = 17
+)
+
+var errCorrupt = errors.New("corrupt record")
+
+// Segmented is a raft log store appending entries to segment files, so that
+// writes are sequential and a batch costs one fsync. The offset of every
+// entry is kept in memory. Compaction removes whole segments and truncation
+// cuts the last ones.
+type Segmented struct {
+	dir         string
+	segmentSize int64
+
+	sync.RWMutex
+	// segments are ordered by first index, indexes within a segment are
+	// contiguous but there can be a gap between segments after a snapshot
+	// was installed
+	segments []*segment
+	first    uint64
+	last     uint64
+}
+
+type segment struct {
+	first   uint64
+	path    string
+	file    *os.File
+	offsets []int64
+	size    int64
+}
+
+func (s *segment) last() uint64 {
+	return s.first + uint64(len(s.offsets)) - 1
+}
+
+// OpenSegmented opens the log in dir, a torn record at the end of the last
+// segment, left by a crash during a write, is cut off
+func OpenSegmented(dir string, segmentSize int64) (*Segmented, error) {
+	if segmentSize <= 0 {
+		segmentSize = DefaultSegmentSize
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("Failed to mkdir (%s): (%v)", dir, err)
+	}
+	l := &Segmented{dir: dir, segmentSize: segmentSize}
+
+	first, err := l.readFirstIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	names, err := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		seg, err := openSegment(name, i == len(names)-1)
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		// segments left over from a compaction interrupted by a crash
+		if len(seg.offsets) == 0 || (first > 0 && seg.last() < first) {
+			seg.file.Close()
+			os.Remove(seg.path)
+			continue
+		}
+		l.segments = append(l.segments, seg)
+	}
+
+	if len(l.segments) > 0 {
+		l.first = l.segments[0].first
+		if first > l.first {
+			l.first = first
+		}
+		l.last = l.segments[len(l.segments)-1].last()
+	}
+	return l, nil
+}
+
+func openSegment(path string, last bool) (*segment, error) {
+	base := strings.TrimSuffix(filepath.Base(path), segmentExt)
+	first, err := strconv.ParseUint(base, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("bad segment name (%s)", path)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	seg := &segment{first: first, path: path, file: f}
+
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	var offset int64
+	for offset < int64(len(data)) {
+		log, n, err := decodeRecord(data[offset:])
+		if err == nil && log.Index != first+uint64(len(seg.offsets)) {
+			err = fmt.Errorf("unexpected index %d", log.Index)
+		}
+		if err != nil {
+			if !last {
+				f.Close()
+				return nil, fmt.Errorf("segment (%s) at offset %d: %v", path, offset, err)
+			}
+			// only the last segment can end with a partial write
+			if err := f.Truncate(offset); err != nil {
+				f.Close()
+				return nil, err
+			}
+			break
+		}
+		seg.offsets = append(seg.offsets, offset)
+		offset += int64(n)
+	}
+	seg.size = offset
+	return seg, nil
+}
+
+func (l *Segmented) FirstIndex() (uint64, error) {
+	l.RLock()
+	defer l.RUnlock()
+	return l.first, nil
+}
+
+func (l *Segmented) LastIndex() (uint64, error) {
+	l.RLock()
+	defer l.RUnlock()
+	return l.last, nil
+}
+
+func (l *Segmented) GetLog(index uint64, log *raft.Log) error {
+	l.RLock()
+	defer l.RUnlock()
+	if l.last == 0 || index < l.first || index > l.last {
+		return raft.ErrLogNotFound
+	}
+	// the last segment starting at or before index
+	i := sort.Search(len(l.segments), func(i int) bool { return l.segments[i].first > index }) - 1
+	if i < 0 || index > l.segments[i].last() {
+		return raft.ErrLogNotFound
+	}
+	seg := l.segments[i]
+	offset := seg.offsets[index-seg.first]
+	end := seg.size
+	if index < seg.last() {
+		end = seg.offsets[index-seg.first+1]
+	}
+	buf := make([]byte, end-offset)
+	if _, err := seg.file.ReadAt(buf, offset); err != nil {
+		return err
+	}
+	decoded, _, err := decodeRecord(buf)
+	if err != nil {
+		return fmt.Errorf("segment (%s) index %d: %v", seg.path, index, err)
+	}
+	*log = *decoded
+	return nil
+}
+
+func (l *Segmented) StoreLog(log *raft.Log) error {
+	return l.StoreLogs([]*raft.Log{log})
+}
+
+// StoreLogs appends logs and syncs every segment written to once. A segment is
+// synced before the next one is started, only the last segment can end with a
+// torn record after a crash. The entries become visible once they are synced,
+// on error the files are cut back and the log is left as it was.
+func (l *Segmented) StoreLogs(logs []*raft.Log) error {
+	l.Lock()
+	defer l.Unlock()
+
+	var appends []*segmentAppend
+	var current *segmentAppend
+	last := l.last
+	for _, log := range logs {
+		if last != 0 && log.Index <= last {
+			l.abort(appends)
+			return fmt.Errorf("log index %d is not after the last index %d", log.Index, last)
+		}
+		if current == nil && l.tail() != nil {
+			current = &segmentAppend{seg: l.tail()}
+			appends = append(appends, current)
+		}
+		// start a new segment when the log is empty, after a gap or when
+		// the current one is full
+		if current == nil || log.Index != last+1 || current.size() >= l.segmentSize {
+			if current != nil {
+				if err := current.write(); err != nil {
+					l.abort(appends)
+					return err
+				}
+			}
+			seg, err := l.newSegment(log.Index)
+			if err != nil {
+				l.abort(appends)
+				return err
+			}
+			current = &segmentAppend{seg: seg, created: true}
+			appends = append(appends, current)
+		}
+		current.add(encodeRecord(log))
+		last = log.Index
+	}
+	if current != nil {
+		if err := current.write(); err != nil {
+			l.abort(appends)
+			return err
+		}
+	}
+
+	for _, a := range appends {
+		a.seg.offsets = append(a.seg.offsets, a.offsets...)
+		a.seg.size += int64(len(a.buf))
+		if a.created {
+			l.segments = append(l.segments, a.seg)
+		}
+	}
+	if l.first == 0 && len(logs) > 0 {
+		l.first = logs[0].Index
+	}
+	l.last = last
+	return nil
+}
+
+// segmentAppend collects the records a batch appends to one segment
+type segmentAppend struct {
+	seg *segment
+	// created is set for a segment started by the batch
+	created bool
+	offsets []int64
+	buf     []byte
+	written bool
+}
+
+// size is the size of the segment with the records appended
+func (a *segmentAppend) size() int64 {
+	return a.seg.size + int64(len(a.buf))
+}
+
+func (a *segmentAppend) add(record []byte) {
+	a.offsets = append(a.offsets, a.size())
+	a.buf = append(a.buf, record...)
+}
+
+// write appends the records to the file and syncs it
+func (a *segmentAppend) write() error {
+	if len(a.buf) == 0 {
+		return nil
+	}
+	a.written = true
+	if _, err := a.seg.file.WriteAt(a.buf, a.seg.size); err != nil {
+		return err
+	}
+	return a.seg.file.Sync()
+}
+
+// abort removes the segments a failed batch started and cuts the records it
+// wrote off the others
+func (l *Segmented) abort(appends []*segmentAppend) {
+	for _, a := range appends {
+		switch {
+		case a.created:
+			a.seg.file.Close()
+			os.Remove(a.seg.path)
+		case a.written:
+			if err := a.seg.file.Truncate(a.seg.size); err == nil {
+				a.seg.file.Sync()
+			}
+		}
+	}
+}
+
+// DeleteRange removes a prefix (compaction) or a suffix (conflicting entries)
+// of the log
+func (l *Segmented) DeleteRange(min, max uint64) error {
+	l.Lock()
+	defer l.Unlock()
+	if l.last == 0 || max < l.first || min > l.last {
+		return nil
+	}
+
+	switch {
+	case min <= l.first && max >= l.last:
+		for _, seg := range l.segments {
+			seg.file.Close()
+			os.Remove(seg.path)
+		}
+		l.segments = nil
+		l.first, l.last = 0, 0
+		return l.writeFirstIndex(0)
+
+	case min <= l.first:
+		// record the new first index before dropping files, so entries
+		// before it never come back after a crash
+		if err := l.writeFirstIndex(max + 1); err != nil {
+			return err
+		}
+		for len(l.segments) > 0 && l.segments[0].last() <= max {
+			l.segments[0].file.Close()
+			os.Remove(l.segments[0].path)
+			l.segments = l.segments[1:]
+		}
+		l.first = max + 1
+		if len(l.segments) > 0 && l.segments[0].first > l.first {
+			l.first = l.segments[0].first
+		}
+
+	case max >= l.last:
+		for len(l.segments) > 0 && l.tail().first >= min {
+			seg := l.tail()
+			seg.file.Close()
+			os.Remove(seg.path)
+			l.segments = l.segments[:len(l.segments)-1]
+		}
+		if seg := l.tail(); seg != nil && seg.last() >= min {
+			n := min - seg.first
+			if err := seg.file.Truncate(seg.offsets[n]); err != nil {
+				return err
+			}
+			if err := seg.file.Sync(); err != nil {
+				return err
+			}
+			seg.size = seg.offsets[n]
+			seg.offsets = seg.offsets[:n]
+		}
+		l.last = 0
+		if seg := l.tail(); seg != nil {
+			l.last = seg.last()
+		}
+		if l.last == 0 {
+			l.first = 0
+		}
+
+	default:
+		return fmt.Errorf("cannot delete [%d, %d] from the middle of the log [%d, %d]", min, max, l.first, l.last)
+	}
+	return nil
+}
+
+// Size returns the total size of the segment files
+func (l *Segmented) Size() int64 {
+	l.RLock()
+	defer l.RUnlock()
+	var size int64
+	for _, seg := range l.segments {
+		size += seg.size
+	}
+	return size
+}
+
+func (l *Segmented) Close() error {
+	l.Lock()
+	defer l.Unlock()
+	var firstErr error
+	for _, seg := range l.segments {
+		if err := seg.file.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	l.segments = nil
+	return firstErr
+}
+
+func (l *Segmented) tail() *segment {
+	if len(l.segments) == 0 {
+		return nil
+	}
+	return l.segments[len(l.segments)-1]
+}
+
+// newSegment creates the segment file starting at first, the caller adds it
+// to the segments
+func (l *Segmented) newSegment(first uint64) (*segment, error) {
+	path := filepath.Join(l.dir, fmt.Sprintf("%020d%s", first, segmentExt))
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	// make the new file itself durable
+	if err := syncDir(l.dir); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &segment{first: first, path: path, file: f}, nil
+}
+
+func (l *Segmented) readFirstIndex() (uint64, error) {
+	data, err := ioutil.ReadFile(filepath.Join(l.dir, firstIndexFile))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	first, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("bad first index file in (%s): (%v)", l.dir, err)
+	}
+	return first, nil
+}
+
+func (l *Segmented) writeFirstIndex(first uint64) error {
+	return writeFileAtomic(filepath.Join(l.dir, firstIndexFile), []byte(strconv.FormatUint(first, 10)))
+}
+
+func encodeRecord(log *raft.Log) []byte {
+	record := make([]byte, recordHeaderSize+payloadHeaderSize+len(log.Data))
+	payload := record[recordHeaderSize:]
+	binary.BigEndian.PutUint64(payload[0:8], log.Index)
+	binary.BigEndian.PutUint64(payload[8:16], log.Term)
+	payload[16] = byte(log.Type)
+	copy(payload[payloadHeaderSize:], log.Data)
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+	return record
+}
+
+// decodeRecord decodes the record at the start of data and returns its size
+func decodeRecord(data []byte) (*raft.Log, int, error) {
+	if len(data) < recordHeaderSize {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	n := int(binary.BigEndian.Uint32(data[0:4]))
+	if n < payloadHeaderSize {
+		return nil, 0, errCorrupt
+	}
+	if len(data) < recordHeaderSize+n {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	payload := data[recordHeaderSize : recordHeaderSize+n]
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(data[4:8]) {
+		return nil, 0, errCorrupt
+	}
+	log := &raft.Log{
+		Index: binary.BigEndian.Uint64(payload[0:8]),
+		Term:  binary.BigEndian.Uint64(payload[8:16]),
+		Type:  raft.LogType(payload[16]),
+		Data:  append([]byte(nil), payload[payloadHeaderSize:]...),
+	}
+	return log, recordHeaderSize + n, nil
+}
@@ -0,0 +1,255 @@
+package logstore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/raft"
+)
+
+func testLogs(first, last uint64) []*raft.Log {
+	var logs []*raft.Log
+	for i := first; i <= last; i++ {
+		logs = append(logs, &raft.Log{Index: i, Term: 1, Type: raft.LogCommand, Data: []byte(fmt.Sprintf("entry-%d", i))})
+	}
+	return logs
+}
+
+func checkRange(t *testing.T, l *Segmented, first, last uint64) {
+	if got, _ := l.FirstIndex(); got != first {
+		t.Fatalf("first index %d, want %d", got, first)
+	}
+	if got, _ := l.LastIndex(); got != last {
+		t.Fatalf("last index %d, want %d", got, last)
+	}
+	if first == 0 {
+		return
+	}
+	for i := first; i <= last; i++ {
+		var log raft.Log
+		if err := l.GetLog(i, &log); err != nil {
+			t.Fatalf("get %d: %v", i, err)
+		}
+		if log.Index != i || string(log.Data) != fmt.Sprintf("entry-%d", i) {
+			t.Fatalf("bad log at %d: %+v", i, log)
+		}
+	}
+	var log raft.Log
+	if err := l.GetLog(first-1, &log); err != raft.ErrLogNotFound {
+		t.Fatalf("expected log %d to be gone, got %v", first-1, err)
+	}
+	if err := l.GetLog(last+1, &log); err != raft.ErrLogNotFound {
+		t.Fatalf("expected log %d to be missing, got %v", last+1, err)
+	}
+}
+
+func TestSegmentedStoreAndReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "depot-segment")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// small segments so the log spans several files
+	l, err := OpenSegmented(dir, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRange(t, l, 0, 0)
+	if err := l.StoreLogs(testLogs(1, 50)); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.StoreLog(testLogs(51, 51)[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.StoreLog(testLogs(51, 51)[0]); err == nil {
+		t.Fatal("expected an index that is not after the last one to be refused")
+	}
+	checkRange(t, l, 1, 51)
+	if len(l.segments) < 2 {
+		t.Fatalf("expected several segments, got %d", len(l.segments))
+	}
+	size := l.Size()
+	l.Close()
+
+	l, err = OpenSegmented(dir, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	checkRange(t, l, 1, 51)
+	if l.Size() != size {
+		t.Fatalf("size %d after reopen, want %d", l.Size(), size)
+	}
+}
+
+func TestSegmentedTornTail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "depot-segment")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := OpenSegmented(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.StoreLogs(testLogs(1, 10)); err != nil {
+		t.Fatal(err)
+	}
+	path := l.tail().path
+	size := l.tail().size
+	l.Close()
+
+	// a crash in the middle of writing the last record
+	f, err := os.OpenFile(path, os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Truncate(size - 3)
+	f.Close()
+
+	l, err = OpenSegmented(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	checkRange(t, l, 1, 9)
+	if err := l.StoreLogs(testLogs(10, 12)); err != nil {
+		t.Fatal(err)
+	}
+	checkRange(t, l, 1, 12)
+}
+
+func TestSegmentedFailedWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "depot-segment")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := OpenSegmented(dir, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if err := l.StoreLogs(testLogs(1, 3)); err != nil {
+		t.Fatal(err)
+	}
+	segments, size := len(l.segments), l.tail().size
+
+	// the tail can no longer be written, the batch spans several segments
+	l.tail().file.Close()
+	if err := l.StoreLogs(testLogs(4, 50)); err == nil {
+		t.Fatal("expected the write to fail")
+	}
+	if last, _ := l.LastIndex(); last != 3 {
+		t.Fatalf("last index %d after a failed write, want 3", last)
+	}
+	if len(l.segments) != segments || l.tail().size != size || len(l.tail().offsets) != 3 {
+		t.Fatalf("the failed write changed the segments: %d segments, tail of %d bytes", len(l.segments), l.tail().size)
+	}
+	names, _ := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	if len(names) != segments {
+		t.Fatalf("got segment files %v, want %d", names, segments)
+	}
+}
+
+func TestSegmentedDeleteRange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "depot-segment")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := OpenSegmented(dir, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.StoreLogs(testLogs(1, 60)); err != nil {
+		t.Fatal(err)
+	}
+
+	// compaction
+	if err := l.DeleteRange(1, 20); err != nil {
+		t.Fatal(err)
+	}
+	checkRange(t, l, 21, 60)
+	// conflicting entries
+	if err := l.DeleteRange(45, 60); err != nil {
+		t.Fatal(err)
+	}
+	checkRange(t, l, 21, 44)
+	if err := l.DeleteRange(30, 35); err == nil {
+		t.Fatal("expected deleting from the middle to fail")
+	}
+	if err := l.StoreLogs(testLogs(45, 50)); err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+
+	l, err = OpenSegmented(dir, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRange(t, l, 21, 50)
+
+	// an installed snapshot empties the log, the next entries follow a gap
+	if err := l.DeleteRange(21, 50); err != nil {
+		t.Fatal(err)
+	}
+	checkRange(t, l, 0, 0)
+	if err := l.StoreLogs(testLogs(100, 105)); err != nil {
+		t.Fatal(err)
+	}
+	checkRange(t, l, 100, 105)
+	l.Close()
+
+	l, err = OpenSegmented(dir, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	checkRange(t, l, 100, 105)
+	names, _ := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	if len(names) != 1 {
+		t.Fatalf("expected only the new segment to be left, got %v", names)
+	}
+}
+
+func TestFileStable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "depot-stable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "stable.json")
+	s, err := OpenFileStable(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetUint64([]byte("CurrentTerm")); err == nil || err.Error() != "not found" {
+		t.Fatalf("expected not found, got %v", err)
+	}
+	if err := s.SetUint64([]byte("CurrentTerm"), 7); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set([]byte("LastVoteCand"), []byte("node1")); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = OpenFileStable(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if term, err := s.GetUint64([]byte("CurrentTerm")); err != nil || term != 7 {
+		t.Fatalf("term %d (%v), want 7", term, err)
+	}
+	if cand, err := s.Get([]byte("LastVoteCand")); err != nil || string(cand) != "node1" {
+		t.Fatalf("vote %q (%v), want node1", cand, err)
+	}
+}
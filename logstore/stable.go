@@ -0,0 +1,107 @@
+package logstore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// ErrKeyNotFound is what raft expects from a stable store for missing keys
+var ErrKeyNotFound = errors.New("not found")
+
+// FileStable is a raft stable store kept in a small JSON file, rewritten
+// atomically on every change. Raft only stores the current term and vote in
+// it, which change rarely.
+type FileStable struct {
+	path string
+
+	sync.Mutex
+	values map[string][]byte
+}
+
+func OpenFileStable(path string) (*FileStable, error) {
+	s := &FileStable{path: path, values: make(map[string][]byte)}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.values); err != nil {
+		return nil, fmt.Errorf("Failed to parse stable store (%s): (%v)", path, err)
+	}
+	return s, nil
+}
+
+func (s *FileStable) Set(key []byte, val []byte) error {
+	s.Lock()
+	defer s.Unlock()
+	s.values[string(key)] = append([]byte(nil), val...)
+	data, err := json.Marshal(s.values)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data)
+}
+
+func (s *FileStable) Get(key []byte) ([]byte, error) {
+	s.Lock()
+	defer s.Unlock()
+	val, ok := s.values[string(key)]
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	return append([]byte(nil), val...), nil
+}
+
+func (s *FileStable) SetUint64(key []byte, val uint64) error {
+	return s.Set(key, []byte(strconv.FormatUint(val, 10)))
+}
+
+func (s *FileStable) GetUint64(key []byte) (uint64, error) {
+	val, err := s.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(string(val), 10, 64)
+}
+
+// writeFileAtomic replaces path with data, the file is either the old or the
+// new one after a crash
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,167 @@
+// Package metrics keeps counters, gauges and histograms and writes them in
+// the Prometheus text exposition format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	TypeCounter   = "counter"
+	TypeGauge     = "gauge"
+	TypeHistogram = "histogram"
+)
+
+// DefaultBuckets suit latencies in seconds
+var DefaultBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Label is a label name and value
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Sample is one value of a family, Suffix is appended to the family name
+// (_bucket, _sum and _count for histograms)
+type Sample struct {
+	Suffix string
+	Labels []Label
+	Value  float64
+}
+
+// Family is a named metric with all its samples
+type Family struct {
+	Name    string
+	Help    string
+	Type    string
+	Samples []Sample
+}
+
+// Collector returns the current value of its metrics
+type Collector interface {
+	Collect() []Family
+}
+
+// CollectorFunc collects values computed at scrape time
+type CollectorFunc func() []Family
+
+func (f CollectorFunc) Collect() []Family {
+	return f()
+}
+
+// Registry holds the collectors exposed together
+type Registry struct {
+	sync.Mutex
+	collectors []Collector
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) Register(c Collector) {
+	r.Lock()
+	defer r.Unlock()
+	r.collectors = append(r.collectors, c)
+}
+
+// Gather collects every family, families of the same name from different
+// collectors are merged and the result is sorted by name
+func (r *Registry) Gather() []Family {
+	r.Lock()
+	collectors := append([]Collector(nil), r.collectors...)
+	r.Unlock()
+
+	byName := make(map[string]*Family)
+	var names []string
+	for _, c := range collectors {
+		for _, f := range c.Collect() {
+			if existing, ok := byName[f.Name]; ok {
+				existing.Samples = append(existing.Samples, f.Samples...)
+				continue
+			}
+			f := f
+			byName[f.Name] = &f
+			names = append(names, f.Name)
+		}
+	}
+	sort.Strings(names)
+	families := make([]Family, 0, len(names))
+	for _, name := range names {
+		families = append(families, *byName[name])
+	}
+	return families
+}
+
+// WriteText writes every family in the Prometheus text format
+func (r *Registry) WriteText(w io.Writer) error {
+	for _, f := range r.Gather() {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.Name, escapeHelp(f.Help), f.Name, f.Type); err != nil {
+			return err
+		}
+		for _, s := range f.Samples {
+			if _, err := fmt.Fprintf(w, "%s%s%s %s\n", f.Name, s.Suffix, formatLabels(s.Labels), formatValue(s.Value)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// WithLabels adds labels to every sample of c, e.g. to tell apart the raft
+// groups of a node
+func WithLabels(c Collector, labels ...Label) Collector {
+	return CollectorFunc(func() []Family {
+		families := c.Collect()
+		for i := range families {
+			for j := range families[i].Samples {
+				s := &families[i].Samples[j]
+				s.Labels = append(append([]Label(nil), labels...), s.Labels...)
+			}
+		}
+		return families
+	})
+}
+
+// Gauge returns a family with a single gauge sample
+func Gauge(name, help string, value float64, labels ...Label) Family {
+	return Family{Name: name, Help: help, Type: TypeGauge, Samples: []Sample{{Labels: labels, Value: value}}}
+}
+
+func formatLabels(labels []Label) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	parts := make([]string, len(labels))
+	for i, l := range labels {
+		parts[i] = fmt.Sprintf(`%s="%s"`, l.Name, labelEscaper.Replace(l.Value))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+var (
+	labelEscaper = strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n")
+	helpEscaper  = strings.NewReplacer("\\", "\\\\", "\n", "\\n")
+)
+
+func escapeHelp(help string) string {
+	return helpEscaper.Replace(help)
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,54 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWriteText(t *testing.T) {
+	r := NewRegistry()
+	requests := NewCounterVec("depot_requests_total", "Requests.", "route", "code")
+	requests.Inc("/getKV/:key", "200")
+	requests.Add(2, "/getKV/:key", "200")
+	requests.Inc("/setKV", "400")
+	r.Register(requests)
+
+	latency := NewHistogramVec("depot_latency_seconds", "Latency.", []float64{0.5, 0.1})
+	latency.Observe(0.05)
+	latency.Observe(0.3)
+	latency.Observe(7)
+	r.Register(latency)
+
+	group := CollectorFunc(func() []Family {
+		return []Family{Gauge("depot_keys", "Keys\nstored.", 3)}
+	})
+	r.Register(group)
+	r.Register(WithLabels(group, Label{Name: "group", Value: `g"1`}))
+
+	var buf bytes.Buffer
+	if err := r.WriteText(&buf); err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP depot_keys Keys\nstored.
+# TYPE depot_keys gauge
+depot_keys 3
+depot_keys{group="g\"1"} 3
+# HELP depot_latency_seconds Latency.
+# TYPE depot_latency_seconds histogram
+depot_latency_seconds_bucket{le="0.1"} 1
+depot_latency_seconds_bucket{le="0.5"} 2
+depot_latency_seconds_bucket{le="+Inf"} 3
+depot_latency_seconds_sum 7.35
+depot_latency_seconds_count 3
+# HELP depot_requests_total Requests.
+# TYPE depot_requests_total counter
+depot_requests_total{route="/getKV/:key",code="200"} 3
+depot_requests_total{route="/setKV",code="400"} 1
+`
+	if buf.String() != want {
+		t.Fatalf("unexpected output:\n%s\nwant:\n%s", buf.String(), want)
+	}
+	if requests.Value("/getKV/:key", "200") != 3 || latency.Count() != 3 {
+		t.Fatal("unexpected values")
+	}
+}
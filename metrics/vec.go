@@ -0,0 +1,171 @@
+package metrics
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// CounterVec is a counter per combination of label values
+type CounterVec struct {
+	name, help string
+	labelNames []string
+
+	sync.Mutex
+	values map[string]*counterValue
+}
+
+type counterValue struct {
+	labels []string
+	value  float64
+}
+
+func NewCounterVec(name, help string, labelNames ...string) *CounterVec {
+	return &CounterVec{name: name, help: help, labelNames: labelNames, values: make(map[string]*counterValue)}
+}
+
+// Add adds delta to the counter of the label values, given in the order of
+// the label names
+func (c *CounterVec) Add(delta float64, labelValues ...string) {
+	c.Lock()
+	defer c.Unlock()
+	key := strings.Join(labelValues, "\xff")
+	v, ok := c.values[key]
+	if !ok {
+		v = &counterValue{labels: append([]string(nil), labelValues...)}
+		c.values[key] = v
+	}
+	v.value += delta
+}
+
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Value returns the counter of the label values
+func (c *CounterVec) Value(labelValues ...string) float64 {
+	c.Lock()
+	defer c.Unlock()
+	if v, ok := c.values[strings.Join(labelValues, "\xff")]; ok {
+		return v.value
+	}
+	return 0
+}
+
+func (c *CounterVec) Collect() []Family {
+	c.Lock()
+	defer c.Unlock()
+	f := Family{Name: c.name, Help: c.help, Type: TypeCounter}
+	for _, key := range sortedKeys(c.values) {
+		v := c.values[key]
+		f.Samples = append(f.Samples, Sample{Labels: labelPairs(c.labelNames, v.labels), Value: v.value})
+	}
+	return []Family{f}
+}
+
+// HistogramVec is a histogram per combination of label values
+type HistogramVec struct {
+	name, help string
+	labelNames []string
+	buckets    []float64
+
+	sync.Mutex
+	values map[string]*histogramValue
+}
+
+type histogramValue struct {
+	labels []string
+	// counts holds the observations per bucket, not cumulated
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogramVec creates a histogram with the given upper bounds, the +Inf
+// bucket is added
+func NewHistogramVec(name, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	return &HistogramVec{name: name, help: help, labelNames: labelNames, buckets: buckets, values: make(map[string]*histogramValue)}
+}
+
+// Observe records v for the label values, given in the order of the label names
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	h.Lock()
+	defer h.Unlock()
+	key := strings.Join(labelValues, "\xff")
+	hv, ok := h.values[key]
+	if !ok {
+		hv = &histogramValue{labels: append([]string(nil), labelValues...), counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hv
+	}
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		hv.counts[i]++
+	}
+	hv.count++
+	hv.sum += v
+}
+
+// Count returns the number of observations of the label values
+func (h *HistogramVec) Count(labelValues ...string) uint64 {
+	h.Lock()
+	defer h.Unlock()
+	if hv, ok := h.values[strings.Join(labelValues, "\xff")]; ok {
+		return hv.count
+	}
+	return 0
+}
+
+func (h *HistogramVec) Collect() []Family {
+	h.Lock()
+	defer h.Unlock()
+	f := Family{Name: h.name, Help: h.help, Type: TypeHistogram}
+	for _, key := range sortedKeys(h.values) {
+		hv := h.values[key]
+		labels := labelPairs(h.labelNames, hv.labels)
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += hv.counts[i]
+			f.Samples = append(f.Samples, Sample{Suffix: "_bucket", Labels: withLe(labels, bound), Value: float64(cumulative)})
+		}
+		f.Samples = append(f.Samples,
+			Sample{Suffix: "_bucket", Labels: withLe(labels, math.Inf(1)), Value: float64(hv.count)},
+			Sample{Suffix: "_sum", Labels: labels, Value: hv.sum},
+			Sample{Suffix: "_count", Labels: labels, Value: float64(hv.count)},
+		)
+	}
+	return []Family{f}
+}
+
+func withLe(labels []Label, bound float64) []Label {
+	return append(append([]Label(nil), labels...), Label{Name: "le", Value: formatValue(bound)})
+}
+
+func labelPairs(names, values []string) []Label {
+	labels := make([]Label, 0, len(names))
+	for i, name := range names {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		labels = append(labels, Label{Name: name, Value: value})
+	}
+	return labels
+}
+
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch m := m.(type) {
+	case map[string]*counterValue:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]*histogramValue:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,204 @@
+package mux
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// HeaderRaft is the first byte raft peers write on a multiplexed
+	// connection, it is neither printable nor a TLS record type so it cannot
+	// be mistaken for http or https
+	HeaderRaft byte = 0x01
+	// HeaderTLS is the first byte of a TLS handshake record
+	HeaderTLS byte = 0x16
+)
+
+// headerTimeout bounds how long a new connection may take to send its first byte
+const headerTimeout = 10 * time.Second
+
+var ErrClosed = errors.New("mux: listener closed")
+
+// Mux shares one listener between several protocols, picking the protocol of
+// each connection by its first byte. Connections with a header that has no
+// handler go to the default listener.
+type Mux struct {
+	listener net.Listener
+
+	sync.Mutex
+	handlers map[byte]*listener
+	fallback *listener
+	// consume records the headers which are stripped before the connection
+	// is handed over, the others are read again by the handler
+	consume map[byte]bool
+
+	closing   chan struct{}
+	closeOnce sync.Once
+}
+
+func Listen(addr string) (*Mux, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return New(l), nil
+}
+
+func New(l net.Listener) *Mux {
+	m := &Mux{
+		listener: l,
+		handlers: make(map[byte]*listener),
+		consume:  make(map[byte]bool),
+		closing:  make(chan struct{}),
+	}
+	m.fallback = m.newListener()
+	return m
+}
+
+// Handle returns the listener of connections starting with header. When
+// consume is set the header is removed from the connection.
+func (m *Mux) Handle(header byte, consume bool) net.Listener {
+	m.Lock()
+	defer m.Unlock()
+	l, ok := m.handlers[header]
+	if !ok {
+		l = m.newListener()
+		m.handlers[header] = l
+		m.consume[header] = consume
+	}
+	return l
+}
+
+// Default returns the listener of connections no handler claimed
+func (m *Mux) Default() net.Listener {
+	return m.fallback
+}
+
+func (m *Mux) Addr() net.Addr {
+	return m.listener.Addr()
+}
+
+// Serve accepts connections until the mux is closed
+func (m *Mux) Serve() error {
+	for {
+		conn, err := m.listener.Accept()
+		if err != nil {
+			select {
+			case <-m.closing:
+				return nil
+			default:
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		go m.dispatch(conn)
+	}
+}
+
+func (m *Mux) dispatch(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(headerTimeout))
+	r := bufio.NewReader(conn)
+	header, err := r.Peek(1)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	m.Lock()
+	l, ok := m.handlers[header[0]]
+	if !ok {
+		l = m.fallback
+	} else if m.consume[header[0]] {
+		r.Discard(1)
+	}
+	m.Unlock()
+
+	l.deliver(&bufferedConn{Conn: conn, r: r})
+}
+
+func (m *Mux) Close() error {
+	m.closeOnce.Do(func() { close(m.closing) })
+	return m.listener.Close()
+}
+
+func (m *Mux) newListener() *listener {
+	return &listener{
+		mux:     m,
+		conns:   make(chan net.Conn),
+		closing: make(chan struct{}),
+	}
+}
+
+// Dial connects to a multiplexed address and writes header
+func Dial(addr string, header byte, timeout time.Duration) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetWriteDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write([]byte{header}); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("mux: failed to write header to %s: %v", addr, err)
+	}
+	conn.SetWriteDeadline(time.Time{})
+	return conn, nil
+}
+
+// listener hands out the connections dispatched to one protocol
+type listener struct {
+	mux   *Mux
+	conns chan net.Conn
+
+	closing   chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *listener) deliver(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.closing:
+		conn.Close()
+	case <-l.mux.closing:
+		conn.Close()
+	}
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closing:
+		return nil, ErrClosed
+	case <-l.mux.closing:
+		return nil, ErrClosed
+	}
+}
+
+// Close stops this protocol only, connections for it are refused from now
+// on. The shared listener is closed by Mux.Close.
+func (l *listener) Close() error {
+	l.closeOnce.Do(func() { close(l.closing) })
+	return nil
+}
+
+func (l *listener) Addr() net.Addr {
+	return l.mux.Addr()
+}
+
+// bufferedConn replays the bytes peeked while dispatching
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
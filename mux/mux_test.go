@@ -0,0 +1,87 @@
+package mux
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestMux(t *testing.T) {
+	m, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	go m.Serve()
+
+	raftListener := m.Handle(HeaderRaft, true)
+	tlsListener := m.Handle(HeaderTLS, false)
+
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "http")
+	})}
+	go server.Serve(m.Default())
+	defer server.Close()
+
+	// raft connections lose their header
+	go func() {
+		conn, err := Dial(m.Addr().String(), HeaderRaft, time.Second)
+		if err != nil {
+			return
+		}
+		conn.Write([]byte("raft\n"))
+		conn.Close()
+	}()
+	conn, err := raftListener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || line != "raft\n" {
+		t.Fatalf("unexpected raft data %q (%v)", line, err)
+	}
+	conn.Close()
+
+	// other handlers read the header again
+	go func() {
+		conn, err := net.Dial("tcp", m.Addr().String())
+		if err != nil {
+			return
+		}
+		conn.Write([]byte{HeaderTLS, 3, 1})
+		conn.Close()
+	}()
+	conn, err = tlsListener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(conn)
+	if err != nil || string(data) != string([]byte{HeaderTLS, 3, 1}) {
+		t.Fatalf("unexpected tls data %v (%v)", data, err)
+	}
+	conn.Close()
+
+	// everything else is http
+	resp, err := http.Get("http://" + m.Addr().String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "http" {
+		t.Fatalf("unexpected http response %q", body)
+	}
+
+	// closing one protocol leaves the others running
+	raftListener.Close()
+	if _, err := raftListener.Accept(); err != ErrClosed {
+		t.Fatalf("expected closed raft listener, got %v", err)
+	}
+	if _, err := http.Get("http://" + m.Addr().String() + "/"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,265 @@
+package raftnode
+
+import (
+	"fmt"
+	"math"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/forjoin92/depot/logging"
+	"github.com/forjoin92/depot/mux"
+	"github.com/forjoin92/depot/tracing"
+	"github.com/hashicorp/raft"
+)
+
+type Config struct {
+	// ID is the stable raft server id, generated and persisted in DataDir when empty
+	ID string
+	// BindAddr is the address the raft transport listens on
+	BindAddr string
+	// AdvertiseAddr is the address peers use to reach this node, defaults to BindAddr
+	AdvertiseAddr string
+	// Cluster is a comma separated list of id=address pairs used to bootstrap
+	Cluster string
+	// Bootstrap forms a brand new cluster from Cluster, or from this node alone
+	// when Cluster is empty. It is ignored when the node has existing raft state.
+	Bootstrap bool
+	// Zone is the failure zone of the node, voters are kept spread across zones
+	Zone string
+	// APIAddr is the address of the node's http api, advertised to the other
+	// members so that they can forward requests to the leader
+	APIAddr string
+
+	DataDir      string
+	SnapshotPath string
+	RaftDBPath   string
+	// LogStore is the raft log backend: bolt (default), segment or memory
+	LogStore string
+	// LogCacheSize is the number of recent log entries kept in memory, defaults to 512
+	LogCacheSize int
+	// SegmentSize is the size of a segment file of the segment backend, defaults to 64MB
+	SegmentSize int64
+
+	// raft tuning, zero values use the hashicorp/raft defaults
+	HeartbeatTimeout   time.Duration
+	ElectionTimeout    time.Duration
+	CommitTimeout      time.Duration
+	LeaderLeaseTimeout time.Duration
+	MaxAppendEntries   int
+	SnapshotInterval   time.Duration
+	SnapshotThreshold  uint64
+	TrailingLogs       uint64
+	// SnapshotRetain is the number of snapshots kept on disk, defaults to 3
+	SnapshotRetain int
+	// ApplyTimeout bounds how long a write waits to be committed, defaults to 10s
+	ApplyTimeout time.Duration
+	// ReadyMaxLag is the number of committed entries a ready node may still
+	// have to apply, defaults to 1000
+	ReadyMaxLag uint64
+	// SlowPeerLag is the number of entries a peer may miss before the leader
+	// warns about it, defaults to 1000
+	SlowPeerLag uint64
+
+	// TransportMaxPool is the number of pooled connections per peer, defaults to 3
+	TransportMaxPool int
+	// TransportTimeout is the raft RPC io timeout, defaults to 10s
+	TransportTimeout time.Duration
+
+	// TLSCertFile and TLSKeyFile enable mutually authenticated TLS between
+	// peers, both sides must present a certificate signed by TLSCAFile
+	TLSCertFile string
+	TLSKeyFile  string
+	TLSCAFile   string
+	// TLSVerifyServerID requires a peer's certificate common name or a DNS
+	// name to equal the server id registered for its address
+	TLSVerifyServerID bool
+
+	// Mux, when set, shares the raft port with the api. Raft takes the
+	// connections starting with mux.HeaderRaft and writes that header when
+	// dialing, so every member of the cluster must share its port.
+	Mux *mux.Mux
+
+	// Logger receives the log lines of the node and of raft, tagged with the
+	// node id. Defaults to logging.Default().
+	Logger *logging.Logger
+	// Tracer records spans of traced writes, tracing is off when nil
+	Tracer *tracing.Tracer
+}
+
+// TLSEnabled reports whether peer traffic uses TLS
+func (c *Config) TLSEnabled() bool {
+	return c.TLSCertFile != ""
+}
+
+// raftConfig returns the hashicorp/raft config for the local node
+func (c *Config) raftConfig(id string, logger *logging.Logger) *raft.Config {
+	config := raft.DefaultConfig()
+	config.LocalID = raft.ServerID(id)
+	config.Logger = logger.StdLogger()
+	if c.HeartbeatTimeout > 0 {
+		config.HeartbeatTimeout = c.HeartbeatTimeout
+	}
+	if c.ElectionTimeout > 0 {
+		config.ElectionTimeout = c.ElectionTimeout
+	}
+	if c.CommitTimeout > 0 {
+		config.CommitTimeout = c.CommitTimeout
+	}
+	if c.LeaderLeaseTimeout > 0 {
+		config.LeaderLeaseTimeout = c.LeaderLeaseTimeout
+	}
+	if c.MaxAppendEntries > 0 {
+		config.MaxAppendEntries = c.MaxAppendEntries
+	}
+	// snapshots are triggered by the node's own snapshot loop so the policy
+	// can be changed at runtime, raft's threshold check is disabled
+	config.SnapshotThreshold = math.MaxUint64
+	if c.TrailingLogs > 0 {
+		config.TrailingLogs = c.TrailingLogs
+	}
+	return config
+}
+
+func (c *Config) logStore() string {
+	if c.LogStore != "" {
+		return c.LogStore
+	}
+	return LogStoreBolt
+}
+
+func (c *Config) logCacheSize() int {
+	if c.LogCacheSize > 0 {
+		return c.LogCacheSize
+	}
+	return 512
+}
+
+func (c *Config) snapshotInterval() time.Duration {
+	if c.SnapshotInterval > 0 {
+		return c.SnapshotInterval
+	}
+	return 120 * time.Second
+}
+
+func (c *Config) snapshotThreshold() uint64 {
+	if c.SnapshotThreshold > 0 {
+		return c.SnapshotThreshold
+	}
+	return 8192
+}
+
+func (c *Config) snapshotRetain() int {
+	if c.SnapshotRetain > 0 {
+		return c.SnapshotRetain
+	}
+	return 3
+}
+
+func (c *Config) slowPeerLag() uint64 {
+	if c.SlowPeerLag > 0 {
+		return c.SlowPeerLag
+	}
+	return 1000
+}
+
+func (c *Config) logger() *logging.Logger {
+	if c.Logger != nil {
+		return c.Logger
+	}
+	return logging.Default()
+}
+
+func (c *Config) readyMaxLag() uint64 {
+	if c.ReadyMaxLag > 0 {
+		return c.ReadyMaxLag
+	}
+	return 1000
+}
+
+func (c *Config) applyTimeout() time.Duration {
+	if c.ApplyTimeout > 0 {
+		return c.ApplyTimeout
+	}
+	return 10 * time.Second
+}
+
+func (c *Config) transportMaxPool() int {
+	if c.TransportMaxPool > 0 {
+		return c.TransportMaxPool
+	}
+	return 3
+}
+
+func (c *Config) transportTimeout() time.Duration {
+	if c.TransportTimeout > 0 {
+		return c.TransportTimeout
+	}
+	return 10 * time.Second
+}
+
+// paths returns the data, snapshot and raft db directories with defaults applied
+func (c *Config) paths() (dataDir, snapshotPath, raftDBPath string) {
+	dataDir = c.DataDir
+	if dataDir == "" {
+		name := c.ID
+		if name == "" {
+			name = c.AdvertiseAddr
+		}
+		if name == "" {
+			name = c.BindAddr
+		}
+		dataDir = filepath.Join(DefaultDataDir(), name)
+	}
+	snapshotPath = c.SnapshotPath
+	if snapshotPath == "" {
+		snapshotPath = dataDir
+	}
+	raftDBPath = c.RaftDBPath
+	if raftDBPath == "" {
+		raftDBPath = dataDir
+	}
+	return dataDir, snapshotPath, raftDBPath
+}
+
+// ParseServer parses a single "id=address" member spec. A spec without "="
+// is treated as an address which is also used as the id.
+func ParseServer(spec string) (raft.Server, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return raft.Server{}, fmt.Errorf("empty server spec")
+	}
+	id, addr := spec, spec
+	if i := strings.Index(spec, "="); i >= 0 {
+		id, addr = strings.TrimSpace(spec[:i]), strings.TrimSpace(spec[i+1:])
+	}
+	if id == "" || addr == "" {
+		return raft.Server{}, fmt.Errorf("invalid server spec (%s), expected id=address", spec)
+	}
+	return raft.Server{
+		Suffrage: raft.Voter,
+		ID:       raft.ServerID(id),
+		Address:  raft.ServerAddress(addr),
+	}, nil
+}
+
+// ParseCluster parses a comma separated list of "id=address" member specs.
+func ParseCluster(cluster string) ([]raft.Server, error) {
+	var servers []raft.Server
+	seen := make(map[raft.ServerID]bool)
+	for _, spec := range strings.Split(cluster, ",") {
+		if strings.TrimSpace(spec) == "" {
+			continue
+		}
+		server, err := ParseServer(spec)
+		if err != nil {
+			return nil, err
+		}
+		if seen[server.ID] {
+			return nil, fmt.Errorf("duplicate server id (%s) in cluster", server.ID)
+		}
+		seen[server.ID] = true
+		servers = append(servers, server)
+	}
+	return servers, nil
+}
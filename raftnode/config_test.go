@@ -0,0 +1,28 @@
+package raftnode
+
+import (
+	"testing"
+)
+
+func TestParseCluster(t *testing.T) {
+	servers, err := ParseCluster("n1=127.0.0.1:30401, n2=node2.local:30402,127.0.0.1:30403")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(servers) != 3 {
+		t.Fatalf("expected 3 servers, got %d", len(servers))
+	}
+	if servers[1].ID != "n2" || servers[1].Address != "node2.local:30402" {
+		t.Fatalf("bad server: %+v", servers[1])
+	}
+	if servers[2].ID != "127.0.0.1:30403" || servers[2].Address != "127.0.0.1:30403" {
+		t.Fatalf("bad server: %+v", servers[2])
+	}
+
+	if _, err := ParseCluster("n1=127.0.0.1:30401,n1=127.0.0.1:30402"); err == nil {
+		t.Fatal("expected duplicate id error")
+	}
+	if _, err := ParseCluster("n1="); err == nil {
+		t.Fatal("expected invalid spec error")
+	}
+}
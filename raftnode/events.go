@@ -0,0 +1,213 @@
+package raftnode
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+type EventType string
+
+const (
+	// the cluster leader changed, Leader is empty when there is no leader
+	EventLeaderElected EventType = "leader_elected"
+	// this node changed raft state
+	EventStateChanged EventType = "state_changed"
+	// this node acquired or lost leadership, State is "acquired" or "lost"
+	EventLeadershipChanged EventType = "leadership_changed"
+	// a candidate asked this node for its vote
+	EventVoteRequested EventType = "vote_requested"
+	// the leader could not reach a peer, or reached it again
+	EventPeerFailed    EventType = "peer_failed"
+	EventPeerRecovered EventType = "peer_recovered"
+	// the raft configuration changed
+	EventMembershipChanged EventType = "membership_changed"
+	EventSnapshotTaken     EventType = "snapshot_taken"
+	EventSnapshotRestored  EventType = "snapshot_restored"
+)
+
+// Event is a cluster event seen by this node
+type Event struct {
+	Type    EventType `json:"type"`
+	Node    string    `json:"node"`
+	Time    time.Time `json:"time"`
+	Leader  string    `json:"leader,omitempty"`
+	State   string    `json:"state,omitempty"`
+	Peer    string    `json:"peer,omitempty"`
+	Term    uint64    `json:"term,omitempty"`
+	Index   uint64    `json:"index,omitempty"`
+	Servers []string  `json:"servers,omitempty"`
+	Error   string    `json:"error,omitempty"`
+}
+
+const eventPollInterval = time.Second
+
+// eventBus fans events out to subscribers, slow subscribers drop events
+type eventBus struct {
+	sync.Mutex
+	subs    map[int]chan Event
+	nextID  int
+	dropped uint64
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{subs: make(map[int]chan Event)}
+}
+
+func (b *eventBus) subscribe(buffer int) (<-chan Event, func()) {
+	b.Lock()
+	defer b.Unlock()
+	id := b.nextID
+	b.nextID++
+	ch := make(chan Event, buffer)
+	b.subs[id] = ch
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.Lock()
+			defer b.Unlock()
+			delete(b.subs, id)
+			close(ch)
+		})
+	}
+}
+
+func (b *eventBus) publish(e Event) {
+	b.Lock()
+	defer b.Unlock()
+	for _, ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+			atomic.AddUint64(&b.dropped, 1)
+		}
+	}
+}
+
+// 订阅集群事件，取消订阅时关闭channel，处理不及时的订阅者会丢失事件
+func (node *RaftNode) Subscribe(buffer int) (<-chan Event, func()) {
+	return node.events.subscribe(buffer)
+}
+
+// 因为订阅者处理不及时而丢弃的事件数
+func (node *RaftNode) DroppedEvents() uint64 {
+	return atomic.LoadUint64(&node.events.dropped)
+}
+
+func (node *RaftNode) publish(e Event) {
+	e.Node = node.id
+	e.Time = time.Now()
+	node.events.publish(e)
+}
+
+// runEvents turns raft observations, leadership notifications and polled
+// leader and configuration changes into events
+func (node *RaftNode) runEvents() {
+	observations := make(chan raft.Observation, 64)
+	observer := raft.NewObserver(observations, false, nil)
+	node.raft.RegisterObserver(observer)
+	defer node.raft.DeregisterObserver(observer)
+
+	ticker := time.NewTicker(eventPollInterval)
+	defer ticker.Stop()
+
+	var leader raft.ServerAddress
+	var servers []string
+	failed := make(map[raft.ServerID]bool)
+	for {
+		select {
+		case o := <-observations:
+			switch data := o.Data.(type) {
+			case raft.RaftState:
+				node.publish(Event{Type: EventStateChanged, State: data.String()})
+			case raft.RequestVoteRequest:
+				node.publish(Event{
+					Type: EventVoteRequested,
+					Peer: string(data.Candidate),
+					Term: data.Term,
+				})
+			}
+
+		case isLeader := <-node.raft.LeaderCh():
+			state := "lost"
+			if isLeader {
+				state = "acquired"
+			}
+			node.publish(Event{Type: EventLeadershipChanged, State: state})
+
+		case <-ticker.C:
+			if current := node.raft.Leader(); current != leader {
+				leader = current
+				node.publish(Event{Type: EventLeaderElected, Leader: string(leader)})
+			}
+
+			future := node.raft.GetConfiguration()
+			if future.Error() == nil {
+				current := serverList(future.Configuration())
+				if servers != nil && !equalStrings(current, servers) {
+					node.publish(Event{Type: EventMembershipChanged, Servers: current})
+				}
+				servers = current
+
+				if node.IsLeader() {
+					node.checkPeers(future.Configuration(), failed)
+				}
+			}
+
+		case <-node.shutdownCh:
+			return
+		}
+	}
+}
+
+// checkPeers reports the peers the leader's requests no longer reach and
+// those they reach again. The leader sends every peer a heartbeat several
+// times per heartbeat timeout, so the last request tells.
+func (node *RaftNode) checkPeers(configuration raft.Configuration, failed map[raft.ServerID]bool) {
+	states := node.transport.peerStates()
+	for _, server := range configuration.Servers {
+		state, ok := states[server.ID]
+		if server.ID == raft.ServerID(node.id) || !ok {
+			continue
+		}
+		peer := string(server.ID) + "=" + string(server.Address)
+		switch {
+		case state.err != nil && !failed[server.ID]:
+			failed[server.ID] = true
+			node.publish(Event{Type: EventPeerFailed, Peer: peer, Error: state.err.Error()})
+		case state.err == nil && failed[server.ID]:
+			delete(failed, server.ID)
+			node.publish(Event{Type: EventPeerRecovered, Peer: peer})
+		}
+	}
+	// removed peers are forgotten
+	for id := range failed {
+		if _, ok := states[id]; !ok {
+			delete(failed, id)
+		}
+	}
+}
+
+func serverList(configuration raft.Configuration) []string {
+	servers := make([]string, 0, len(configuration.Servers))
+	for _, server := range configuration.Servers {
+		servers = append(servers, string(server.ID)+"="+string(server.Address)+"/"+server.Suffrage.String())
+	}
+	sort.Strings(servers)
+	return servers
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,116 @@
+package raftnode
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// newTestNode bootstraps a single node cluster on loopback
+func newTestNode(t *testing.T, dir string) *RaftNode {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	node, err := NewRaftNode(&Config{
+		ID:                 "node1",
+		BindAddr:           addr,
+		Bootstrap:          true,
+		DataDir:            dir,
+		HeartbeatTimeout:   50 * time.Millisecond,
+		ElectionTimeout:    50 * time.Millisecond,
+		LeaderLeaseTimeout: 50 * time.Millisecond,
+		CommitTimeout:      5 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return node
+}
+
+func waitEvent(t *testing.T, events <-chan Event, typ EventType) Event {
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case e := <-events:
+			if e.Type == typ {
+				return e
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for %s", typ)
+		}
+	}
+}
+
+func TestEvents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "depot-events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	node := newTestNode(t, dir)
+	defer node.Close()
+	events, cancel := node.Subscribe(64)
+	defer cancel()
+
+	if e := waitEvent(t, events, EventLeaderElected); e.Leader != node.Addr() {
+		t.Fatalf("expected %s to be elected, got %+v", node.Addr(), e)
+	}
+
+	if err := node.SetKV("k", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if err := node.snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	if e := waitEvent(t, events, EventSnapshotTaken); e.Index == 0 {
+		t.Fatalf("expected a snapshot index, got %+v", e)
+	}
+
+	// the leader's heartbeats tell when a peer cannot be reached
+	if err := node.raft.AddNonvoter("node2", "127.0.0.1:1", 0, 0).Error(); err != nil {
+		t.Fatal(err)
+	}
+	if e := waitEvent(t, events, EventPeerFailed); e.Peer != "node2=127.0.0.1:1" || e.Error == "" {
+		t.Fatalf("expected node2 to fail, got %+v", e)
+	}
+}
+
+func TestCheckPeers(t *testing.T) {
+	node := &RaftNode{id: "node1", transport: newPeerTransport(nil), events: newEventBus()}
+	events, cancel := node.Subscribe(8)
+	defer cancel()
+	configuration := raft.Configuration{Servers: []raft.Server{
+		{ID: "node1", Address: "addr1"},
+		{ID: "node2", Address: "addr2"},
+	}}
+	failed := make(map[raft.ServerID]bool)
+	setErr := func(err error) {
+		node.transport.Lock()
+		node.transport.peer("node2").err = err
+		node.transport.Unlock()
+	}
+
+	setErr(errors.New("connection refused"))
+	node.checkPeers(configuration, failed)
+	node.checkPeers(configuration, failed)
+	setErr(nil)
+	node.checkPeers(configuration, failed)
+
+	var got []EventType
+	for len(events) > 0 {
+		got = append(got, (<-events).Type)
+	}
+	if len(got) != 2 || got[0] != EventPeerFailed || got[1] != EventPeerRecovered {
+		t.Fatalf("got events %v, want one failure and one recovery", got)
+	}
+}
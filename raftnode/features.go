@@ -0,0 +1,245 @@
+package raftnode
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/forjoin92/depot/store"
+	"github.com/hashicorp/raft"
+)
+
+// Version is the build version, set it with
+// -ldflags "-X github.com/forjoin92/depot/raftnode.Version=1.2.3"
+var Version = "0.1.0"
+
+// nodeInfoPrefix is the key prefix of the members' advertised NodeInfo
+const nodeInfoPrefix = "cluster/node/"
+
+// IsInternalKey reports whether key holds cluster bookkeeping rather than user data
+func IsInternalKey(key string) bool {
+	return key == clusterIDKey || strings.HasPrefix(key, nodeInfoPrefix) || strings.HasPrefix(key, store.FrozenPrefix)
+}
+
+// NodeInfo is what a member advertises about its build
+type NodeInfo struct {
+	ID       string   `json:"id"`
+	Version  string   `json:"version"`
+	Commands []string `json:"commands"`
+	// Zone is the failure zone of the member, empty when it has none
+	Zone string `json:"zone,omitempty"`
+	// APIAddr is the address of the member's http api
+	APIAddr string `json:"api_addr,omitempty"`
+}
+
+// Features is what every member of the cluster supports
+type Features struct {
+	// MinVersion is the oldest build in the cluster, empty when a member has
+	// not advertised its version
+	MinVersion string   `json:"min_version"`
+	Commands   []string `json:"commands"`
+	// Members lists every member, members without a record have an empty
+	// version and the base commands
+	Members []NodeInfo `json:"members"`
+}
+
+// ErrUnsupportedCommand is returned for commands some member cannot apply yet
+var ErrUnsupportedCommand = errors.New("command is not supported by every member, finish upgrading the cluster first")
+
+// 本节点的版本和支持的命令
+func (node *RaftNode) Info() NodeInfo {
+	return NodeInfo{
+		ID:       node.id,
+		Version:  Version,
+		Commands: sortedCopy(node.commands),
+		Zone:     node.zone,
+		APIAddr:  node.apiAddr,
+	}
+}
+
+// InfoRecorded reports whether the replicated record of this node is current
+func (node *RaftNode) InfoRecorded() bool {
+	info, ok := node.recordedInfo(node.id)
+	if !ok {
+		return false
+	}
+	local := node.Info()
+	return info.Version == local.Version && info.Zone == local.Zone && info.APIAddr == local.APIAddr &&
+		equalStrings(info.Commands, local.Commands)
+}
+
+// ErrNotMember is returned for info reported for a node outside of the raft
+// configuration
+var ErrNotMember = errors.New("node is not a member of the raft configuration")
+
+// RecordInfo stores the info advertised by a member, only on the leader
+func (node *RaftNode) RecordInfo(info NodeInfo) error {
+	if info.ID == "" {
+		return errors.New("node id should not be empty")
+	}
+	if _, ok := node.lookupServerAddress(raft.ServerID(info.ID)); !ok {
+		return fmt.Errorf("%w (%s)", ErrNotMember, info.ID)
+	}
+	info.Commands = sortedCopy(info.Commands)
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	if node.kvs.Get(nodeInfoPrefix+info.ID) == string(data) {
+		return nil
+	}
+	return node.SetKV(nodeInfoPrefix+info.ID, string(data))
+}
+
+// Features computes what every member of the raft configuration supports.
+// Non-voters apply the log too, so they count as well.
+func (node *RaftNode) Features() (Features, error) {
+	future := node.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return Features{}, err
+	}
+
+	var features Features
+	for i, server := range future.Configuration().Servers {
+		info, ok := node.recordedInfo(string(server.ID))
+		if !ok {
+			info = NodeInfo{ID: string(server.ID), Commands: sortedCopy(store.BaseCommands)}
+		}
+		features.Members = append(features.Members, info)
+		if i == 0 {
+			features.MinVersion = info.Version
+			features.Commands = info.Commands
+			continue
+		}
+		if compareVersions(info.Version, features.MinVersion) < 0 {
+			features.MinVersion = info.Version
+		}
+		features.Commands = intersect(features.Commands, info.Commands)
+	}
+	return features, nil
+}
+
+// checkCommand refuses commands that this build or another member cannot apply
+func (node *RaftNode) checkCommand(method string) error {
+	if !containsString(node.commands, method) {
+		return fmt.Errorf("unknown op:%s", method)
+	}
+	// every release applies the base commands
+	if containsString(store.BaseCommands, method) {
+		return nil
+	}
+	features, err := node.Features()
+	if err != nil {
+		return err
+	}
+	if containsString(features.Commands, method) {
+		return nil
+	}
+	var missing []string
+	for _, member := range features.Members {
+		if !containsString(member.Commands, method) {
+			missing = append(missing, member.ID)
+		}
+	}
+	return fmt.Errorf("%w (%s not supported by %s)", ErrUnsupportedCommand, method, strings.Join(missing, ", "))
+}
+
+func (node *RaftNode) recordedInfo(id string) (NodeInfo, bool) {
+	value := node.kvs.Get(nodeInfoPrefix + id)
+	if value == "" {
+		return NodeInfo{}, false
+	}
+	var info NodeInfo
+	if err := json.Unmarshal([]byte(value), &info); err != nil {
+		return NodeInfo{}, false
+	}
+	return info, true
+}
+
+// lookupServerAddress finds the address of the server with the given id
+func (node *RaftNode) lookupServerAddress(id raft.ServerID) (raft.ServerAddress, bool) {
+	future := node.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return "", false
+	}
+	for _, server := range future.Configuration().Servers {
+		if server.ID == id {
+			return server.Address, true
+		}
+	}
+	return "", false
+}
+
+// 成员的raft地址，不是成员时ok为false
+func (node *RaftNode) MemberAddr(id string) (addr string, ok bool) {
+	address, ok := node.lookupServerAddress(raft.ServerID(id))
+	return string(address), ok
+}
+
+// forgetInfo drops the record of a member leaving the cluster
+func (node *RaftNode) forgetInfo(id raft.ServerID) error {
+	if node.kvs.Get(nodeInfoPrefix+string(id)) == "" {
+		return nil
+	}
+	return node.DeleteKV(nodeInfoPrefix + string(id))
+}
+
+// compareVersions compares dotted numeric versions, an empty (unknown)
+// version is older than any other
+func compareVersions(a, b string) int {
+	if a == b {
+		return 0
+	}
+	if a == "" {
+		return -1
+	}
+	if b == "" {
+		return 1
+	}
+	as := strings.Split(strings.TrimPrefix(a, "v"), ".")
+	bs := strings.Split(strings.TrimPrefix(b, "v"), ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return strings.Compare(a, b)
+}
+
+func intersect(a, b []string) []string {
+	var both []string
+	for _, s := range a {
+		if containsString(b, s) {
+			both = append(both, s)
+		}
+	}
+	return both
+}
+
+func containsString(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedCopy(list []string) []string {
+	c := append([]string(nil), list...)
+	sort.Strings(c)
+	return c
+}
@@ -0,0 +1,91 @@
+package raftnode
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/forjoin92/depot/store"
+)
+
+func TestCompareVersions(t *testing.T) {
+	for _, c := range []struct {
+		a, b string
+		want int
+	}{
+		{"1.2.0", "1.2.0", 0},
+		{"1.2.0", "1.10.0", -1},
+		{"v2.0", "1.9.9", 1},
+		{"1.2", "1.2.1", -1},
+		{"", "0.1.0", -1},
+	} {
+		if got := compareVersions(c.a, c.b); got != c.want {
+			t.Fatalf("compareVersions(%q, %q) = %d, want %d", c.a, c.b, got, c.want)
+		}
+	}
+}
+
+func TestFeatureGating(t *testing.T) {
+	dir, err := ioutil.TempDir("", "depot-features")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	node := newTestNode(t, dir)
+	defer node.Close()
+	deadline := time.Now().Add(10 * time.Second)
+	for !node.IsLeader() {
+		if time.Now().After(deadline) {
+			t.Fatal("node did not become leader")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the cluster id is proposed in the background, only the test proposes
+	// once it is set
+	for node.GetKV(clusterIDKey) == "" {
+		if time.Now().After(deadline) {
+			t.Fatal("cluster id was not set")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// pretend this build added a command
+	node.commands = append([]string{"CAS"}, store.Commands...)
+
+	if err := node.checkCommand("SET"); err != nil {
+		t.Fatalf("base command refused: %v", err)
+	}
+	// members without a record only run the base commands
+	err = node.checkCommand("CAS")
+	if err == nil || !strings.Contains(err.Error(), "node1") {
+		t.Fatalf("expected CAS to be refused, got %v", err)
+	}
+
+	if err := node.RecordInfo(NodeInfo{ID: "node9", Commands: node.commands}); !errors.Is(err, ErrNotMember) {
+		t.Fatalf("expected info of a non member to be refused, got %v", err)
+	}
+	if err := node.RecordInfo(node.Info()); err != nil {
+		t.Fatal(err)
+	}
+	if !node.InfoRecorded() {
+		t.Fatal("expected info to be recorded")
+	}
+	if err := node.checkCommand("CAS"); err != nil {
+		t.Fatalf("expected CAS once every member supports it: %v", err)
+	}
+	features, err := node.Features()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if features.MinVersion != Version || len(features.Members) != 1 {
+		t.Fatalf("unexpected features %+v", features)
+	}
+
+	if err := node.checkCommand("NOPE"); err == nil {
+		t.Fatal("expected unknown command to be refused")
+	}
+}
@@ -0,0 +1,70 @@
+package raftnode
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/hashicorp/raft"
+)
+
+// Status is the raft state of a node, taken from raft.Stats()
+type Status struct {
+	ID                string `json:"id"`
+	State             string `json:"state"`
+	Term              uint64 `json:"term"`
+	Leader            string `json:"leader"`
+	LeaderID          string `json:"leader_id"`
+	LastLogIndex      uint64 `json:"last_log_index"`
+	CommitIndex       uint64 `json:"commit_index"`
+	AppliedIndex      uint64 `json:"applied_index"`
+	LastSnapshotIndex uint64 `json:"last_snapshot_index"`
+	NumPeers          int    `json:"num_peers"`
+	// LastContact is the time since the leader was last heard from, "never"
+	// before the first contact and 0 on the leader
+	LastContact string `json:"last_contact"`
+	Restoring   bool   `json:"restoring"`
+}
+
+// 节点的raft状态
+func (node *RaftNode) Status() Status {
+	stats := node.raft.Stats()
+	number := func(key string) uint64 {
+		v, _ := strconv.ParseUint(stats[key], 10, 64)
+		return v
+	}
+	status := Status{
+		ID:                node.id,
+		State:             stats["state"],
+		Term:              number("term"),
+		Leader:            string(node.raft.Leader()),
+		LastLogIndex:      number("last_log_index"),
+		CommitIndex:       number("commit_index"),
+		AppliedIndex:      number("applied_index"),
+		LastSnapshotIndex: number("last_snapshot_index"),
+		NumPeers:          int(number("num_peers")),
+		LastContact:       stats["last_contact"],
+		Restoring:         node.kvs.Restoring(),
+	}
+	if status.Leader != "" {
+		id, _ := node.lookupServerID(raft.ServerAddress(status.Leader))
+		status.LeaderID = string(id)
+	}
+	return status
+}
+
+// Ready reports whether the node can serve requests: it knows the leader, is
+// not restoring a snapshot and has applied the committed log up to the
+// configured lag. The error says why it is not ready.
+func (node *RaftNode) Ready() (Status, error) {
+	status := node.Status()
+	switch {
+	case status.Leader == "":
+		return status, errors.New("no known leader")
+	case status.Restoring:
+		return status, errors.New("restoring a snapshot")
+	case status.CommitIndex > status.AppliedIndex+node.readyMaxLag:
+		return status, fmt.Errorf("applied index %d is more than %d behind commit index %d", status.AppliedIndex, node.readyMaxLag, status.CommitIndex)
+	}
+	return status, nil
+}
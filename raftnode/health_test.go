@@ -0,0 +1,33 @@
+package raftnode
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestReady(t *testing.T) {
+	dir, err := ioutil.TempDir("", "depot-health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	node := newTestNode(t, dir)
+	defer node.Close()
+	waitLeader(t, node)
+	if err := node.SetKV("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	status, err := node.Ready()
+	if err != nil {
+		t.Fatalf("expected the leader to be ready, got %v", err)
+	}
+	if status.State != "Leader" || status.LeaderID != "node1" || status.Leader != node.Addr() {
+		t.Fatalf("unexpected status %+v", status)
+	}
+	if status.AppliedIndex == 0 || status.CommitIndex < status.AppliedIndex || status.LastContact != "0" {
+		t.Fatalf("unexpected indexes %+v", status)
+	}
+}
@@ -0,0 +1,142 @@
+package raftnode
+
+import (
+	"sort"
+	"time"
+)
+
+const (
+	// lagCheckInterval is how often the leader compares the followers' progress
+	// with the slow peer threshold
+	lagCheckInterval = time.Second
+	// slowPeerWarnInterval repeats the warning about a peer which stays slow
+	slowPeerWarnInterval = time.Minute
+)
+
+// PeerReplication is the replication progress of a peer as seen by the leader
+type PeerReplication struct {
+	ID       string `json:"id"`
+	Address  string `json:"address"`
+	Suffrage string `json:"suffrage"`
+	// MatchIndex is the last log index the peer reported holding
+	MatchIndex uint64 `json:"match_index"`
+	// Lag is the number of entries of the leader's log the peer misses
+	Lag uint64 `json:"lag"`
+	// LastContact is the time since the peer last answered, "never" when it
+	// has not answered this leader yet
+	LastContact string `json:"last_contact"`
+	// InstallingSnapshot is set while the leader sends the peer a snapshot
+	// because the log entries it needs were compacted
+	InstallingSnapshot bool   `json:"installing_snapshot"`
+	SnapshotIndex      uint64 `json:"snapshot_index,omitempty"`
+	// Slow is set when Lag is above the slow peer threshold
+	Slow bool `json:"slow"`
+}
+
+// ReplicationReport is the replication progress of every peer, only known on
+// the leader
+type ReplicationReport struct {
+	LastLogIndex uint64            `json:"last_log_index"`
+	CommitIndex  uint64            `json:"commit_index"`
+	SlowPeerLag  uint64            `json:"slow_peer_lag"`
+	Peers        []PeerReplication `json:"peers"`
+}
+
+// 各个节点的复制进度，只能在leader上查看
+func (node *RaftNode) Replication() (ReplicationReport, error) {
+	if !node.IsLeader() {
+		return ReplicationReport{}, ErrNotLeader
+	}
+	future := node.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return ReplicationReport{}, err
+	}
+	status := node.Status()
+	report := ReplicationReport{
+		LastLogIndex: status.LastLogIndex,
+		CommitIndex:  status.CommitIndex,
+		SlowPeerLag:  node.slowPeerLag,
+		Peers:        []PeerReplication{},
+	}
+	states := node.transport.peerStates()
+	now := time.Now()
+	for _, server := range future.Configuration().Servers {
+		if string(server.ID) == node.id {
+			continue
+		}
+		state := states[server.ID]
+		peer := PeerReplication{
+			ID:                 string(server.ID),
+			Address:            string(server.Address),
+			Suffrage:           server.Suffrage.String(),
+			MatchIndex:         state.matchIndex,
+			LastContact:        "never",
+			InstallingSnapshot: state.snapshotIndex > 0,
+			SnapshotIndex:      state.snapshotIndex,
+		}
+		if status.LastLogIndex > state.matchIndex {
+			peer.Lag = status.LastLogIndex - state.matchIndex
+		}
+		if !state.contact.IsZero() {
+			peer.LastContact = now.Sub(state.contact).Round(time.Millisecond).String()
+		}
+		peer.Slow = peer.Lag > node.slowPeerLag
+		report.Peers = append(report.Peers, peer)
+	}
+	sort.Slice(report.Peers, func(i, j int) bool { return report.Peers[i].ID < report.Peers[j].ID })
+	return report, nil
+}
+
+// runLagCheck warns on the leader when a peer falls more than slowPeerLag
+// entries behind, again every slowPeerWarnInterval while it stays behind, and
+// tells when it caught up
+func (node *RaftNode) runLagCheck() {
+	ticker := time.NewTicker(lagCheckInterval)
+	defer ticker.Stop()
+
+	// warned holds when each slow peer was last warned about
+	warned := make(map[string]time.Time)
+	for {
+		select {
+		case <-ticker.C:
+		case <-node.shutdownCh:
+			return
+		}
+
+		report, err := node.Replication()
+		if err != nil {
+			// only the leader tracks its peers
+			warned = make(map[string]time.Time)
+			continue
+		}
+		now := time.Now()
+		seen := make(map[string]bool, len(report.Peers))
+		for _, peer := range report.Peers {
+			seen[peer.ID] = true
+			last, slow := warned[peer.ID]
+			switch {
+			case peer.Slow && (!slow || now.Sub(last) >= slowPeerWarnInterval):
+				node.logger.Warn("Peer is falling behind",
+					"peer", peer.ID,
+					"lag", peer.Lag,
+					"match_index", peer.MatchIndex,
+					"last_log_index", report.LastLogIndex,
+					"last_contact", peer.LastContact,
+					"installing_snapshot", peer.InstallingSnapshot)
+				warned[peer.ID] = now
+			case !peer.Slow && slow:
+				node.logger.Info("Peer caught up", "peer", peer.ID, "lag", peer.Lag)
+				delete(warned, peer.ID)
+			}
+		}
+		// removed peers are forgotten
+		for id := range warned {
+			if !seen[id] {
+				delete(warned, id)
+			}
+		}
+		if future := node.raft.GetConfiguration(); future.Error() == nil {
+			node.transport.retain(future.Configuration())
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package raftnode
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/hashicorp/raft"
+)
+
+// answeringTransport answers appends like a follower holding lastLog entries
+type answeringTransport struct {
+	raft.Transport
+	lastLog uint64
+}
+
+func (t *answeringTransport) AppendEntries(id raft.ServerID, target raft.ServerAddress, args *raft.AppendEntriesRequest, resp *raft.AppendEntriesResponse) error {
+	resp.LastLog = t.lastLog
+	resp.Success = true
+	return nil
+}
+
+func (t *answeringTransport) InstallSnapshot(id raft.ServerID, target raft.ServerAddress, args *raft.InstallSnapshotRequest, resp *raft.InstallSnapshotResponse, data io.Reader) error {
+	resp.Success = true
+	return nil
+}
+
+func TestPeerTransport(t *testing.T) {
+	trans := newPeerTransport(&answeringTransport{lastLog: 7})
+
+	// a heartbeat reports the follower's last index
+	var resp raft.AppendEntriesResponse
+	if err := trans.AppendEntries("node2", "addr2", &raft.AppendEntriesRequest{}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if p := trans.peerStates()["node2"]; p.matchIndex != 7 || p.contact.IsZero() {
+		t.Fatalf("unexpected state after heartbeat %+v", p)
+	}
+
+	// an append reports its last entry
+	args := &raft.AppendEntriesRequest{Entries: []*raft.Log{{Index: 8}, {Index: 9}}}
+	if err := trans.AppendEntries("node2", "addr2", args, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if p := trans.peerStates()["node2"]; p.matchIndex != 9 {
+		t.Fatalf("expected match index 9, got %d", p.matchIndex)
+	}
+
+	var snapResp raft.InstallSnapshotResponse
+	if err := trans.InstallSnapshot("node3", "addr3", &raft.InstallSnapshotRequest{LastLogIndex: 20}, &snapResp, nil); err != nil {
+		t.Fatal(err)
+	}
+	if p := trans.peerStates()["node3"]; p.matchIndex != 20 || p.snapshotIndex != 0 {
+		t.Fatalf("unexpected state after snapshot %+v", p)
+	}
+
+	// a removed peer is forgotten
+	trans.retain(raft.Configuration{Servers: []raft.Server{{ID: "node1"}, {ID: "node2"}}})
+	if _, ok := trans.peerStates()["node3"]; ok {
+		t.Fatal("expected the removed peer to be forgotten")
+	}
+
+	// leading a new term starts from scratch, what node2 reported to the
+	// earlier leadership is stale
+	if err := trans.AppendEntries("node4", "addr4", &raft.AppendEntriesRequest{Term: 2}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	states := trans.peerStates()
+	if _, ok := states["node2"]; ok || len(states) != 1 {
+		t.Fatalf("expected only the peer heard from in the new term, got %+v", states)
+	}
+	// a late answer to a request of the earlier term is ignored
+	if err := trans.AppendEntries("node2", "addr2", args, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := trans.peerStates()["node2"]; ok {
+		t.Fatal("expected the answer of an earlier term to be ignored")
+	}
+}
+
+func TestReplication(t *testing.T) {
+	dir, err := ioutil.TempDir("", "depot-lag")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	node := newTestNode(t, dir)
+	defer node.Close()
+	waitLeader(t, node)
+	if err := node.SetKV("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	node.slowPeerLag = 1
+	// a non voter that never answers keeps the single voter the leader
+	if err := node.raft.AddNonvoter("node2", "127.0.0.1:1", 0, 0).Error(); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := node.Replication()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Peers) != 1 {
+		t.Fatalf("expected one peer, got %+v", report)
+	}
+	peer := report.Peers[0]
+	if peer.ID != "node2" || peer.Suffrage != "Nonvoter" || peer.LastContact != "never" {
+		t.Fatalf("unexpected peer %+v", peer)
+	}
+	if peer.Lag != report.LastLogIndex || !peer.Slow {
+		t.Fatalf("expected the peer to miss the whole log, got %+v of %d", peer, report.LastLogIndex)
+	}
+}
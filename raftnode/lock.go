@@ -0,0 +1,29 @@
+//go:build !windows
+// +build !windows
+
+package raftnode
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// lockDataDir takes an exclusive lock on dataDir, held until the returned file
+// is closed or the process exits
+func lockDataDir(dataDir string) (*os.File, error) {
+	path := filepath.Join(dataDir, lockFile)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open lock file (%s): (%v)", path, err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, fmt.Errorf("data directory (%s) is in use by another depot process", dataDir)
+		}
+		return nil, fmt.Errorf("Failed to lock data directory (%s): (%v)", dataDir, err)
+	}
+	return f, nil
+}
@@ -0,0 +1,18 @@
+package raftnode
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// lockDataDir only creates the lock file, data directories are not locked on
+// windows
+func lockDataDir(dataDir string) (*os.File, error) {
+	path := filepath.Join(dataDir, lockFile)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open lock file (%s): (%v)", path, err)
+	}
+	return f, nil
+}
@@ -0,0 +1,156 @@
+package raftnode
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/forjoin92/depot/logstore"
+	"github.com/hashicorp/raft"
+	"github.com/hashicorp/raft-boltdb"
+)
+
+// log store backends
+const (
+	LogStoreBolt    = "bolt"
+	LogStoreMemory  = "memory"
+	LogStoreSegment = "segment"
+)
+
+// LogStoreStats reports the size of the raft log store and how long it
+// takes to durably append a batch of entries
+type LogStoreStats struct {
+	Backend    string `json:"backend"`
+	SizeBytes  int64  `json:"size_bytes"`
+	FirstIndex uint64 `json:"first_index"`
+	LastIndex  uint64 `json:"last_index"`
+	// Appends counts appended batches, the latencies include the fsync
+	Appends          uint64  `json:"appends"`
+	AppendSecondsAvg float64 `json:"append_seconds_avg"`
+	AppendSecondsMax float64 `json:"append_seconds_max"`
+}
+
+// logStorage holds the raft log and stable stores of one backend
+type logStorage struct {
+	backend string
+	// logs is the cached log store handed to raft
+	logs   raft.LogStore
+	stable raft.StableStore
+	timed  *timedLogStore
+	size   func() int64
+	close  func() error
+}
+
+func openLogStorage(c *Config, raftDBPath string) (*logStorage, error) {
+	s := &logStorage{backend: c.logStore()}
+	var logs raft.LogStore
+	switch s.backend {
+	case LogStoreBolt:
+		path := filepath.Join(raftDBPath, "raft.db")
+		bolt, err := raftboltdb.NewBoltStore(path)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to create log store and stable store (%s): (%v)", raftDBPath, err)
+		}
+		logs, s.stable, s.close = bolt, bolt, bolt.Close
+		s.size = func() int64 { return fileSize(path) }
+
+	case LogStoreMemory:
+		// nothing survives a restart, only meant for tests
+		inmem := raft.NewInmemStore()
+		logs, s.stable, s.close = inmem, inmem, func() error { return nil }
+		s.size = func() int64 { return 0 }
+
+	case LogStoreSegment:
+		segmented, err := logstore.OpenSegmented(filepath.Join(raftDBPath, "log"), c.SegmentSize)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to create segmented log store (%s): (%v)", raftDBPath, err)
+		}
+		stable, err := logstore.OpenFileStable(filepath.Join(raftDBPath, "stable.json"))
+		if err != nil {
+			segmented.Close()
+			return nil, fmt.Errorf("Failed to create stable store (%s): (%v)", raftDBPath, err)
+		}
+		logs, s.stable, s.close = segmented, stable, segmented.Close
+		s.size = segmented.Size
+
+	default:
+		return nil, fmt.Errorf("unknown log store %q", s.backend)
+	}
+
+	s.timed = &timedLogStore{LogStore: logs}
+	cache, err := raft.NewLogCache(c.logCacheSize(), s.timed)
+	if err != nil {
+		s.close()
+		return nil, fmt.Errorf("Failed to create log cache : (%v)", err)
+	}
+	s.logs = cache
+	return s, nil
+}
+
+func (s *logStorage) stats() LogStoreStats {
+	stats := s.timed.stats()
+	stats.Backend = s.backend
+	stats.SizeBytes = s.size()
+	stats.FirstIndex, _ = s.logs.FirstIndex()
+	stats.LastIndex, _ = s.logs.LastIndex()
+	return stats
+}
+
+// 日志存储的大小和写入延迟
+func (node *RaftNode) LogStoreStats() LogStoreStats {
+	return node.logStore.stats()
+}
+
+// timedLogStore measures how long appends to the underlying store take
+type timedLogStore struct {
+	raft.LogStore
+
+	sync.Mutex
+	appends uint64
+	total   time.Duration
+	max     time.Duration
+}
+
+func (t *timedLogStore) StoreLog(log *raft.Log) error {
+	start := time.Now()
+	err := t.LogStore.StoreLog(log)
+	t.record(time.Since(start))
+	return err
+}
+
+func (t *timedLogStore) StoreLogs(logs []*raft.Log) error {
+	start := time.Now()
+	err := t.LogStore.StoreLogs(logs)
+	t.record(time.Since(start))
+	return err
+}
+
+func (t *timedLogStore) record(d time.Duration) {
+	t.Lock()
+	defer t.Unlock()
+	t.appends++
+	t.total += d
+	if d > t.max {
+		t.max = d
+	}
+}
+
+func (t *timedLogStore) stats() LogStoreStats {
+	t.Lock()
+	defer t.Unlock()
+	stats := LogStoreStats{Appends: t.appends, AppendSecondsMax: t.max.Seconds()}
+	if t.appends > 0 {
+		stats.AppendSecondsAvg = t.total.Seconds() / float64(t.appends)
+	}
+	return stats
+}
+
+func fileSize(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
@@ -0,0 +1,84 @@
+package raftnode
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestLogStoreBackends(t *testing.T) {
+	for _, backend := range []string{LogStoreBolt, LogStoreSegment, LogStoreMemory} {
+		t.Run(backend, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "depot-logstore")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			addr := l.Addr().String()
+			l.Close()
+			c := &Config{
+				ID:                 "node1",
+				BindAddr:           addr,
+				Bootstrap:          true,
+				DataDir:            dir,
+				LogStore:           backend,
+				HeartbeatTimeout:   50 * time.Millisecond,
+				ElectionTimeout:    50 * time.Millisecond,
+				LeaderLeaseTimeout: 50 * time.Millisecond,
+				CommitTimeout:      5 * time.Millisecond,
+			}
+
+			node, err := NewRaftNode(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			waitLeader(t, node)
+			if err := node.SetKV("a", "1"); err != nil {
+				t.Fatal(err)
+			}
+			stats := node.LogStoreStats()
+			if stats.Backend != backend || stats.Appends == 0 || stats.LastIndex == 0 {
+				t.Fatalf("unexpected stats %+v", stats)
+			}
+			if backend != LogStoreMemory && stats.SizeBytes == 0 {
+				t.Fatalf("expected the log store size to be reported, got %+v", stats)
+			}
+			node.Close()
+			if backend == LogStoreMemory {
+				return
+			}
+
+			// the log is replayed after a restart
+			node, err = NewRaftNode(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer node.Close()
+			waitLeader(t, node)
+			deadline := time.Now().Add(10 * time.Second)
+			for node.GetKV("a") != "1" {
+				if time.Now().After(deadline) {
+					t.Fatal("value was not restored from the log")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+	}
+}
+
+func waitLeader(t *testing.T, node *RaftNode) {
+	deadline := time.Now().Add(10 * time.Second)
+	for !node.IsLeader() {
+		if time.Now().After(deadline) {
+			t.Fatal("node did not become leader")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,206 @@
+package raftnode
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// FormatVersion is the layout of the data directory written by this build
+	FormatVersion = 1
+
+	metaFile = "meta.json"
+	lockFile = "LOCK"
+	// nodeIDFile held the node id before meta.json was introduced
+	nodeIDFile = "node-id"
+
+	// clusterIDKey holds the replicated cluster id
+	clusterIDKey = "cluster/id"
+)
+
+// ErrClusterIDMismatch is returned for join requests from another cluster
+var ErrClusterIDMismatch = errors.New("cluster id does not match")
+
+// Meta is the identity recorded in a data directory
+type Meta struct {
+	NodeID string `json:"node_id"`
+	// ClusterID is empty until the node learns it from the replicated log
+	ClusterID     string `json:"cluster_id"`
+	FormatVersion int    `json:"format_version"`
+}
+
+// nodeMeta guards the meta file of a running node
+type nodeMeta struct {
+	path string
+
+	sync.RWMutex
+	meta Meta
+}
+
+// loadMeta returns the metadata of dataDir, creating it when none exists. A
+// non empty id must match the recorded one.
+func loadMeta(dataDir, id string) (*nodeMeta, error) {
+	path := filepath.Join(dataDir, metaFile)
+	m := &nodeMeta{path: path}
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		if err := json.Unmarshal(data, &m.meta); err != nil {
+			return nil, fmt.Errorf("Failed to parse metadata (%s): (%v)", path, err)
+		}
+		if m.meta.FormatVersion > FormatVersion {
+			return nil, fmt.Errorf("data directory (%s) has format version %d, this build only reads up to %d", dataDir, m.meta.FormatVersion, FormatVersion)
+		}
+		if id != "" && id != m.meta.NodeID {
+			return nil, fmt.Errorf("node id (%s) does not match id (%s) stored in %s", id, m.meta.NodeID, path)
+		}
+		return m, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("Failed to read metadata (%s): (%v)", path, err)
+	}
+
+	if id, err = legacyNodeID(dataDir, id); err != nil {
+		return nil, err
+	}
+	if id == "" {
+		if id, err = generateID(); err != nil {
+			return nil, err
+		}
+	}
+	m.meta = Meta{NodeID: id, FormatVersion: FormatVersion}
+	if err := m.save(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// legacyNodeID reads the node-id file of older builds
+func legacyNodeID(dataDir, id string) (string, error) {
+	path := filepath.Join(dataDir, nodeIDFile)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return id, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("Failed to read node id (%s): (%v)", path, err)
+	}
+	stored := strings.TrimSpace(string(data))
+	if id != "" && id != stored {
+		return "", fmt.Errorf("node id (%s) does not match id (%s) stored in %s", id, stored, path)
+	}
+	return stored, nil
+}
+
+func (m *nodeMeta) get() Meta {
+	m.RLock()
+	defer m.RUnlock()
+	return m.meta
+}
+
+func (m *nodeMeta) setClusterID(clusterID string) error {
+	m.Lock()
+	defer m.Unlock()
+	m.meta.ClusterID = clusterID
+	return m.save()
+}
+
+// save replaces the meta file, the file is either the old or the new one
+// after a crash
+func (m *nodeMeta) save() error {
+	data, err := json.MarshalIndent(m.meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := m.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(data, '\n'), 0600); err != nil {
+		return fmt.Errorf("Failed to write metadata (%s): (%v)", tmp, err)
+	}
+	if err := os.Rename(tmp, m.path); err != nil {
+		return fmt.Errorf("Failed to write metadata (%s): (%v)", m.path, err)
+	}
+	return nil
+}
+
+// 本节点所在集群的id，加入集群前为空
+func (node *RaftNode) ClusterID() string {
+	return node.meta.get().ClusterID
+}
+
+// 数据目录记录的元数据
+func (node *RaftNode) Meta() Meta {
+	return node.meta.get()
+}
+
+// CheckClusterID refuses nodes of another cluster, an empty id is a new node.
+// The recorded id is used until the replicated one is set, a bootstrapped
+// node records it right away.
+func (node *RaftNode) CheckClusterID(clusterID string) error {
+	current := node.kvs.Get(clusterIDKey)
+	if current == "" {
+		current = node.ClusterID()
+	}
+	if clusterID == "" || current == "" || clusterID == current {
+		return nil
+	}
+	return fmt.Errorf("%w (%s, this cluster is %s)", ErrClusterIDMismatch, clusterID, current)
+}
+
+// runClusterID makes the leader generate the cluster id once, and records the
+// replicated id in the meta file of every member
+func (node *RaftNode) runClusterID() {
+	ticker := time.NewTicker(eventPollInterval)
+	defer ticker.Stop()
+	warned := false
+	for {
+		select {
+		case <-node.shutdownCh:
+			return
+		case <-ticker.C:
+		}
+
+		replicated := node.kvs.Get(clusterIDKey)
+		local := node.ClusterID()
+		switch {
+		case replicated == "":
+			if !node.IsLeader() {
+				continue
+			}
+			// clusters created by older builds get an id as well
+			clusterID := local
+			if clusterID == "" {
+				var err error
+				if clusterID, err = generateID(); err != nil {
+					node.logger.Error("Failed to generate cluster id", "err", err)
+					continue
+				}
+			}
+			if err := node.SetKV(clusterIDKey, clusterID); err != nil {
+				node.logger.Error("Failed to record cluster id", "err", err)
+			}
+		case local == "":
+			if err := node.meta.setClusterID(replicated); err != nil {
+				node.logger.Error("Failed to record cluster id", "err", err)
+			}
+		case local != replicated && !warned:
+			node.logger.Warn("Node belongs to another cluster than it replicates, keeping the recorded id", "cluster_id", local, "replicated_cluster_id", replicated)
+			warned = true
+		}
+	}
+}
+
+// generateID returns a random uuid formatted id
+func generateID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("Failed to generate id: (%v)", err)
+	}
+	return fmt.Sprintf("%x-%x-%x-%x-%x", buf[0:4], buf[4:6], buf[6:8], buf[8:10], buf[10:16]), nil
+}
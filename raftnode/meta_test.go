@@ -0,0 +1,151 @@
+package raftnode
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadMeta(t *testing.T) {
+	dir, err := ioutil.TempDir("", "depot-meta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// data directories of older builds only have a node-id file
+	ioutil.WriteFile(filepath.Join(dir, nodeIDFile), []byte("node1\n"), 0600)
+	meta, err := loadMeta(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := meta.get(); m.NodeID != "node1" || m.FormatVersion != FormatVersion || m.ClusterID != "" {
+		t.Fatalf("unexpected meta %+v", m)
+	}
+	if err := meta.setClusterID("cluster1"); err != nil {
+		t.Fatal(err)
+	}
+
+	meta, err = loadMeta(dir, "node1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := meta.get(); m.ClusterID != "cluster1" {
+		t.Fatalf("cluster id was not kept: %+v", m)
+	}
+	if _, err := loadMeta(dir, "node2"); err == nil {
+		t.Fatal("expected a different node id to be refused")
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, metaFile), []byte(`{"node_id": "node1", "format_version": 99}`), 0600)
+	if _, err := loadMeta(dir, ""); err == nil || !strings.Contains(err.Error(), "format version") {
+		t.Fatalf("expected a newer format to be refused, got %v", err)
+	}
+}
+
+func TestDataDirLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "depot-meta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	node := newTestNode(t, dir)
+	if _, err := NewRaftNode(&Config{BindAddr: "127.0.0.1:0", DataDir: dir}); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Fatalf("expected the data directory to be locked, got %v", err)
+	}
+	node.Close()
+
+	lock, err := lockDataDir(dir)
+	if err != nil {
+		t.Fatalf("expected the lock to be released on close, got %v", err)
+	}
+	lock.Close()
+}
+
+func TestNewRaftNodeFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "depot-meta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	c := &Config{ID: "node1", BindAddr: addr, Bootstrap: true, DataDir: dir}
+
+	if _, err := NewRaftNode(&Config{ID: "node1", BindAddr: addr, Bootstrap: true, DataDir: dir, Cluster: "node1=127.0.0.1:1,node1=127.0.0.1:2"}); err == nil {
+		t.Fatal("expected an invalid cluster to be refused")
+	}
+	// raft is running when the bootstrap cluster turns out not to name us
+	c.Cluster = "node2=127.0.0.1:1"
+	if _, err := NewRaftNode(c); err == nil || !strings.Contains(err.Error(), "does not contain") {
+		t.Fatalf("expected a cluster without the node to be refused, got %v", err)
+	}
+
+	// the port, the log store and the data directory were all let go
+	c.Cluster = ""
+	done := make(chan error, 1)
+	go func() {
+		node, err := NewRaftNode(c)
+		if err == nil {
+			node.Close()
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("expected the node to start after a failed attempt: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("node did not start, the log store is still held")
+	}
+}
+
+func TestClusterID(t *testing.T) {
+	dir, err := ioutil.TempDir("", "depot-meta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	node := newTestNode(t, dir)
+	defer node.Close()
+	// bootstrapping generates the id, it is checked before it is replicated
+	clusterID := node.ClusterID()
+	if clusterID == "" {
+		t.Fatal("cluster id was not generated on bootstrap")
+	}
+	if err := node.CheckClusterID("other"); err == nil {
+		t.Fatal("expected a node of another cluster to be refused before the id is replicated")
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for node.GetKV(clusterIDKey) != clusterID {
+		if time.Now().After(deadline) {
+			t.Fatalf("cluster id %s is not replicated", clusterID)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !IsInternalKey(clusterIDKey) {
+		t.Fatal("expected the cluster id to be an internal key")
+	}
+
+	if err := node.CheckClusterID(""); err != nil {
+		t.Fatalf("expected a new node to be accepted, got %v", err)
+	}
+	if err := node.CheckClusterID(clusterID); err != nil {
+		t.Fatalf("expected a member of the cluster to be accepted, got %v", err)
+	}
+	if err := node.CheckClusterID("other"); err == nil {
+		t.Fatal("expected a node of another cluster to be refused")
+	}
+}
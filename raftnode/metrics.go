@@ -0,0 +1,102 @@
+package raftnode
+
+import (
+	"time"
+
+	"github.com/forjoin92/depot/metrics"
+	"github.com/hashicorp/raft"
+)
+
+// raftStates are reported by depot_raft_state, one series per state
+var raftStates = []string{"Follower", "Candidate", "Leader", "Shutdown"}
+
+// nodeMetrics are the metrics recorded as things happen, the rest is read
+// from raft when scraped
+type nodeMetrics struct {
+	apply    *metrics.HistogramVec
+	snapshot *metrics.HistogramVec
+}
+
+func newNodeMetrics() *nodeMetrics {
+	return &nodeMetrics{
+		apply:    metrics.NewHistogramVec("depot_raft_apply_duration_seconds", "Time to commit and apply a write proposed by this node.", metrics.DefaultBuckets),
+		snapshot: metrics.NewHistogramVec("depot_snapshot_duration_seconds", "Time to take a snapshot.", metrics.DefaultBuckets),
+	}
+}
+
+// Collect returns the raft, state machine and snapshot metrics of the node
+func (node *RaftNode) Collect() []metrics.Family {
+	status := node.Status()
+	var families []metrics.Family
+
+	state := metrics.Family{Name: "depot_raft_state", Help: "Raft state of the node, 1 for the current state.", Type: metrics.TypeGauge}
+	for _, s := range raftStates {
+		value := 0.0
+		if s == status.State {
+			value = 1
+		}
+		state.Samples = append(state.Samples, metrics.Sample{Labels: []metrics.Label{{Name: "state", Value: s}}, Value: value})
+	}
+	families = append(families, state)
+
+	leader := 0.0
+	if status.Leader != "" {
+		leader = 1
+	}
+	families = append(families,
+		metrics.Gauge("depot_raft_term", "Current raft term.", float64(status.Term)),
+		metrics.Gauge("depot_raft_last_log_index", "Index of the last log entry.", float64(status.LastLogIndex)),
+		metrics.Gauge("depot_raft_commit_index", "Index of the last committed entry.", float64(status.CommitIndex)),
+		metrics.Gauge("depot_raft_applied_index", "Index of the last entry applied to the state machine.", float64(status.AppliedIndex)),
+		metrics.Gauge("depot_raft_last_snapshot_index", "Index of the last snapshot.", float64(status.LastSnapshotIndex)),
+		metrics.Gauge("depot_raft_has_leader", "1 when the node knows the leader.", leader),
+		metrics.Gauge("depot_raft_peers", "Voting peers besides this node.", float64(status.NumPeers)),
+		node.lastContactFamily(status),
+		node.metrics.apply.Collect()[0],
+	)
+
+	keys, bytes := node.kvs.Size()
+	families = append(families,
+		metrics.Gauge("depot_fsm_keys", "Keys in the state machine.", float64(keys)),
+		metrics.Gauge("depot_fsm_bytes", "Bytes of keys and values in the state machine.", float64(bytes)),
+		node.metrics.snapshot.Collect()[0],
+	)
+	if report, err := node.Replication(); err == nil {
+		lag := metrics.Family{Name: "depot_raft_peer_lag_entries", Help: "Log entries of the leader a peer misses, on the leader.", Type: metrics.TypeGauge}
+		for _, peer := range report.Peers {
+			lag.Samples = append(lag.Samples, metrics.Sample{Labels: []metrics.Label{{Name: "peer", Value: peer.ID}}, Value: float64(peer.Lag)})
+		}
+		families = append(families, lag)
+	}
+	if snapshots, err := node.Snapshots(); err == nil && len(snapshots) > 0 {
+		families = append(families, metrics.Gauge("depot_snapshot_size_bytes", "Size of the latest snapshot.", float64(snapshots[0].Size)))
+	}
+	return families
+}
+
+// lastContactFamily reports the seconds since each peer answered the leader,
+// on a follower since it heard from the leader
+func (node *RaftNode) lastContactFamily(status Status) metrics.Family {
+	f := metrics.Family{Name: "depot_raft_last_contact_seconds", Help: "Seconds since the peer was last heard from.", Type: metrics.TypeGauge}
+	peer := func(id string, at time.Time) {
+		f.Samples = append(f.Samples, metrics.Sample{
+			Labels: []metrics.Label{{Name: "peer", Value: id}},
+			Value:  time.Since(at).Seconds(),
+		})
+	}
+	if status.State == raft.Leader.String() {
+		future := node.raft.GetConfiguration()
+		if future.Error() != nil {
+			return f
+		}
+		contacts := node.transport.lastContacts()
+		for _, server := range future.Configuration().Servers {
+			if at, ok := contacts[server.ID]; ok && string(server.ID) != node.id {
+				peer(string(server.ID), at)
+			}
+		}
+	} else if last := node.raft.LastContact(); !last.IsZero() && status.LeaderID != "" {
+		peer(status.LeaderID, last)
+	}
+	return f
+}
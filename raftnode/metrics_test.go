@@ -0,0 +1,57 @@
+package raftnode
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/forjoin92/depot/metrics"
+)
+
+func TestCollect(t *testing.T) {
+	dir, err := ioutil.TempDir("", "depot-metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	node := newTestNode(t, dir)
+	defer node.Close()
+	waitLeader(t, node)
+	if err := node.SetKV("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := node.TakeSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := metrics.NewRegistry()
+	r.Register(node)
+	var buf bytes.Buffer
+	if err := r.WriteText(&buf); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, want := range []string{
+		`depot_raft_state{state="Leader"} 1`,
+		`depot_raft_state{state="Follower"} 0`,
+		"depot_raft_has_leader 1",
+		"depot_raft_apply_duration_seconds_count ",
+		"depot_snapshot_duration_seconds_count 1",
+		"depot_fsm_keys ",
+		"# TYPE depot_snapshot_size_bytes gauge",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in:\n%s", want, out)
+		}
+	}
+	if node.metrics.apply.Count() == 0 {
+		t.Fatal("expected the write to be timed")
+	}
+	keys, bytes := node.kvs.Size()
+	if keys == 0 || bytes < int64(len("keyvalue")) {
+		t.Fatalf("unexpected fsm size %d keys %d bytes", keys, bytes)
+	}
+}
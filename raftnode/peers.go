@@ -0,0 +1,164 @@
+package raftnode
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// peerTransport records what the leader learns from each peer's answers:
+// when it last answered, the last log index it holds and whether a snapshot
+// is being sent to it. Raft sends heartbeats with AppendEntries outside of the
+// pipeline, so the leader hears from every reachable peer several times per
+// heartbeat timeout. What is known is dropped when the node leads a new term,
+// a peer's state from an earlier leadership is stale.
+type peerTransport struct {
+	raft.Transport
+
+	sync.Mutex
+	// term is the term of the requests the states were learned from
+	term  uint64
+	peers map[raft.ServerID]*peerState
+}
+
+type peerState struct {
+	contact time.Time
+	// matchIndex is the last log index the peer reported holding. It comes
+	// from the answers to heartbeats and appends, a follower with a stale
+	// tail from an older term may report entries which do not match yet.
+	matchIndex uint64
+	// snapshotIndex is the index of the snapshot being installed, 0 when none
+	snapshotIndex uint64
+	// err is the error of the last request which did not reach the peer,
+	// nil once a request reached it again
+	err error
+}
+
+func newPeerTransport(trans raft.Transport) *peerTransport {
+	return &peerTransport{Transport: trans, peers: make(map[raft.ServerID]*peerState)}
+}
+
+func (t *peerTransport) AppendEntries(id raft.ServerID, target raft.ServerAddress, args *raft.AppendEntriesRequest, resp *raft.AppendEntriesResponse) error {
+	err := t.Transport.AppendEntries(id, target, args, resp)
+	if err == nil {
+		match := resp.LastLog
+		// LastLog is taken before the entries are appended
+		if resp.Success && len(args.Entries) > 0 {
+			match = args.Entries[len(args.Entries)-1].Index
+		}
+		t.Lock()
+		if t.observe(args.Term) {
+			p := t.peer(id)
+			p.contact = time.Now()
+			p.matchIndex = match
+			p.err = nil
+		}
+		t.Unlock()
+	} else {
+		t.Lock()
+		if t.observe(args.Term) {
+			t.peer(id).err = err
+		}
+		t.Unlock()
+	}
+	return err
+}
+
+func (t *peerTransport) InstallSnapshot(id raft.ServerID, target raft.ServerAddress, args *raft.InstallSnapshotRequest, resp *raft.InstallSnapshotResponse, data io.Reader) error {
+	t.Lock()
+	if t.observe(args.Term) {
+		t.peer(id).snapshotIndex = args.LastLogIndex
+	}
+	t.Unlock()
+
+	err := t.Transport.InstallSnapshot(id, target, args, resp, data)
+
+	t.Lock()
+	defer t.Unlock()
+	if !t.observe(args.Term) {
+		return err
+	}
+	p := t.peer(id)
+	p.snapshotIndex = 0
+	if err != nil {
+		p.err = err
+	}
+	if err == nil && resp.Success {
+		p.err = nil
+		p.contact = time.Now()
+		if args.LastLogIndex > p.matchIndex {
+			p.matchIndex = args.LastLogIndex
+		}
+	}
+	return err
+}
+
+// observe drops the states learned in earlier terms when a request of a newer
+// term is sent, and tells whether the answer to a request of term belongs to
+// the current one. It must be called with the lock held.
+func (t *peerTransport) observe(term uint64) bool {
+	if term > t.term {
+		t.term = term
+		t.peers = make(map[raft.ServerID]*peerState)
+	}
+	return term == t.term
+}
+
+// retain forgets the peers which are not in the configuration any more
+func (t *peerTransport) retain(configuration raft.Configuration) {
+	t.Lock()
+	defer t.Unlock()
+	members := make(map[raft.ServerID]bool, len(configuration.Servers))
+	for _, server := range configuration.Servers {
+		members[server.ID] = true
+	}
+	for id := range t.peers {
+		if !members[id] {
+			delete(t.peers, id)
+		}
+	}
+}
+
+// peer must be called with the lock held
+func (t *peerTransport) peer(id raft.ServerID) *peerState {
+	p, ok := t.peers[id]
+	if !ok {
+		p = &peerState{}
+		t.peers[id] = p
+	}
+	return p
+}
+
+// Close lets raft close the wrapped transport on shutdown
+func (t *peerTransport) Close() error {
+	if closer, ok := t.Transport.(raft.WithClose); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// lastContacts returns when each peer last answered
+func (t *peerTransport) lastContacts() map[raft.ServerID]time.Time {
+	t.Lock()
+	defer t.Unlock()
+	contacts := make(map[raft.ServerID]time.Time, len(t.peers))
+	for id, p := range t.peers {
+		if !p.contact.IsZero() {
+			contacts[id] = p.contact
+		}
+	}
+	return contacts
+}
+
+// peerStates returns a copy of what is known about each peer
+func (t *peerTransport) peerStates() map[raft.ServerID]peerState {
+	t.Lock()
+	defer t.Unlock()
+	states := make(map[raft.ServerID]peerState, len(t.peers))
+	for id, p := range t.peers {
+		states[id] = *p
+	}
+	return states
+}
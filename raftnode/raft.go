@@ -1,157 +1,368 @@
 package raftnode
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net"
 	"os"
-	"path/filepath"
-	"strings"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/forjoin92/depot/logging"
 	"github.com/forjoin92/depot/store"
+	"github.com/forjoin92/depot/tracing"
 	"github.com/hashicorp/raft"
-	"github.com/hashicorp/raft-boltdb"
 )
 
+// ErrNotLeader is returned for requests only the leader can serve
+var ErrNotLeader = errors.New("Not the leader")
+
 type RaftNode struct {
-	id    string
-	peers []string
+	id       string
+	addr     string
+	apiAddr  string
+	zone     string
+	peers    []raft.Server
+	hasState bool
 
 	dataDir      string
 	snapshotPath string
 	raftDBPath   string
 
-	kvs  *store.KvStore
-	raft *raft.Raft
+	kvs       *store.KvStore
+	raft      *raft.Raft
+	logStore  *logStorage
+	snapshots *raft.FileSnapshotStore
+	tlsLayer  *tlsStreamLayer
+	transport *peerTransport
+	metrics   *nodeMetrics
+	meta      *nodeMeta
+	// lock keeps other processes out of dataDir
+	lock *os.File
+
+	// applyTimeout and the snapshot policy can be changed at runtime
+	applyTimeout      int64
+	snapshotInterval  int64
+	snapshotThreshold uint64
+	readyMaxLag       uint64
+	slowPeerLag       uint64
+	// commands are the operations this build applies, store.Commands
+	commands []string
+
+	events *eventBus
+	logger *logging.Logger
+	tracer *tracing.Tracer
+
+	shutdownCh chan struct{}
+	closeOnce  sync.Once
+	closeErr   error
 }
 
-func NewRaftNode(id string, cluster string, dataDir string, snapshotPath string, raftDBPath string) (*RaftNode, error) {
-	if id == "" {
-		return nil, fmt.Errorf("id should not be empty")
+func NewRaftNode(c *Config) (_ *RaftNode, err error) {
+	if c.BindAddr == "" {
+		return nil, fmt.Errorf("bind address should not be empty")
 	}
-	config := raft.DefaultConfig()
-	config.LocalID = raft.ServerID(id)
-	config.SnapshotInterval = 30 * time.Second
-	config.SnapshotThreshold = 10
-	config.TrailingLogs = 10
-
-	if dataDir == "" {
-		dataDir = filepath.Join(DefaultDataDir(), id)
+	advertise := c.AdvertiseAddr
+	if advertise == "" {
+		advertise = c.BindAddr
 	}
 
+	dataDir, snapshotPath, raftDBPath := c.paths()
+
 	if err := os.MkdirAll(dataDir, 0700); err != nil {
 		return nil, fmt.Errorf("Failed to mkdir (%s): (%v)", dataDir, err)
 	}
 
-	addr, err := net.ResolveTCPAddr("tcp", id)
+	// 同一个数据目录只能被一个进程使用
+	lock, err := lockDataDir(dataDir)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to resolve TCP address (%s): (%v)", id, err)
+		return nil, err
 	}
+	defer func() {
+		if err != nil {
+			lock.Close()
+		}
+	}()
 
-	transport, err := raft.NewTCPTransport(id, addr, 3, 10*time.Second, os.Stderr)
+	meta, err := loadMeta(dataDir, c.ID)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to create TCP transport (%s): (%v)", id, err)
+		return nil, err
 	}
+	id := meta.get().NodeID
+	logger := c.logger().With("node_id", id)
 
-	if snapshotPath == "" {
-		snapshotPath = dataDir
+	config := c.raftConfig(id, logger)
+	if err := raft.ValidateConfig(config); err != nil {
+		return nil, fmt.Errorf("Invalid raft config : (%v)", err)
 	}
-	snapshot, err := raft.NewFileSnapshotStore(snapshotPath, 3, os.Stderr)
+	servers, err := ParseCluster(c.Cluster)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to create file snapshot store (%s): (%v)", snapshotPath, err)
+		return nil, err
 	}
 
-	if raftDBPath == "" {
-		raftDBPath = dataDir
-	}
-	logStore, err := raftboltdb.NewBoltStore(filepath.Join(raftDBPath, "raft.db"))
+	addr, err := net.ResolveTCPAddr("tcp", advertise)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to create log store and stable store (%s): (%v)", raftDBPath, err)
+		return nil, fmt.Errorf("Failed to resolve TCP address (%s): (%v)", advertise, err)
 	}
 
-	kvs := store.NewKVStore()
+	// on a failure below everything opened so far is closed in reverse order,
+	// raft first so that it lets go of the transport and the stores
+	transport, tlsLayer, err := newTransport(c, addr, logger)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			transport.Close()
+		}
+	}()
 
-	r, err := raft.NewRaft(config, kvs, logStore, logStore, snapshot, transport)
+	snapshot, err := raft.NewFileSnapshotStore(snapshotPath, c.snapshotRetain(), logger.Writer())
 	if err != nil {
-		return nil, fmt.Errorf("Failed to create Raft system : (%v)", err)
+		return nil, fmt.Errorf("Failed to create file snapshot store (%s): (%v)", snapshotPath, err)
 	}
 
-	var clusters []string
-	if cluster == "" {
-		clusters = append(clusters, id)
-	} else {
-		clusters = strings.Split(cluster, ",")
+	logStore, err := openLogStorage(c, raftDBPath)
+	if err != nil {
+		return nil, err
 	}
-	servers := make([]raft.Server, len(clusters))
-	for i, server := range clusters {
-		servers[i] = raft.Server{
-			ID:      raft.ServerID(server),
-			Address: raft.ServerAddress(server),
+	defer func() {
+		if err != nil {
+			logStore.close()
 		}
+	}()
+
+	// 已有raft状态的节点不能再次bootstrap
+	hasState, err := raft.HasExistingState(logStore.logs, logStore.stable, snapshot)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to check existing raft state (%s): (%v)", raftDBPath, err)
 	}
 
-	configuration := raft.Configuration{
-		Servers: servers,
+	kvs := store.NewKVStore()
+	kvs.SetLogger(logger)
+	tracer := c.Tracer.With("node", id)
+	kvs.SetTracer(tracer)
+
+	// raft restores the latest snapshot inside NewRaft, so the callback is
+	// registered first and publishes through restored once node exists, the
+	// startup restore is published then
+	var (
+		restoreLock  sync.Mutex
+		restored     *RaftNode
+		startupIndex *uint64
+	)
+	kvs.OnRestore(func(index uint64) {
+		restoreLock.Lock()
+		defer restoreLock.Unlock()
+		if restored == nil {
+			startupIndex = &index
+			return
+		}
+		restored.publish(Event{Type: EventSnapshotRestored, Index: index})
+	})
+
+	tracked := newPeerTransport(transport)
+	r, err := raft.NewRaft(config, kvs, logStore.logs, logStore.stable, snapshot, tracked)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create Raft system : (%v)", err)
 	}
+	defer func() {
+		if err != nil {
+			r.Shutdown()
+		}
+	}()
 
-	r.BootstrapCluster(configuration)
+	switch {
+	case hasState:
+		if c.Bootstrap || c.Cluster != "" {
+			logger.Warn("Node has existing raft state, ignoring bootstrap settings", "path", raftDBPath)
+		}
+	case c.Bootstrap:
+		// 只有新建集群时才bootstrap
+		if len(servers) == 0 {
+			servers = append(servers, raft.Server{
+				Suffrage: raft.Voter,
+				ID:       raft.ServerID(id),
+				Address:  transport.LocalAddr(),
+			})
+		}
+		if !containsServer(servers, raft.ServerID(id)) {
+			return nil, fmt.Errorf("bootstrap cluster (%s) does not contain local node id (%s)", c.Cluster, id)
+		}
+		configuration := raft.Configuration{
+			Servers: servers,
+		}
+		if err := r.BootstrapCluster(configuration).Error(); err != nil {
+			return nil, fmt.Errorf("Failed to bootstrap cluster : (%v)", err)
+		}
+		// a cluster of one knows its id right away, the first leader
+		// replicates it. Members bootstrapped together learn the id of
+		// whichever becomes leader first.
+		if len(servers) == 1 && meta.get().ClusterID == "" {
+			clusterID, err := generateID()
+			if err == nil {
+				err = meta.setClusterID(clusterID)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	case c.Cluster != "":
+		logger.Warn("Cluster is only used with bootstrap, ignoring it", "cluster", c.Cluster)
+	}
 
 	node := &RaftNode{
-		id:    id,
-		peers: clusters,
+		id:       id,
+		addr:     string(transport.LocalAddr()),
+		apiAddr:  c.APIAddr,
+		zone:     c.Zone,
+		peers:    servers,
+		hasState: hasState,
 
 		dataDir:      dataDir,
 		snapshotPath: snapshotPath,
 		raftDBPath:   raftDBPath,
 
-		kvs:  kvs,
-		raft: r,
+		kvs:       kvs,
+		raft:      r,
+		logStore:  logStore,
+		snapshots: snapshot,
+		tlsLayer:  tlsLayer,
+		transport: tracked,
+		metrics:   newNodeMetrics(),
+		meta:      meta,
+		lock:      lock,
+
+		applyTimeout:      int64(c.applyTimeout()),
+		readyMaxLag:       c.readyMaxLag(),
+		slowPeerLag:       c.slowPeerLag(),
+		snapshotInterval:  int64(c.snapshotInterval()),
+		snapshotThreshold: c.snapshotThreshold(),
+		commands:          store.Commands,
+
+		events: newEventBus(),
+		logger: logger,
+		tracer: tracer,
+
+		shutdownCh: make(chan struct{}),
 	}
+	if tlsLayer != nil {
+		tlsLayer.lookupID.Store(node.lookupServerID)
+		tlsLayer.memberIDs.Store(node.serverIDs)
+		tlsLayer.clusterID.Store(node.ClusterID)
+	}
+	restoreLock.Lock()
+	restored = node
+	if startupIndex != nil {
+		node.publish(Event{Type: EventSnapshotRestored, Index: *startupIndex})
+	}
+	restoreLock.Unlock()
+	go node.runSnapshots()
+	go node.runEvents()
+	go node.runClusterID()
+	go node.runLagCheck()
 
 	return node, nil
 }
 
+// 写操作等待提交的超时时间
+func (node *RaftNode) ApplyTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&node.applyTimeout))
+}
+
+// 运行时修改写操作的超时时间
+func (node *RaftNode) SetApplyTimeout(timeout time.Duration) {
+	atomic.StoreInt64(&node.applyTimeout, int64(timeout))
+}
+
 // 获取keyvalue
 func (node *RaftNode) GetKV(key string) string {
 	return node.kvs.Get(key)
 }
 
+// 获取keyvalue，ok表示key是否存在
+func (node *RaftNode) LookupKV(key string) (value string, ok bool) {
+	return node.kvs.Lookup(key)
+}
+
+// 获取[start, end)范围内的keyvalue，end为空表示没有上界
+func (node *RaftNode) ScanKV(start, end string) map[string]string {
+	return node.kvs.Scan(start, end)
+}
+
+// 获取所有keyvalue及其对应的raft index
+func (node *RaftNode) DumpKV() (map[string]string, uint64) {
+	return node.kvs.Dump()
+}
+
+// 状态机最后应用的raft index，与DumpKV返回的index相同
+func (node *RaftNode) KVIndex() uint64 {
+	return node.kvs.AppliedIndex()
+}
+
+// 获取index之后已经应用到状态机的变更，变更已不在缓存中时返回false
+func (node *RaftNode) ChangesSince(index uint64, max int) ([]store.Change, bool) {
+	return node.kvs.ChangesSince(index, max)
+}
+
+// 状态机下一次变更时关闭的channel
+func (node *RaftNode) Changed() <-chan struct{} {
+	return node.kvs.Changed()
+}
+
 // 设置keyvalue
 func (node *RaftNode) SetKV(key, value string) error {
-	if !node.IsLeader() {
-		return errors.New("Not the leader")
-	}
+	return node.SetKVContext(context.Background(), key, value)
+}
 
-	op := &store.Op{
+// 设置keyvalue，ctx中的trace id随命令一起提交
+func (node *RaftNode) SetKVContext(ctx context.Context, key, value string) error {
+	return node.propose(ctx, &store.Op{
 		Method: "SET",
 		Key:    key,
 		Value:  value,
-	}
-
-	cmd, err := json.Marshal(op)
-	if err != nil {
-		return err
-	}
-
-	// Apply is used to issue a command to the FSM in a highly consistent manner.
-	// This returns a future that ca be used to wait on the application.
-	// This must be run on the leader or it will fail.
-	return node.raft.Apply(cmd, 10*time.Second).Error()
+	})
 }
 
 // 删除keyvalue
 func (node *RaftNode) DeleteKV(key string) error {
-	if !node.IsLeader() {
-		return errors.New("Not the leader")
-	}
+	return node.DeleteKVContext(context.Background(), key)
+}
 
-	op := &store.Op{
+// 删除keyvalue，ctx中的trace id随命令一起提交
+func (node *RaftNode) DeleteKVContext(ctx context.Context, key string) error {
+	return node.propose(ctx, &store.Op{
 		Method: "DEL",
 		Key:    key,
+	})
+}
+
+// 删除已迁移到其他raft组的key，key所在范围已冻结时同样删除
+func (node *RaftNode) DeleteMovedKV(key string) error {
+	return node.propose(context.Background(), &store.Op{
+		Method: "DEL",
+		Key:    key,
+		Moving: true,
+	})
+}
+
+// propose commits op through raft, commands some member cannot apply are
+// refused. The trace id of ctx is carried in the command so that every
+// member records when it applies it.
+func (node *RaftNode) propose(ctx context.Context, op *store.Op) error {
+	if !node.IsLeader() {
+		return ErrNotLeader
+	}
+	if err := node.checkCommand(op.Method); err != nil {
+		return err
 	}
 
+	op.TraceID = tracing.IDFromContext(ctx)
 	cmd, err := json.Marshal(op)
 	if err != nil {
 		return err
@@ -160,13 +371,69 @@ func (node *RaftNode) DeleteKV(key string) error {
 	// Apply is used to issue a command to the FSM in a highly consistent manner.
 	// This returns a future that ca be used to wait on the application.
 	// This must be run on the leader or it will fail.
-	return node.raft.Apply(cmd, 10*time.Second).Error()
+	span := node.tracer.Start(op.TraceID, "raft.apply", "op", op.Method)
+	start := time.Now()
+	future := node.raft.Apply(cmd, node.ApplyTimeout())
+	err = future.Error()
+	node.metrics.apply.Observe(time.Since(start).Seconds())
+	if err == nil {
+		if result, ok := future.Response().(*store.ApplyResult); ok {
+			err = result.Err
+			// the leader applies an entry as soon as it is committed, the
+			// time until then is spent replicating it
+			index := strconv.FormatUint(future.Index(), 10)
+			span.Set("index", index)
+			node.tracer.Record(tracing.Span{
+				TraceID:  op.TraceID,
+				Name:     "raft.commit",
+				Start:    start,
+				Duration: result.Start.Sub(start),
+				Attrs:    map[string]string{"index": index},
+			})
+		}
+	}
+	span.End(err)
+	return err
 }
 
 func (node *RaftNode) ID() string {
 	return node.id
 }
 
+// 节点数据目录
+func (node *RaftNode) DataDir() string {
+	return node.dataDir
+}
+
+// 节点的日志，带有node_id字段
+func (node *RaftNode) Logger() *logging.Logger {
+	return node.logger
+}
+
+// 节点的tracer，没有配置时为nil
+func (node *RaftNode) Tracer() *tracing.Tracer {
+	return node.tracer
+}
+
+// 节点对外通告的raft地址
+func (node *RaftNode) Addr() string {
+	return node.addr
+}
+
+// 成员通告的api地址，ok表示地址是否已知。只有主raft组记录各成员的地址
+func (node *RaftNode) APIAddr(id string) (addr string, ok bool) {
+	if id == node.id {
+		return node.apiAddr, node.apiAddr != ""
+	}
+	info, _ := node.recordedInfo(id)
+	return info.APIAddr, info.APIAddr != ""
+}
+
+// 节点启动时是否已有raft状态(已经是集群成员)
+func (node *RaftNode) HasExistingState() bool {
+	return node.hasState
+}
+
 // 判断节点是否是leader
 func (node *RaftNode) IsLeader() bool {
 	return node.raft.State() == raft.Leader
@@ -177,15 +444,142 @@ func (node *RaftNode) Leader() raft.ServerAddress {
 	return node.raft.Leader()
 }
 
-// 增加raft集群节点
-func (node *RaftNode) AddNode(id string) error {
-	return node.raft.AddVoter(raft.ServerID(id), raft.ServerAddress(id), 0, 0).Error()
+// 增加raft集群节点，zone为节点所在区域，force跳过区域分布检查
+func (node *RaftNode) AddNode(id, addr, zone string, force bool) error {
+	if id == "" || addr == "" {
+		return errors.New("node id and address should not be empty")
+	}
+	if !node.IsLeader() {
+		return ErrNotLeader
+	}
+	if !force {
+		current, err := node.voterZones()
+		if err != nil {
+			return err
+		}
+		next := make(map[raft.ServerID]string, len(current)+1)
+		for k, v := range current {
+			next[k] = v
+		}
+		if zone == "" {
+			zone = current[raft.ServerID(id)]
+		}
+		next[raft.ServerID(id)] = zone
+		if err := checkPlacement(current, next); err != nil {
+			return err
+		}
+	}
+	if err := node.raft.AddVoter(raft.ServerID(id), raft.ServerAddress(addr), 0, 0).Error(); err != nil {
+		return err
+	}
+	if zone != "" {
+		if err := node.recordZone(id, zone); err != nil {
+			node.logger.Error("Failed to record zone", "peer", id, "err", err)
+		}
+	}
+	return nil
 }
 
-// 移除raft集群节点
-func (node *RaftNode) RemoveNode(id string) error {
+// 移除raft集群节点，force跳过区域分布检查
+func (node *RaftNode) RemoveNode(id string, force bool) error {
 	if !node.IsLeader() {
-		return errors.New("Not the leader")
+		return ErrNotLeader
+	}
+	if !force {
+		current, err := node.voterZones()
+		if err != nil {
+			return err
+		}
+		next := make(map[raft.ServerID]string, len(current))
+		for k, v := range current {
+			if k != raft.ServerID(id) {
+				next[k] = v
+			}
+		}
+		if err := checkPlacement(current, next); err != nil {
+			return err
+		}
+	}
+	if err := node.raft.RemoveServer(raft.ServerID(id), 0, 0).Error(); err != nil {
+		return err
+	}
+	// the zone and api address stay recorded as long as the member is one. A
+	// leader removing itself has stepped down by now and keeps the record,
+	// which is only read for members and replaced if the id joins again.
+	if err := node.forgetInfo(raft.ServerID(id)); err != nil {
+		node.logger.Error("Failed to forget node info", "peer", id, "err", err)
 	}
-	return node.raft.RemoveServer(raft.ServerID(id), 0, 0).Error()
+	return nil
+}
+
+// Member is a server of the raft configuration
+type Member struct {
+	ID       string `json:"id"`
+	Address  string `json:"address"`
+	Suffrage string `json:"suffrage"`
+	// Zone is the recorded failure zone of the member, empty when it has none
+	Zone   string `json:"zone,omitempty"`
+	Leader bool   `json:"leader"`
+}
+
+// 查看raft集群的节点，按id排序
+func (node *RaftNode) Members() ([]Member, error) {
+	future := node.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return nil, err
+	}
+	leader := node.Leader()
+	members := []Member{}
+	for _, server := range future.Configuration().Servers {
+		member := Member{
+			ID:       string(server.ID),
+			Address:  string(server.Address),
+			Suffrage: server.Suffrage.String(),
+			Leader:   server.Address == leader,
+		}
+		if member.ID == node.id {
+			member.Zone = node.zone
+		} else {
+			info, _ := node.recordedInfo(member.ID)
+			member.Zone = info.Zone
+		}
+		members = append(members, member)
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].ID < members[j].ID })
+	return members, nil
+}
+
+func containsServer(servers []raft.Server, id raft.ServerID) bool {
+	for _, server := range servers {
+		if server.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// 将本节点移出集群，只能在leader上执行，其他节点需要通过leader移除。
+// 节点无论如何都会停止，所以不检查区域分布
+func (node *RaftNode) Leave() error {
+	return node.RemoveNode(node.id, true)
+}
+
+// 关闭节点：生成最后一次快照，停止raft，关闭transport和日志存储
+func (node *RaftNode) Close() error {
+	node.closeOnce.Do(func() {
+		close(node.shutdownCh)
+		if err := node.snapshot(); err != nil && err != raft.ErrNothingNewToSnapshot {
+			node.logger.Error("Failed to take final snapshot", "err", err)
+		}
+		// Shutdown also closes the transport
+		if err := node.raft.Shutdown().Error(); err != nil {
+			node.closeErr = fmt.Errorf("Failed to shutdown raft : (%v)", err)
+			return
+		}
+		if err := node.logStore.close(); err != nil {
+			node.closeErr = fmt.Errorf("Failed to close log store (%s): (%v)", node.raftDBPath, err)
+		}
+		node.lock.Close()
+	})
+	return node.closeErr
 }
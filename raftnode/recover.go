@@ -0,0 +1,94 @@
+package raftnode
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/forjoin92/depot/store"
+	"github.com/hashicorp/raft"
+)
+
+// RecoverWarning explains the risk of an offline recovery
+const RecoverWarning = `WARNING: recovering a cluster from a lost quorum is unsafe.
+The raft configuration stored in the data directory will be replaced by the
+given peers, so log entries that were still being replicated when quorum was
+lost may be committed, and entries committed by the lost majority but not
+replicated here are gone for good. Run the recovery with the same peers file on
+every surviving node while all of them are stopped, then start them without
+-bootstrap. Do not restart any node that is not in the new peer list.`
+
+// ReadPeersFile reads a peers.json file. The new format is a list of
+// {"id": ..., "address": ..., "non_voter": ...} objects, the legacy format is a
+// list of addresses which are also used as ids.
+func ReadPeersFile(path string) (raft.Configuration, error) {
+	configuration, err := raft.ReadConfigJSON(path)
+	if err == nil {
+		return configuration, nil
+	}
+	legacy, lerr := raft.ReadPeersJSON(path)
+	if lerr != nil {
+		return raft.Configuration{}, fmt.Errorf("Failed to read peers file (%s): (%v)", path, err)
+	}
+	return legacy, nil
+}
+
+// Recover rewrites the raft configuration stored in the node's data directory
+// to the given peers so the node can start as part of a new cluster with its
+// existing data. The node must not be running.
+func Recover(c *Config, configuration raft.Configuration) error {
+	dataDir, snapshotPath, raftDBPath := c.paths()
+
+	if c.logStore() == LogStoreMemory {
+		return fmt.Errorf("the %s log store keeps no state to recover", LogStoreMemory)
+	}
+
+	if _, err := os.Stat(dataDir); err != nil {
+		return fmt.Errorf("no raft state to recover in (%s): (%v)", dataDir, err)
+	}
+	lock, err := lockDataDir(dataDir)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	meta, err := loadMeta(dataDir, c.ID)
+	if err != nil {
+		return err
+	}
+	id := meta.get().NodeID
+	logger := c.logger().With("node_id", id)
+	if !containsServer(configuration.Servers, raft.ServerID(id)) {
+		return fmt.Errorf("peers do not contain local node id (%s)", id)
+	}
+
+	snapshot, err := raft.NewFileSnapshotStore(snapshotPath, c.snapshotRetain(), logger.Writer())
+	if err != nil {
+		return fmt.Errorf("Failed to create file snapshot store (%s): (%v)", snapshotPath, err)
+	}
+
+	logStore, err := openLogStorage(c, raftDBPath)
+	if err != nil {
+		return err
+	}
+	defer logStore.close()
+
+	hasState, err := raft.HasExistingState(logStore.logs, logStore.stable, snapshot)
+	if err != nil {
+		return fmt.Errorf("Failed to check existing raft state (%s): (%v)", raftDBPath, err)
+	}
+	if !hasState {
+		return fmt.Errorf("no raft state to recover in (%s)", raftDBPath)
+	}
+
+	// the transport is only used to encode peers, nothing is sent
+	_, transport := raft.NewInmemTransport(raft.ServerAddress(c.BindAddr))
+	defer transport.Close()
+
+	fsm := store.NewKVStore()
+	fsm.SetLogger(logger)
+	// RecoverCluster leaves the fsm in an unusable state, it is discarded afterwards
+	if err := raft.RecoverCluster(c.raftConfig(id, logger), fsm, logStore.logs, logStore.stable, snapshot, transport, configuration); err != nil {
+		return fmt.Errorf("Failed to recover cluster : (%v)", err)
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package raftnode
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadPeersFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "depot-peers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "peers.json")
+	ioutil.WriteFile(path, []byte(`[{"id": "n1", "address": "127.0.0.1:30401"}, {"id": "n2", "address": "127.0.0.1:30402", "non_voter": true}]`), 0600)
+	configuration, err := ReadPeersFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(configuration.Servers) != 2 || configuration.Servers[1].ID != "n2" {
+		t.Fatalf("bad configuration: %+v", configuration)
+	}
+
+	ioutil.WriteFile(path, []byte(`["127.0.0.1:30401", "127.0.0.1:30402"]`), 0600)
+	configuration, err = ReadPeersFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(configuration.Servers) != 2 || configuration.Servers[0].ID != "127.0.0.1:30401" {
+		t.Fatalf("bad legacy configuration: %+v", configuration)
+	}
+}
@@ -0,0 +1,184 @@
+package raftnode
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/forjoin92/depot/logging"
+	"github.com/forjoin92/depot/store"
+	"github.com/hashicorp/raft"
+)
+
+// 快照策略：每隔interval检查一次，新增日志数达到threshold时生成快照
+func (node *RaftNode) SnapshotPolicy() (time.Duration, uint64) {
+	return time.Duration(atomic.LoadInt64(&node.snapshotInterval)), atomic.LoadUint64(&node.snapshotThreshold)
+}
+
+// 运行时修改快照策略，下一次检查时生效，interval不为正时使用默认值
+func (node *RaftNode) SetSnapshotPolicy(interval time.Duration, threshold uint64) {
+	if interval <= 0 {
+		interval = (&Config{}).snapshotInterval()
+	}
+	atomic.StoreInt64(&node.snapshotInterval, int64(interval))
+	atomic.StoreUint64(&node.snapshotThreshold, threshold)
+}
+
+// runSnapshots replaces raft's own snapshot loop so that the interval and
+// threshold can be reloaded without restarting raft
+func (node *RaftNode) runSnapshots() {
+	for {
+		interval, threshold := node.SnapshotPolicy()
+		// jitter like raft does so that nodes don't snapshot at the same time
+		timeout := interval + time.Duration(rand.Int63())%interval
+		select {
+		case <-time.After(timeout):
+		case <-node.shutdownCh:
+			return
+		}
+
+		if node.logsSinceSnapshot() < threshold {
+			continue
+		}
+		if err := node.snapshot(); err != nil && err != raft.ErrNothingNewToSnapshot {
+			node.logger.Error("Failed to take snapshot", "err", err)
+		}
+	}
+}
+
+// snapshot takes a snapshot and publishes it as an event
+func (node *RaftNode) snapshot() error {
+	start := time.Now()
+	if err := node.raft.Snapshot().Error(); err != nil {
+		return err
+	}
+	node.metrics.snapshot.Observe(time.Since(start).Seconds())
+	index, _ := strconv.ParseUint(node.raft.Stats()["last_snapshot_index"], 10, 64)
+	node.publish(Event{Type: EventSnapshotTaken, Index: index})
+	return nil
+}
+
+// logsSinceSnapshot returns the number of log entries after the last snapshot
+func (node *RaftNode) logsSinceSnapshot() uint64 {
+	lastSnapshot, err := strconv.ParseUint(node.raft.Stats()["last_snapshot_index"], 10, 64)
+	if err != nil {
+		return 0
+	}
+	lastIndex := node.raft.LastIndex()
+	if lastIndex < lastSnapshot {
+		return 0
+	}
+	return lastIndex - lastSnapshot
+}
+
+// restoreTimeout bounds a restore from a backup, which has to reach the followers
+const restoreTimeout = 5 * time.Minute
+
+// SnapshotInfo describes a snapshot stored on this node
+type SnapshotInfo struct {
+	ID    string `json:"id"`
+	Index uint64 `json:"index"`
+	Term  uint64 `json:"term"`
+	Size  int64  `json:"size"`
+}
+
+// 立即生成快照，返回新快照的信息
+func (node *RaftNode) TakeSnapshot() (SnapshotInfo, error) {
+	if err := node.snapshot(); err != nil {
+		return SnapshotInfo{}, err
+	}
+	snapshots, err := node.Snapshots()
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	if len(snapshots) == 0 {
+		return SnapshotInfo{}, errors.New("snapshot was taken but is not stored")
+	}
+	return snapshots[0], nil
+}
+
+// 本节点保存的快照，最新的在前
+func (node *RaftNode) Snapshots() ([]SnapshotInfo, error) {
+	metas, err := node.snapshots.List()
+	if err != nil {
+		return nil, err
+	}
+	snapshots := make([]SnapshotInfo, 0, len(metas))
+	for _, meta := range metas {
+		snapshots = append(snapshots, SnapshotInfo{
+			ID:    meta.ID,
+			Index: meta.Index,
+			Term:  meta.Term,
+			Size:  meta.Size,
+		})
+	}
+	return snapshots, nil
+}
+
+// OpenSnapshot opens a stored snapshot, its data is a backup RestoreSnapshot accepts
+func (node *RaftNode) OpenSnapshot(id string) (SnapshotInfo, io.ReadCloser, error) {
+	meta, rc, err := node.snapshots.Open(id)
+	if err != nil {
+		return SnapshotInfo{}, nil, err
+	}
+	return SnapshotInfo{ID: meta.ID, Index: meta.Index, Term: meta.Term, Size: meta.Size}, rc, nil
+}
+
+// RestoreSnapshot replaces the state of the whole cluster with a backup, only
+// on the leader. Writes in flight are aborted. The backup is decoded first
+// because raft cannot recover from a snapshot the store fails to restore, it
+// is kept in a file meanwhile rather than in memory.
+func (node *RaftNode) RestoreSnapshot(backup io.Reader) error {
+	if !node.IsLeader() {
+		return ErrNotLeader
+	}
+	f, err := ioutil.TempFile(node.dataDir, "restore-")
+	if err != nil {
+		return fmt.Errorf("Failed to create backup file (%s): (%v)", node.dataDir, err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	size, err := io.Copy(f, backup)
+	if err != nil {
+		return fmt.Errorf("Failed to read backup : (%w)", err)
+	}
+
+	check := store.NewKVStore()
+	check.SetLogger(logging.Discard())
+	if err := check.Restore(ioutil.NopCloser(io.NewSectionReader(f, 0, size))); err != nil {
+		return fmt.Errorf("invalid backup: %v", err)
+	}
+
+	// the backup may come from another cluster, the cluster id and member
+	// records stay those of this cluster
+	internal := node.kvs.Select(IsInternalKey)
+	if internal[clusterIDKey] == "" && node.ClusterID() != "" {
+		internal[clusterIDKey] = node.ClusterID()
+	}
+	check.ReplaceKeys(IsInternalKey, internal)
+	if err := f.Truncate(0); err != nil {
+		return fmt.Errorf("Failed to write backup file (%s): (%v)", f.Name(), err)
+	}
+	if err := check.WriteSnapshot(io.NewOffsetWriter(f, 0)); err != nil {
+		return fmt.Errorf("Failed to write backup file (%s): (%v)", f.Name(), err)
+	}
+	if size, err = f.Seek(0, io.SeekEnd); err != nil {
+		return fmt.Errorf("Failed to write backup file (%s): (%v)", f.Name(), err)
+	}
+
+	meta := &raft.SnapshotMeta{
+		Version: raft.SnapshotVersionMax,
+		Size:    size,
+	}
+	if err := node.raft.Restore(meta, io.NewSectionReader(f, 0, size), restoreTimeout); err != nil {
+		return fmt.Errorf("Failed to restore backup : (%v)", err)
+	}
+	node.logger.Info("Restored backup", "bytes", size)
+	return nil
+}
@@ -0,0 +1,117 @@
+package raftnode
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/forjoin92/depot/store"
+)
+
+func TestSnapshotBackupRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "depot-snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	node := newTestNode(t, dir)
+	defer node.Close()
+	deadline := time.Now().Add(10 * time.Second)
+	for !node.IsLeader() {
+		if time.Now().After(deadline) {
+			t.Fatal("node did not become leader")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := node.SetKV("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := node.TakeSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshots, err := node.Snapshots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) == 0 || snapshots[0] != snapshot || snapshot.Size == 0 {
+		t.Fatalf("unexpected snapshots %+v, took %+v", snapshots, snapshot)
+	}
+
+	_, rc, err := node.OpenSnapshot(snapshot.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backup, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := node.SetKV("a", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := node.SetKV("b", "3"); err != nil {
+		t.Fatal(err)
+	}
+	_, before := node.DumpKV()
+
+	if err := node.RestoreSnapshot(strings.NewReader("not a backup")); err == nil {
+		t.Fatal("expected invalid backup to be refused")
+	}
+	if err := node.RestoreSnapshot(bytes.NewReader(backup)); err != nil {
+		t.Fatal(err)
+	}
+	kvs, after := node.DumpKV()
+	if kvs["a"] != "1" || kvs["b"] != "" {
+		t.Fatalf("unexpected state after restore %v", kvs)
+	}
+	// readers of the change feed must notice the state was replaced
+	if after <= before {
+		t.Fatalf("applied index went from %d to %d", before, after)
+	}
+	if _, ok := node.ChangesSince(before, 0); ok {
+		t.Fatal("expected changes before the restore to be unavailable")
+	}
+
+	// a backup taken in another cluster must not carry its identity over
+	id := node.ClusterID()
+	other := store.NewKVStore()
+	other.ReplaceKeys(IsInternalKey, map[string]string{clusterIDKey: "other"})
+	var foreign bytes.Buffer
+	if err := other.WriteSnapshot(&foreign); err != nil {
+		t.Fatal(err)
+	}
+	if err := node.RestoreSnapshot(&foreign); err != nil {
+		t.Fatal(err)
+	}
+	if got := node.GetKV(clusterIDKey); id == "" || got != id {
+		t.Fatalf("cluster id went from %q to %q after restore", id, got)
+	}
+}
+
+func TestSetSnapshotPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "depot-snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	node := newTestNode(t, dir)
+	defer node.Close()
+
+	// a zero interval would make the snapshot loop divide by zero
+	node.SetSnapshotPolicy(0, 10)
+	if interval, threshold := node.SnapshotPolicy(); interval != 120*time.Second || threshold != 10 {
+		t.Fatalf("got policy %s/%d, want the default interval", interval, threshold)
+	}
+	node.SetSnapshotPolicy(-time.Second, 10)
+	if interval, _ := node.SnapshotPolicy(); interval != 120*time.Second {
+		t.Fatalf("got interval %s for a negative one, want the default", interval)
+	}
+}
@@ -0,0 +1,230 @@
+package raftnode
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/forjoin92/depot/tlsutil"
+	"github.com/hashicorp/raft"
+)
+
+// tlsStreamLayer is a raft stream layer over mutually authenticated TLS.
+// Peers are usually addressed by IP, so instead of the host name the dialer
+// checks the certificate chain and, when verifyID is set, that the peer
+// certificate names the server ID registered for the address. With verifyID
+// the listener in turn requires the client certificate to name a member of
+// the raft configuration.
+type tlsStreamLayer struct {
+	stream   *streamLayer
+	listener net.Listener
+	keyPair  *tlsutil.KeyPair
+	roots    *x509.CertPool
+	verifyID bool
+	// lookupID holds a func(raft.ServerAddress) (raft.ServerID, bool) mapping a
+	// peer address to its server id, it is set once raft is running
+	lookupID atomic.Value
+	// memberIDs holds a func() []raft.ServerID returning the ids in the raft
+	// configuration, it is set once raft is running
+	memberIDs atomic.Value
+	// clusterID holds a func() string returning the local cluster id, it is
+	// offered as ALPN protocol and peers of another cluster are refused
+	clusterID atomic.Value
+}
+
+// clusterProtoPrefix prefixes the cluster id offered as ALPN protocol. Peers
+// that offer none, e.g. older builds or nodes that never joined, pass.
+const clusterProtoPrefix = "depot-cluster/"
+
+func newTLSStreamLayer(c *Config, stream *streamLayer) (*tlsStreamLayer, error) {
+	keyPair, err := tlsutil.LoadKeyPair(c.TLSCertFile, c.TLSKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	roots, err := tlsutil.LoadCAPool(c.TLSCAFile)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &tlsStreamLayer{
+		stream:   stream,
+		keyPair:  keyPair,
+		roots:    roots,
+		verifyID: c.TLSVerifyServerID,
+	}
+	config := &tls.Config{
+		GetCertificate: keyPair.GetCertificate,
+		ClientCAs:      roots,
+		ClientAuth:     tls.RequireAndVerifyClientCert,
+		MinVersion:     tls.VersionTLS12,
+		VerifyPeerCertificate: func(_ [][]byte, chains [][]*x509.Certificate) error {
+			return l.verifyClient(chains[0][0])
+		},
+	}
+	config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		ours := l.localClusterID()
+		if theirs := offeredClusterID(hello.SupportedProtos); theirs != "" && ours != "" && theirs != ours {
+			return nil, fmt.Errorf("%w (peer %s is in cluster %s, this cluster is %s)", ErrClusterIDMismatch, hello.Conn.RemoteAddr(), theirs, ours)
+		}
+		if ours == "" {
+			return nil, nil
+		}
+		perConn := config.Clone()
+		perConn.GetConfigForClient = nil
+		perConn.NextProtos = []string{clusterProtoPrefix + ours}
+		return perConn, nil
+	}
+	l.listener = tls.NewListener(stream.listener, config)
+	return l, nil
+}
+
+// localClusterID returns the cluster id of the node, empty until it is known
+func (l *tlsStreamLayer) localClusterID() string {
+	clusterID, _ := l.clusterID.Load().(func() string)
+	if clusterID == nil {
+		return ""
+	}
+	return clusterID()
+}
+
+// offeredClusterID returns the cluster id among the ALPN protocols of a peer
+func offeredClusterID(protos []string) string {
+	for _, proto := range protos {
+		if strings.HasPrefix(proto, clusterProtoPrefix) {
+			return strings.TrimPrefix(proto, clusterProtoPrefix)
+		}
+	}
+	return ""
+}
+
+func (l *tlsStreamLayer) Dial(address raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
+	config := &tls.Config{
+		GetClientCertificate: l.keyPair.GetClientCertificate,
+		// the chain and server id are verified below
+		InsecureSkipVerify: true,
+		MinVersion:         tls.VersionTLS12,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return l.verifyServer(address, rawCerts)
+		},
+	}
+	ours := l.localClusterID()
+	if ours != "" {
+		config.NextProtos = []string{clusterProtoPrefix + ours}
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			if theirs := offeredClusterID([]string{state.NegotiatedProtocol}); theirs != "" && theirs != ours {
+				return fmt.Errorf("%w (peer %s is in cluster %s, this cluster is %s)", ErrClusterIDMismatch, address, theirs, ours)
+			}
+			return nil
+		}
+	}
+	conn, err := l.stream.Dial(address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Client(conn, config)
+	tlsConn.SetDeadline(time.Now().Add(timeout))
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+func (l *tlsStreamLayer) verifyServer(address raft.ServerAddress, rawCerts [][]byte) error {
+	cert, err := tlsutil.VerifyChain(rawCerts, l.roots, x509.ExtKeyUsageServerAuth)
+	if err != nil {
+		return fmt.Errorf("peer %s: %v", address, err)
+	}
+	if !l.verifyID {
+		return nil
+	}
+	lookup, _ := l.lookupID.Load().(func(raft.ServerAddress) (raft.ServerID, bool))
+	if lookup == nil {
+		return fmt.Errorf("peer %s: server ids are not known yet", address)
+	}
+	id, ok := lookup(address)
+	if !ok {
+		return fmt.Errorf("peer %s is not in the raft configuration", address)
+	}
+	if !tlsutil.HasName(cert, string(id)) {
+		return fmt.Errorf("peer %s certificate does not match server id %s", address, id)
+	}
+	return nil
+}
+
+// verifyClient checks that the certificate of a connecting peer names a
+// member, the chain is verified by the TLS listener
+func (l *tlsStreamLayer) verifyClient(cert *x509.Certificate) error {
+	if !l.verifyID {
+		return nil
+	}
+	memberIDs, _ := l.memberIDs.Load().(func() []raft.ServerID)
+	if memberIDs == nil {
+		return fmt.Errorf("peer %s: server ids are not known yet", cert.Subject.CommonName)
+	}
+	ids := memberIDs()
+	// a node which has not joined yet learns the configuration from the
+	// leader, which it cannot tell apart before
+	if len(ids) == 0 {
+		return nil
+	}
+	for _, id := range ids {
+		if tlsutil.HasName(cert, string(id)) {
+			return nil
+		}
+	}
+	return fmt.Errorf("peer certificate %s does not name a member of the raft configuration", cert.Subject.CommonName)
+}
+
+func (l *tlsStreamLayer) Accept() (net.Conn, error) {
+	return l.listener.Accept()
+}
+
+func (l *tlsStreamLayer) Close() error {
+	return l.listener.Close()
+}
+
+func (l *tlsStreamLayer) Addr() net.Addr {
+	return l.stream.Addr()
+}
+
+// 重新加载raft传输层证书
+func (node *RaftNode) ReloadTLS() error {
+	if node.tlsLayer == nil {
+		return nil
+	}
+	return node.tlsLayer.keyPair.Reload()
+}
+
+// serverIDs returns the ids in the raft configuration, none when it is not
+// known
+func (node *RaftNode) serverIDs() []raft.ServerID {
+	future := node.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return nil
+	}
+	var ids []raft.ServerID
+	for _, server := range future.Configuration().Servers {
+		ids = append(ids, server.ID)
+	}
+	return ids
+}
+
+// lookupServerID finds the id of the server with the given address
+func (node *RaftNode) lookupServerID(address raft.ServerAddress) (raft.ServerID, bool) {
+	future := node.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return "", false
+	}
+	for _, server := range future.Configuration().Servers {
+		if server.Address == address {
+			return server.ID, true
+		}
+	}
+	return "", false
+}
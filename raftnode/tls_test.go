@@ -0,0 +1,250 @@
+package raftnode
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	file string
+}
+
+func writePEM(t *testing.T, path, typ string, der []byte) {
+	data := pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der})
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTestCA(t *testing.T, dir, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, name+".pem")
+	writePEM(t, file, "CERTIFICATE", der)
+	return &testCA{cert: cert, key: key, file: file}
+}
+
+// issue writes a peer certificate for id and returns a config using it
+func (ca *testCA) issue(t *testing.T, dir, id string) *Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: id},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Config{
+		ID:                id,
+		BindAddr:          "127.0.0.1:0",
+		TLSCertFile:       filepath.Join(dir, id+".crt"),
+		TLSKeyFile:        filepath.Join(dir, id+".key"),
+		TLSCAFile:         ca.file,
+		TLSVerifyServerID: true,
+	}
+	writePEM(t, c.TLSCertFile, "CERTIFICATE", der)
+	writePEM(t, c.TLSKeyFile, "EC PRIVATE KEY", keyDER)
+	return c
+}
+
+func newTestLayer(t *testing.T, c *Config) *tlsStreamLayer {
+	base, err := net.Listen("tcp", c.BindAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := newTLSStreamLayer(c, &streamLayer{listener: base, advertise: base.Addr()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// complete the server side of every handshake
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn.(*tls.Conn).Handshake()
+				conn.Close()
+			}()
+		}
+	}()
+	return l
+}
+
+func dialLayer(from, to *tlsStreamLayer) error {
+	conn, err := from.Dial(raft.ServerAddress(to.Addr().String()), time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.(*tls.Conn).Handshake(); err != nil {
+		return err
+	}
+	// the server reports a rejected client certificate on the first read
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return nil
+	}
+	if err != nil && err.Error() == "EOF" {
+		return nil
+	}
+	return err
+}
+
+func TestTLSStreamLayer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "depot-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t, dir, "ca")
+	node1 := newTestLayer(t, ca.issue(t, dir, "node1"))
+	defer node1.Close()
+	node2 := newTestLayer(t, ca.issue(t, dir, "node2"))
+	defer node2.Close()
+
+	ids := map[raft.ServerAddress]raft.ServerID{
+		raft.ServerAddress(node1.Addr().String()): "node1",
+	}
+	node2.lookupID.Store(func(addr raft.ServerAddress) (raft.ServerID, bool) {
+		id, ok := ids[addr]
+		return id, ok
+	})
+	// node1 does not know yet who may connect
+	if err := dialLayer(node2, node1); err == nil {
+		t.Fatal("expected accept without server ids to fail")
+	}
+	members := []raft.ServerID{"node1", "node2"}
+	node1.memberIDs.Store(func() []raft.ServerID { return members })
+
+	if err := dialLayer(node2, node1); err != nil {
+		t.Fatalf("dial with matching server id: %v", err)
+	}
+
+	// the server checks the client as well, node2 is no longer a member
+	members = []raft.ServerID{"node1", "node3"}
+	if err := dialLayer(node2, node1); err == nil {
+		t.Fatal("expected a client which is not a member to be rejected")
+	}
+	// a node which has not joined accepts the leader of the cluster
+	members = nil
+	if err := dialLayer(node2, node1); err != nil {
+		t.Fatalf("dial to a node without configuration: %v", err)
+	}
+	members = []raft.ServerID{"node1", "node2"}
+
+	// a certificate for another id at the address is rejected
+	ids[raft.ServerAddress(node1.Addr().String())] = "node3"
+	if err := dialLayer(node2, node1); err == nil {
+		t.Fatal("expected server id mismatch to fail")
+	}
+
+	// server ids are unknown until raft is running
+	if err := dialLayer(node1, node2); err == nil {
+		t.Fatal("expected dial without server ids to fail")
+	}
+
+	// a peer signed by another CA cannot connect
+	other := newTestCA(t, dir, "other")
+	c := other.issue(t, dir, "intruder")
+	c.TLSCAFile = ca.file
+	c.TLSVerifyServerID = false
+	intruder := newTestLayer(t, c)
+	defer intruder.Close()
+	if err := dialLayer(intruder, node1); err == nil {
+		t.Fatal("expected certificate from unknown CA to be rejected")
+	}
+}
+
+func TestTLSStreamLayerClusterID(t *testing.T) {
+	dir, err := ioutil.TempDir("", "depot-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t, dir, "ca")
+	issue := func(id string) *Config {
+		c := ca.issue(t, dir, id)
+		c.TLSVerifyServerID = false
+		return c
+	}
+	node1 := newTestLayer(t, issue("node1"))
+	defer node1.Close()
+	node2 := newTestLayer(t, issue("node2"))
+	defer node2.Close()
+
+	// the id is unknown before the first leader replicates it
+	if err := dialLayer(node2, node1); err != nil {
+		t.Fatalf("dial without cluster ids: %v", err)
+	}
+
+	clusterIDs := map[*tlsStreamLayer]string{node1: "a", node2: "a"}
+	for _, l := range []*tlsStreamLayer{node1, node2} {
+		l := l
+		l.clusterID.Store(func() string { return clusterIDs[l] })
+	}
+	if err := dialLayer(node2, node1); err != nil {
+		t.Fatalf("dial within the cluster: %v", err)
+	}
+
+	// a node of another cluster holding a certificate of the same CA is
+	// refused, whichever side dials
+	clusterIDs[node2] = "b"
+	if err := dialLayer(node2, node1); err == nil {
+		t.Fatal("expected dial to a node of another cluster to fail")
+	}
+	if err := dialLayer(node1, node2); err == nil {
+		t.Fatal("expected dial from a node of another cluster to fail")
+	}
+}
@@ -0,0 +1,75 @@
+package raftnode
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/forjoin92/depot/tracing"
+)
+
+func TestTracedWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "depot-tracing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	ring := tracing.NewRing(64)
+	node, err := NewRaftNode(&Config{
+		ID:                 "node1",
+		BindAddr:           addr,
+		Bootstrap:          true,
+		DataDir:            dir,
+		HeartbeatTimeout:   50 * time.Millisecond,
+		ElectionTimeout:    50 * time.Millisecond,
+		LeaderLeaseTimeout: 50 * time.Millisecond,
+		CommitTimeout:      5 * time.Millisecond,
+		Tracer:             tracing.New(ring),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer node.Close()
+	waitLeader(t, node)
+
+	// writes without a trace id are not recorded
+	if err := node.SetKV("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := node.SetKVContext(tracing.NewContext(context.Background(), "req1"), "b", "2"); err != nil {
+		t.Fatal(err)
+	}
+
+	traces := ring.Traces("")
+	if len(traces) != 1 || traces[0].ID != "req1" {
+		t.Fatalf("expected one trace req1, got %+v", traces)
+	}
+	spans := make(map[string]tracing.Span)
+	for _, span := range traces[0].Spans {
+		spans[span.Name] = span
+	}
+	for _, name := range []string{"raft.apply", "raft.commit", "fsm.apply"} {
+		span, ok := spans[name]
+		if !ok {
+			t.Fatalf("missing span %s in %+v", name, traces[0].Spans)
+		}
+		if span.Attrs["node"] != "node1" || span.Attrs["index"] == "" {
+			t.Fatalf("unexpected attributes of %s: %v", name, span.Attrs)
+		}
+	}
+	apply, commit, fsm := spans["raft.apply"], spans["raft.commit"], spans["fsm.apply"]
+	if commit.Duration > apply.Duration || fsm.Start.Before(apply.Start) || fsm.Attrs["index"] != apply.Attrs["index"] {
+		t.Fatalf("inconsistent spans %+v", traces[0].Spans)
+	}
+}
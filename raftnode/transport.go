@@ -0,0 +1,76 @@
+package raftnode
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/forjoin92/depot/logging"
+	"github.com/forjoin92/depot/mux"
+	"github.com/hashicorp/raft"
+)
+
+// newTransport creates the raft transport. Raft listens on BindAddr unless
+// the port is shared through c.Mux, and runs over TLS when configured.
+func newTransport(c *Config, advertise *net.TCPAddr, logger *logging.Logger) (*raft.NetworkTransport, *tlsStreamLayer, error) {
+	if c.Mux == nil && !c.TLSEnabled() {
+		transport, err := raft.NewTCPTransport(c.BindAddr, advertise, c.transportMaxPool(), c.transportTimeout(), logger.Writer())
+		if err != nil {
+			return nil, nil, fmt.Errorf("Failed to create TCP transport (%s): (%v)", c.BindAddr, err)
+		}
+		return transport, nil, nil
+	}
+
+	if advertise.IP == nil || advertise.IP.IsUnspecified() {
+		return nil, nil, errors.New("local bind address is not advertisable")
+	}
+	stream := &streamLayer{advertise: advertise}
+	if c.Mux != nil {
+		stream.listener = c.Mux.Handle(mux.HeaderRaft, true)
+		stream.mux = true
+	} else {
+		listener, err := net.Listen("tcp", c.BindAddr)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Failed to listen (%s): (%v)", c.BindAddr, err)
+		}
+		stream.listener = listener
+	}
+
+	if !c.TLSEnabled() {
+		return raft.NewNetworkTransport(stream, c.transportMaxPool(), c.transportTimeout(), logger.Writer()), nil, nil
+	}
+	tlsLayer, err := newTLSStreamLayer(c, stream)
+	if err != nil {
+		stream.Close()
+		return nil, nil, fmt.Errorf("Failed to create TLS transport (%s): (%v)", c.BindAddr, err)
+	}
+	return raft.NewNetworkTransport(tlsLayer, c.transportMaxPool(), c.transportTimeout(), logger.Writer()), tlsLayer, nil
+}
+
+// streamLayer is a plain TCP raft stream layer, on a shared port every
+// connection starts with the raft header
+type streamLayer struct {
+	listener  net.Listener
+	advertise net.Addr
+	mux       bool
+}
+
+func (l *streamLayer) Dial(address raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
+	if l.mux {
+		return mux.Dial(string(address), mux.HeaderRaft, timeout)
+	}
+	return net.DialTimeout("tcp", string(address), timeout)
+}
+
+func (l *streamLayer) Accept() (net.Conn, error) {
+	return l.listener.Accept()
+}
+
+func (l *streamLayer) Close() error {
+	return l.listener.Close()
+}
+
+func (l *streamLayer) Addr() net.Addr {
+	return l.advertise
+}
@@ -0,0 +1,125 @@
+package raftnode
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/forjoin92/depot/store"
+	"github.com/hashicorp/raft"
+)
+
+// PlacementError is returned for membership changes that would let the loss
+// of one zone take quorum with it
+type PlacementError struct {
+	Zone   string
+	Count  int
+	Voters int
+}
+
+func (e *PlacementError) Error() string {
+	return fmt.Sprintf("change would put %d of %d voters in zone %s, a majority; use force to override", e.Count, e.Voters, e.Zone)
+}
+
+// ZonePlacement shows how the voters are spread across zones
+type ZonePlacement struct {
+	Voters int `json:"voters"`
+	// Zones lists the voters of every zone, voters without a zone are left out
+	Zones map[string][]string `json:"zones"`
+	// MajorityZone holds a majority of the voters, empty when no zone does
+	MajorityZone string `json:"majority_zone,omitempty"`
+}
+
+// 查看投票节点在各个区域的分布
+func (node *RaftNode) Placement() (ZonePlacement, error) {
+	voters, err := node.voterZones()
+	if err != nil {
+		return ZonePlacement{}, err
+	}
+	placement := ZonePlacement{Voters: len(voters), Zones: make(map[string][]string)}
+	for id, zone := range voters {
+		if zone != "" {
+			placement.Zones[zone] = append(placement.Zones[zone], string(id))
+		}
+	}
+	for _, ids := range placement.Zones {
+		sort.Strings(ids)
+	}
+	placement.MajorityZone, _ = majorityZone(voters)
+	return placement, nil
+}
+
+// voterZones maps the voters of the current configuration to their recorded zone
+func (node *RaftNode) voterZones() (map[raft.ServerID]string, error) {
+	future := node.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return nil, err
+	}
+	voters := make(map[raft.ServerID]string)
+	for _, server := range future.Configuration().Servers {
+		if server.Suffrage != raft.Voter {
+			continue
+		}
+		// this node may not have reported its info yet
+		if string(server.ID) == node.id {
+			voters[server.ID] = node.zone
+			continue
+		}
+		info, _ := node.recordedInfo(string(server.ID))
+		voters[server.ID] = info.Zone
+	}
+	return voters, nil
+}
+
+// checkPlacement refuses to move from the current voters to next when a zone
+// would then hold a majority, unless the change spreads the voters better
+// than they are now
+func checkPlacement(current, next map[raft.ServerID]string) error {
+	zone, share := majorityZone(next)
+	if zone == "" {
+		return nil
+	}
+	if _, before := majorityZone(current); before > share {
+		return nil
+	}
+	count := 0
+	for _, z := range next {
+		if z == zone {
+			count++
+		}
+	}
+	return &PlacementError{Zone: zone, Count: count, Voters: len(next)}
+}
+
+// majorityZone returns the zone holding a majority of voters and its share of
+// them. A single voter is always a majority and not reported.
+func majorityZone(voters map[raft.ServerID]string) (string, float64) {
+	if len(voters) < 2 {
+		return "", 0
+	}
+	counts := make(map[string]int)
+	for _, zone := range voters {
+		if zone != "" {
+			counts[zone]++
+		}
+	}
+	for zone, count := range counts {
+		if count > len(voters)/2 {
+			return zone, float64(count) / float64(len(voters))
+		}
+	}
+	return "", 0
+}
+
+// recordZone stores the zone a joining node declared until it reports its
+// own info, its commands are the base ones until then
+func (node *RaftNode) recordZone(id, zone string) error {
+	info, ok := node.recordedInfo(id)
+	if ok && info.Zone == zone {
+		return nil
+	}
+	if !ok {
+		info = NodeInfo{ID: id, Commands: sortedCopy(store.BaseCommands)}
+	}
+	info.Zone = zone
+	return node.RecordInfo(info)
+}
@@ -0,0 +1,71 @@
+package raftnode
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/hashicorp/raft"
+)
+
+func TestCheckPlacement(t *testing.T) {
+	zones := func(list ...string) map[raft.ServerID]string {
+		voters := make(map[raft.ServerID]string)
+		for i, zone := range list {
+			voters[raft.ServerID(string(rune('a'+i)))] = zone
+		}
+		return voters
+	}
+	tests := []struct {
+		current, next []string
+		ok            bool
+	}{
+		{[]string{"z1"}, []string{"z1", "z2"}, true},
+		{[]string{"z1"}, []string{"z1", "z1"}, false},
+		{[]string{"z1", "z2"}, []string{"z1", "z2", "z1"}, false},
+		{[]string{"z1", "z2", "z3"}, []string{"z1", "z2", "z3", "z1"}, true},
+		{[]string{"z1", "z2", "z3"}, []string{"z1", "z2"}, true},
+		// a forced placement can still be improved
+		{[]string{"z1", "z1"}, []string{"z1", "z1", "z2"}, true},
+		{[]string{"z1", "z1", "z2"}, []string{"z1", "z1", "z2", "z1"}, false},
+		// voters without a zone never form a majority
+		{[]string{""}, []string{"", ""}, true},
+		{[]string{"z1", ""}, []string{"z1", "", ""}, true},
+	}
+	for _, test := range tests {
+		err := checkPlacement(zones(test.current...), zones(test.next...))
+		if (err == nil) != test.ok {
+			t.Errorf("%v -> %v: got %v", test.current, test.next, err)
+		}
+		if err != nil {
+			if _, ok := err.(*PlacementError); !ok {
+				t.Errorf("unexpected error type %T", err)
+			}
+		}
+	}
+}
+
+func TestAddNodeZone(t *testing.T) {
+	dir, err := ioutil.TempDir("", "depot-zones")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	node := newTestNode(t, dir)
+	defer node.Close()
+	waitLeader(t, node)
+	node.zone = "z1"
+
+	err = node.AddNode("node2", "127.0.0.1:1", "z1", false)
+	if _, ok := err.(*PlacementError); !ok {
+		t.Fatalf("expected a second voter in zone z1 to be refused, got %v", err)
+	}
+	placement, err := node.Placement()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if placement.Voters != 1 || len(placement.Zones["z1"]) != 1 || placement.MajorityZone != "" {
+		t.Fatalf("unexpected placement %+v", placement)
+	}
+}
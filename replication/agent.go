@@ -0,0 +1,391 @@
+package replication
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/forjoin92/depot/raftnode"
+	"github.com/forjoin92/depot/store"
+)
+
+const batchSize = 256
+
+// Config configures a replication agent
+type Config struct {
+	// Targets are the API addresses of the standby cluster's members
+	Targets []string
+	// Prefixes limits replication to keys with one of these prefixes, empty
+	// means every key
+	Prefixes []string
+	// CheckpointPath is the file recording the last replicated index
+	CheckpointPath string
+	// Interval is how often the agent checks for changes when idle and how
+	// long it waits after an error
+	Interval time.Duration
+	// Client sends the writes to the targets and Scheme is the scheme of
+	// their API, a plain http client is used when Client is nil
+	Client *http.Client
+	Scheme string
+}
+
+// Status reports the replication progress
+type Status struct {
+	State       string    `json:"state"`
+	Target      string    `json:"target,omitempty"`
+	Checkpoint  uint64    `json:"checkpoint"`
+	SourceIndex uint64    `json:"source_index"`
+	LagEntries  uint64    `json:"lag_entries"`
+	LagSeconds  float64   `json:"lag_seconds"`
+	Replicated  uint64    `json:"replicated"`
+	Resyncs     uint64    `json:"resyncs"`
+	LastError   string    `json:"last_error,omitempty"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+const (
+	StateStandby     = "standby"
+	StateResyncing   = "resyncing"
+	StateReplicating = "replicating"
+	StateStopped     = "stopped"
+)
+
+// Agent tails the operations committed on the source node and applies them
+// to a standby cluster through its API. Only the agent on the current leader
+// replicates, the others stay in standby.
+type Agent struct {
+	source *raftnode.RaftNode
+	config Config
+	client *http.Client
+
+	checkpoint uint64
+	// target is the index of the last target that accepted a write
+	target int
+
+	sync.RWMutex
+	status Status
+}
+
+func NewAgent(source *raftnode.RaftNode, config Config) (*Agent, error) {
+	if len(config.Targets) == 0 {
+		return nil, errors.New("replication needs at least one target")
+	}
+	if config.CheckpointPath == "" {
+		return nil, errors.New("replication checkpoint path should not be empty")
+	}
+	if config.Interval <= 0 {
+		config.Interval = time.Second
+	}
+	if config.Client == nil {
+		config.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+	if config.Scheme == "" {
+		config.Scheme = "http"
+	}
+	checkpoint, err := readCheckpoint(config.CheckpointPath)
+	if err != nil {
+		return nil, err
+	}
+	return &Agent{
+		source:     source,
+		config:     config,
+		client:     config.Client,
+		checkpoint: checkpoint,
+		status: Status{
+			State:      StateStandby,
+			Checkpoint: checkpoint,
+			UpdatedAt:  time.Now(),
+		},
+	}, nil
+}
+
+// Run replicates until stop is closed
+func (a *Agent) Run(stop <-chan struct{}) {
+	for {
+		wait := a.config.Interval
+		// take the channel before reading changes so that none is missed
+		changed := a.source.Changed()
+		if a.source.IsLeader() {
+			more, err := a.sync()
+			if err != nil {
+				a.source.Logger().Error("Failed to replicate", "err", err)
+				a.update(func(s *Status) { s.LastError = err.Error() })
+			} else if more {
+				wait = 0
+			}
+		} else {
+			a.update(func(s *Status) { s.State = StateStandby })
+			changed = nil
+		}
+
+		select {
+		case <-stop:
+			a.update(func(s *Status) { s.State = StateStopped })
+			return
+		case <-changed:
+		case <-time.After(wait):
+		}
+	}
+}
+
+// sync replicates one batch of changes, it returns true when more are pending
+func (a *Agent) sync() (bool, error) {
+	changes, ok := a.source.ChangesSince(a.checkpoint, batchSize)
+	if !ok {
+		return true, a.resync()
+	}
+
+	a.update(func(s *Status) { s.State = StateReplicating })
+	for _, c := range changes {
+		if a.match(c.Op.Key) {
+			if err := a.send(c.Op); err != nil {
+				a.report(&c)
+				return false, err
+			}
+			a.update(func(s *Status) { s.Replicated++ })
+		}
+		a.checkpoint = c.Index
+	}
+	if len(changes) > 0 {
+		if err := writeCheckpoint(a.config.CheckpointPath, a.checkpoint); err != nil {
+			return false, err
+		}
+	}
+
+	var next *store.Change
+	pending, _ := a.source.ChangesSince(a.checkpoint, 1)
+	if len(pending) > 0 {
+		next = &pending[0]
+	}
+	a.report(next)
+	return next != nil, nil
+}
+
+// resync copies every matching key when the changes after the checkpoint are
+// no longer available, e.g. after a restart or a snapshot restore, and
+// deletes the matching keys the target holds but the source does not.
+func (a *Agent) resync() error {
+	a.update(func(s *Status) {
+		s.State = StateResyncing
+		s.Resyncs++
+	})
+	kvs, index := a.source.DumpKV()
+	a.source.Logger().Info("Resyncing standby cluster", "keys", len(kvs), "index", index)
+	for k, v := range kvs {
+		if !a.match(k) {
+			continue
+		}
+		if err := a.send(store.Op{Method: "SET", Key: k, Value: v}); err != nil {
+			return err
+		}
+	}
+	// keys deleted on the source while the changes were not available
+	stale, err := a.targetKeys()
+	if err != nil {
+		return err
+	}
+	for _, k := range stale {
+		if _, ok := kvs[k]; ok || !a.match(k) {
+			continue
+		}
+		if err := a.send(store.Op{Method: "DEL", Key: k}); err != nil {
+			return err
+		}
+	}
+	a.checkpoint = index
+	return writeCheckpoint(a.config.CheckpointPath, index)
+}
+
+// targetKeys lists the keys of the standby cluster under the replicated
+// prefixes, asking the targets in turn like send
+func (a *Agent) targetKeys() ([]string, error) {
+	prefixes := a.config.Prefixes
+	if len(prefixes) == 0 {
+		prefixes = []string{""}
+	}
+	var keys []string
+	for _, prefix := range prefixes {
+		var lastErr error
+		listed := false
+		for i := 0; i < len(a.config.Targets) && !listed; i++ {
+			target := a.config.Targets[(a.target+i)%len(a.config.Targets)]
+			found, err := a.list(target, prefix)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			keys = append(keys, found...)
+			listed = true
+		}
+		if !listed {
+			return nil, lastErr
+		}
+	}
+	return keys, nil
+}
+
+func (a *Agent) list(target, prefix string) ([]string, error) {
+	resp, err := a.client.Get(fmt.Sprintf("%s://%s/v1/keys?prefix=%s", a.config.Scheme, target, url.QueryEscape(prefix)))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("list %s: %s %s", target, resp.Status, strings.TrimSpace(string(body)))
+	}
+	var keys []string
+	if err := json.NewDecoder(resp.Body).Decode(&keys); err != nil {
+		return nil, fmt.Errorf("Failed to decode keys of %s: (%v)", target, err)
+	}
+	return keys, nil
+}
+
+func (a *Agent) match(key string) bool {
+	// the standby cluster keeps its own member records
+	if raftnode.IsInternalKey(key) {
+		return false
+	}
+	if len(a.config.Prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range a.config.Prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// send applies op on the standby cluster, trying every target until one
+// accepts it (only the standby leader accepts writes)
+func (a *Agent) send(op store.Op) error {
+	var lastErr error
+	for i := 0; i < len(a.config.Targets); i++ {
+		n := (a.target + i) % len(a.config.Targets)
+		target := a.config.Targets[n]
+		if err := a.apply(target, op); err != nil {
+			lastErr = err
+			continue
+		}
+		a.target = n
+		a.update(func(s *Status) { s.Target = target })
+		return nil
+	}
+	return lastErr
+}
+
+func (a *Agent) apply(target string, op store.Op) error {
+	var req *http.Request
+	var err error
+	switch op.Method {
+	case "SET":
+		body, merr := json.Marshal(map[string]string{op.Key: op.Value})
+		if merr != nil {
+			return merr
+		}
+		req, err = http.NewRequest(http.MethodPut, fmt.Sprintf("%s://%s/setKV", a.config.Scheme, target), bytes.NewReader(body))
+	case "DEL":
+		req, err = http.NewRequest(http.MethodDelete, fmt.Sprintf("%s://%s/deleteKV/%s", a.config.Scheme, target, url.PathEscape(op.Key)), nil)
+	default:
+		return fmt.Errorf("unknown op:%s", op.Method)
+	}
+	if err != nil {
+		return err
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s %s: %s %s", op.Method, target, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// report updates the lag, next is the oldest change not replicated yet
+func (a *Agent) report(next *store.Change) {
+	index := a.source.KVIndex()
+	a.update(func(s *Status) {
+		s.Checkpoint = a.checkpoint
+		s.SourceIndex = index
+		s.LagEntries = 0
+		if index > a.checkpoint {
+			s.LagEntries = index - a.checkpoint
+		}
+		s.LagSeconds = 0
+		if next != nil {
+			s.LagSeconds = time.Since(next.Time).Seconds()
+		} else {
+			s.LastError = ""
+		}
+	})
+}
+
+func (a *Agent) Status() Status {
+	a.RLock()
+	defer a.RUnlock()
+	return a.status
+}
+
+func (a *Agent) update(fn func(s *Status)) {
+	a.Lock()
+	defer a.Unlock()
+	fn(&a.status)
+	a.status.UpdatedAt = time.Now()
+}
+
+type checkpointFile struct {
+	Index uint64 `json:"index"`
+}
+
+func readCheckpoint(path string) (uint64, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("Failed to read replication checkpoint (%s): (%v)", path, err)
+	}
+	var c checkpointFile
+	if err := json.Unmarshal(data, &c); err != nil {
+		return 0, fmt.Errorf("Failed to parse replication checkpoint (%s): (%v)", path, err)
+	}
+	return c.Index, nil
+}
+
+// writeCheckpoint replaces the checkpoint file atomically
+func writeCheckpoint(path string, index uint64) error {
+	data, err := json.Marshal(checkpointFile{Index: index})
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("Failed to write replication checkpoint (%s): (%v)", tmp, err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("Failed to write replication checkpoint (%s): (%v)", tmp, err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("Failed to sync replication checkpoint (%s): (%v)", tmp, err)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
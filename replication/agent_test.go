@@ -0,0 +1,187 @@
+package replication_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/forjoin92/depot/raftnode"
+	"github.com/forjoin92/depot/replication"
+	"github.com/forjoin92/depot/service"
+)
+
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// startNode bootstraps a single node cluster on loopback
+func startNode(t *testing.T, dir, id string) *raftnode.RaftNode {
+	node, err := raftnode.NewRaftNode(&raftnode.Config{
+		ID:                 id,
+		BindAddr:           "127.0.0.1:" + strconv.Itoa(freePort(t)),
+		Bootstrap:          true,
+		DataDir:            filepath.Join(dir, id),
+		HeartbeatTimeout:   50 * time.Millisecond,
+		ElectionTimeout:    50 * time.Millisecond,
+		LeaderLeaseTimeout: 50 * time.Millisecond,
+		CommitTimeout:      5 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, node.IsLeader)
+	return node
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestReplicateToStandbyCluster(t *testing.T) {
+	dir, err := ioutil.TempDir("", "depot-replication")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	primary := startNode(t, dir, "primary")
+	defer primary.Close()
+	standby := startNode(t, dir, "standby")
+	defer standby.Close()
+
+	apiPort := strconv.Itoa(freePort(t))
+	api, err := service.NewHTTPServer(standby, "127.0.0.1", apiPort, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go api.Serve()
+	defer api.Shutdown(context.Background())
+
+	for _, kv := range [][2]string{{"app.a", "1"}, {"other.x", "2"}, {"app.b", "3"}} {
+		if err := primary.SetKV(kv[0], kv[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := primary.DeleteKV("app.b"); err != nil {
+		t.Fatal(err)
+	}
+
+	checkpoint := filepath.Join(dir, "replication.checkpoint")
+	agent, err := replication.NewAgent(primary, replication.Config{
+		Targets:        []string{"127.0.0.1:" + apiPort},
+		Prefixes:       []string{"app."},
+		CheckpointPath: checkpoint,
+		Interval:       50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go agent.Run(stop)
+
+	if err := primary.SetKV("app.c", "4"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return standby.GetKV("app.c") == "4" })
+
+	if standby.GetKV("app.a") != "1" {
+		t.Fatal("app.a was not replicated")
+	}
+	if standby.GetKV("app.b") != "" {
+		t.Fatal("app.b delete was not replicated")
+	}
+	if standby.GetKV("other.x") != "" {
+		t.Fatal("other.x should be filtered out")
+	}
+
+	waitFor(t, func() bool { return agent.Status().LagEntries == 0 })
+	if _, err := os.Stat(checkpoint); err != nil {
+		t.Fatalf("checkpoint not written: %v", err)
+	}
+}
+
+func TestResyncDeletesStaleKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "depot-replication")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	primary := startNode(t, dir, "primary")
+	defer primary.Close()
+	standby := startNode(t, dir, "standby")
+	defer standby.Close()
+
+	apiPort := strconv.Itoa(freePort(t))
+	api, err := service.NewHTTPServer(standby, "127.0.0.1", apiPort, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go api.Serve()
+	defer api.Shutdown(context.Background())
+
+	if err := primary.SetKV("app.a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	// the standby still holds a key deleted on the primary, and one outside
+	// of the replicated prefixes
+	for _, kv := range [][2]string{{"app.a", "0"}, {"app.gone", "1"}, {"other.x", "1"}} {
+		if err := standby.SetKV(kv[0], kv[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a restore drops the buffered changes, so the agent has to resync
+	snapshot, err := primary.TakeSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, rc, err := primary.OpenSnapshot(snapshot.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = primary.RestoreSnapshot(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	agent, err := replication.NewAgent(primary, replication.Config{
+		Targets:        []string{"127.0.0.1:" + apiPort},
+		Prefixes:       []string{"app."},
+		CheckpointPath: filepath.Join(dir, "replication.checkpoint"),
+		Interval:       50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go agent.Run(stop)
+
+	waitFor(t, func() bool { return agent.Status().Resyncs > 0 && agent.Status().LagEntries == 0 })
+	waitFor(t, func() bool { return standby.GetKV("app.gone") == "" })
+	if standby.GetKV("app.a") != "1" {
+		t.Fatal("app.a was not copied by the resync")
+	}
+	if standby.GetKV("other.x") != "1" {
+		t.Fatal("other.x is not replicated and should be left alone")
+	}
+}
@@ -0,0 +1,161 @@
+package service
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/forjoin92/depot/raftnode"
+	"github.com/forjoin92/depot/shard"
+	"github.com/julienschmidt/httprouter"
+)
+
+// 重新加载配置，返回已生效和需要重启才能生效的设置
+func (s *HTTPServer) reload(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if s.reloader == nil {
+		http.Error(w, "Reload not supported", http.StatusNotImplemented)
+		return
+	}
+	result, err := s.reloader()
+	if err != nil {
+		logger(r).Error("Failed to reload", "err", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(result)
+}
+
+// 获取复制到备用集群的进度和延迟
+func (s *HTTPServer) replicationStatus(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if s.replication == nil {
+		http.Error(w, "Replication not enabled", http.StatusNotImplemented)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(s.replication.Status())
+}
+
+// 查看路由表
+func (s *HTTPServer) listRanges(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if s.shards == nil {
+		http.Error(w, "Sharding not enabled", http.StatusNotImplemented)
+		return
+	}
+	table, err := s.shards.Table()
+	if err != nil {
+		logger(r).Error("Failed to read routing table", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp := struct {
+		Ranges     shard.Table `json:"ranges"`
+		Groups     []string    `json:"groups"`
+		Consistent bool        `json:"consistent"`
+	}{
+		Ranges:     table,
+		Groups:     s.shards.Groups(),
+		Consistent: table.Validate() == nil,
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// 初始化路由表，整个keyspace分配给一个raft组
+func (s *HTTPServer) initRanges(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if s.shards == nil {
+		http.Error(w, "Sharding not enabled", http.StatusNotImplemented)
+		return
+	}
+	var req struct {
+		Group string `json:"group"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Failed on POST", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	if err := s.shards.Init(req.Group); err != nil {
+		logger(r).Error("Failed to init routing table", "err", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// 在key处拆分range，并把上半部分迁移到指定的raft组
+func (s *HTTPServer) splitRange(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if s.shards == nil {
+		http.Error(w, "Sharding not enabled", http.StatusNotImplemented)
+		return
+	}
+	var req struct {
+		Key   string `json:"key"`
+		Group string `json:"group"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Failed on POST", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	if err := s.shards.Split(req.Key, req.Group); err != nil {
+		logger(r).Error("Failed to split range", "err", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// 增加raft组成员，与移除成员一起用于在节点间迁移raft组副本
+func (s *HTTPServer) addGroupMember(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if s.shards == nil {
+		http.Error(w, "Sharding not enabled", http.StatusNotImplemented)
+		return
+	}
+	spec, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed on POST", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	server, err := raftnode.ParseServer(string(spec))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.shards.AddMember(ps.ByName("group"), string(server.ID), string(server.Address), r.URL.Query().Get("zone"), forced(r)); err != nil {
+		logger(r).Error("Failed to add group member", "err", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// 移除raft组成员
+func (s *HTTPServer) removeGroupMember(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if s.shards == nil {
+		http.Error(w, "Sharding not enabled", http.StatusNotImplemented)
+		return
+	}
+	spec, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed on DELETE", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	server, err := raftnode.ParseServer(string(spec))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.shards.RemoveMember(ps.ByName("group"), string(server.ID), forced(r)); err != nil {
+		logger(r).Error("Failed to remove group member", "err", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,195 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/forjoin92/depot/raftnode"
+	"github.com/forjoin92/depot/tlsutil"
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	reportInterval = 5 * time.Second
+	// reportRetryInterval is used until the record is current, the other
+	// members need this node's api address to forward to it
+	reportRetryInterval = time.Second
+)
+
+// ReportInfo keeps the leader's record of this node's version, commands and
+// api address up to date, so the leader knows which commands every member can
+// apply and the members know where to forward requests
+func (s *HTTPServer) ReportInfo(stop <-chan struct{}) {
+	for {
+		interval := reportInterval
+		if !s.node.InfoRecorded() {
+			interval = reportRetryInterval
+			if s.node.Leader() != "" {
+				if err := s.reportInfo(); err != nil {
+					s.logger.Error("Failed to report node info", "err", err)
+				}
+			}
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+func (s *HTTPServer) reportInfo() error {
+	info := s.node.Info()
+	if s.node.IsLeader() {
+		return s.node.RecordInfo(info)
+	}
+	apiAddr, err := s.leaderAPIAddr(s.node)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	resp, err := s.peers.client.Post(s.peers.url(apiAddr, "/cluster/nodes"), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("report to %s failed: %s %s", apiAddr, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// 记录成员上报的版本和支持的命令，只能在leader上执行
+func (s *HTTPServer) recordNode(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var info raftnode.NodeInfo
+	if err := json.NewDecoder(r.Body).Decode(&info); err != nil {
+		logger(r).Error("Failed to read on POST", "err", err)
+		http.Error(w, "Failed on POST", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	if !s.node.IsLeader() {
+		http.Error(w, "Not the leader", http.StatusServiceUnavailable)
+		return
+	}
+	// members forward to the api address and gate commands on the record
+	if err := s.checkReporter(r, info.ID); err != nil {
+		logger(r).Warn("Refused node info", "node", info.ID, "remote", r.RemoteAddr, "err", err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err := s.node.RecordInfo(info); err != nil {
+		logger(r).Error("Failed to record node info", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// checkReporter makes sure a member reports its own info: its client
+// certificate names the member, or the request comes from the host of the
+// member's raft address
+func (s *HTTPServer) checkReporter(r *http.Request, id string) error {
+	raftAddr, ok := s.node.MemberAddr(id)
+	if !ok {
+		return fmt.Errorf("%w (%s)", raftnode.ErrNotMember, id)
+	}
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && tlsutil.HasName(r.TLS.VerifiedChains[0][0], id) {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(raftAddr)
+	if err != nil {
+		return fmt.Errorf("Invalid raft address (%s): (%v)", raftAddr, err)
+	}
+	remote, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remote = r.RemoteAddr
+	}
+	ips, err := net.LookupHost(host)
+	if err != nil {
+		return fmt.Errorf("Failed to resolve raft address (%s): (%v)", raftAddr, err)
+	}
+	for _, ip := range ips {
+		if net.ParseIP(ip).Equal(net.ParseIP(remote)) {
+			return nil
+		}
+	}
+	return fmt.Errorf("info of %s must be reported by the member itself", id)
+}
+
+// 集群各成员的版本，以及所有成员都支持的命令
+func (s *HTTPServer) clusterVersion(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	features, err := s.node.Features()
+	if err != nil {
+		logger(r).Error("Failed to get cluster features", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(struct {
+		Version string `json:"version"`
+		raftnode.Features
+	}{raftnode.Version, features})
+}
+
+// 查看投票节点在各个区域的分布
+func (s *HTTPServer) clusterZones(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	placement, err := s.node.Placement()
+	if err != nil {
+		logger(r).Error("Failed to get zone placement", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(placement)
+}
+
+// 查看各个节点的复制进度，只能在leader上查看
+func (s *HTTPServer) clusterReplication(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	node, err := s.snapshotNode(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	report, err := node.Replication()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(report)
+}
+
+// forced reports whether a membership change skips the zone placement check
+func forced(r *http.Request) bool {
+	return r.URL.Query().Get("force") == "true"
+}
+
+// conflict returns the message of errors refusing a membership change, from
+// this node or a member the request was forwarded to
+func conflict(err error) (string, bool) {
+	switch e := err.(type) {
+	case *raftnode.PlacementError:
+		return e.Error(), true
+	case *JoinError:
+		if e.Status == http.StatusConflict {
+			return e.Message, true
+		}
+	}
+	if errors.Is(err, raftnode.ErrClusterIDMismatch) {
+		return err.Error(), true
+	}
+	return "", false
+}
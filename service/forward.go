@@ -0,0 +1,317 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/forjoin92/depot/raftnode"
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// forwardedHeader lists the ids of the members which forwarded a request
+	forwardedHeader = "X-Depot-Forwarded-By"
+	// maxForwardHops bounds how often a request is forwarded while the
+	// members disagree about the leader
+	maxForwardHops = 3
+	// forwardRetries is how often a request is sent again after the leader
+	// could not be reached or answered 503
+	forwardRetries = 3
+	// leaderChangeWait is how long a retry waits for a new leader
+	leaderChangeWait = 3 * time.Second
+	// forwardReplaySize is how much of a request body is kept to send it
+	// again, larger bodies are streamed once and not retried
+	forwardReplaySize = 1024 * 1024
+)
+
+// errForwardLoop is returned for a request which came back to a member that
+// already forwarded it
+var errForwardLoop = errors.New("request is forwarded in a loop, the members disagree about the leader")
+
+// hopHeaders are meaningful for a single connection and are not forwarded
+var hopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization",
+	"Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+// groupFunc returns the raft group whose leader serves a request, nil when
+// the handler serves it on any member
+type groupFunc func(r *http.Request, ps httprouter.Params) (*raftnode.RaftNode, error)
+
+// mainGroup is the node's own raft group
+func (s *HTTPServer) mainGroup(*http.Request, httprouter.Params) (*raftnode.RaftNode, error) {
+	return s.node, nil
+}
+
+// keyGroup is the raft group owning the key parameter
+func (s *HTTPServer) keyGroup(r *http.Request, ps httprouter.Params) (*raftnode.RaftNode, error) {
+	return s.route(strings.TrimPrefix(ps.ByName("key"), "/"), true)
+}
+
+// queryGroup is the raft group named by the group query parameter
+func (s *HTTPServer) queryGroup(r *http.Request, _ httprouter.Params) (*raftnode.RaftNode, error) {
+	return s.snapshotNode(r)
+}
+
+// paramGroup is the data group named by the group parameter
+func (s *HTTPServer) paramGroup(r *http.Request, ps httprouter.Params) (*raftnode.RaftNode, error) {
+	if s.shards == nil {
+		return nil, nil
+	}
+	node, ok := s.shards.Group(ps.ByName("group"))
+	if !ok {
+		return nil, nil
+	}
+	return node, nil
+}
+
+// unshardedGroup is the node's own raft group unless the keyspace is
+// sharded, then the handler forwards each key itself
+func (s *HTTPServer) unshardedGroup(*http.Request, httprouter.Params) (*raftnode.RaftNode, error) {
+	if s.shards != nil {
+		return nil, nil
+	}
+	return s.node, nil
+}
+
+// onLeader serves h on the leader of the group, other members proxy the
+// request to the leader. The request is sent again when the leader changes
+// on the way, unless more of the body was streamed than can be replayed.
+func (s *HTTPServer) onLeader(group groupFunc, h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		node, err := group(r, ps)
+		// the handler answers the errors of resolving the group
+		if err != nil || node == nil || node.IsLeader() {
+			h(w, r, ps)
+			return
+		}
+		hops := forwardedBy(r)
+		for _, id := range hops {
+			if id == s.node.ID() {
+				s.forwardError(w, r, node, errForwardLoop)
+				return
+			}
+		}
+		if len(hops) >= maxForwardHops {
+			s.forwardError(w, r, node, errForwardLoop)
+			return
+		}
+
+		body := newReplayBody(r.Body, forwardReplaySize)
+		r.Body = body
+		for attempt := 0; ; attempt++ {
+			if node.IsLeader() {
+				h(w, r, ps)
+				return
+			}
+			apiAddr, err := s.leaderAPIAddr(node)
+			var resp *http.Response
+			if err == nil {
+				resp, err = s.forward(r, apiAddr, hops)
+			}
+			retry := err != nil || resp.StatusCode == http.StatusServiceUnavailable
+			if !retry || attempt == forwardRetries || !body.rewind() {
+				if err != nil {
+					s.forwardError(w, r, node, err)
+					return
+				}
+				copyResponse(w, resp)
+				return
+			}
+			if resp != nil {
+				resp.Body.Close()
+			}
+			logger(r).Warn("Retrying request on the leader", "leader", apiAddr, "attempt", attempt+1, "err", err)
+			if err := s.waitLeaderChange(r.Context(), node, apiAddr); err != nil {
+				s.forwardError(w, r, node, err)
+				return
+			}
+		}
+	}
+}
+
+// forward sends the request to the leader's api and returns its response
+func (s *HTTPServer) forward(r *http.Request, apiAddr string, hops []string) (resp *http.Response, err error) {
+	span := s.node.Tracer().Start(requestID(r), "forward", "to", apiAddr, "path", r.URL.Path)
+	defer func() { span.End(err) }()
+
+	var body io.Reader
+	if r.ContentLength != 0 {
+		body = r.Body
+	}
+	req, err := http.NewRequest(r.Method, s.peers.url(apiAddr, r.URL.RequestURI()), body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(r.Context())
+	req.ContentLength = r.ContentLength
+	copyHeader(req.Header, r.Header)
+	req.Header.Set(requestIDHeader, requestID(r))
+	req.Header.Set(forwardedHeader, strings.Join(append(hops, s.node.ID()), ","))
+	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if prior := r.Header.Get("X-Forwarded-For"); prior != "" {
+			ip = prior + ", " + ip
+		}
+		req.Header.Set("X-Forwarded-For", ip)
+	}
+	return s.peers.forward.Do(req)
+}
+
+// forwardSet sets one key of a setKV request on the leader of its group
+func (s *HTTPServer) forwardSet(r *http.Request, node *raftnode.RaftNode, key, value string) error {
+	apiAddr, err := s.leaderAPIAddr(node)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPut, "/v1/kv/"+url.PathEscape(key), strings.NewReader(value))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(r.Context())
+	req.RemoteAddr = r.RemoteAddr
+	req.Header.Set(requestIDHeader, requestID(r))
+	resp, err := s.forward(req, apiAddr, forwardedBy(r))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("set via %s failed: %s %s", apiAddr, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// forwardError answers a request which could not be forwarded, v1 requests
+// with the JSON error envelope
+func (s *HTTPServer) forwardError(w http.ResponseWriter, r *http.Request, node *raftnode.RaftNode, err error) {
+	logger(r).Error("Failed to forward to leader", "err", err)
+	noLeader := node.Leader() == ""
+	code := http.StatusBadGateway
+	switch {
+	case err == errForwardLoop:
+		code = http.StatusLoopDetected
+	case noLeader:
+		code = http.StatusServiceUnavailable
+	}
+	if strings.HasPrefix(r.URL.Path, "/v1/") {
+		e := apiErrorf(CodeUnavailable, "%v", err)
+		if noLeader {
+			e = s.notLeader(node)
+		}
+		writeJSON(w, code, struct {
+			Error *APIError `json:"error"`
+		}{e})
+		return
+	}
+	http.Error(w, err.Error(), code)
+}
+
+// forwardedBy returns the ids of the members which forwarded the request
+func forwardedBy(r *http.Request) []string {
+	header := r.Header.Get(forwardedHeader)
+	if header == "" {
+		return nil
+	}
+	return strings.Split(header, ",")
+}
+
+// waitLeaderChange waits until the group elects another leader than the one
+// at apiAddr, or for leaderChangeWait at most
+func (s *HTTPServer) waitLeaderChange(ctx context.Context, node *raftnode.RaftNode, apiAddr string) error {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	timeout := time.After(leaderChangeWait)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timeout:
+			return nil
+		case <-ticker.C:
+		}
+		if node.IsLeader() {
+			return nil
+		}
+		if addr, err := s.leaderAPIAddr(node); err == nil && addr != apiAddr {
+			return nil
+		}
+	}
+}
+
+// copyHeader replaces the headers of dst with those of src, except the hop
+// by hop ones
+func copyHeader(dst, src http.Header) {
+	for k, vv := range src {
+		dst[k] = append([]string(nil), vv...)
+	}
+	for _, h := range hopHeaders {
+		dst.Del(h)
+	}
+}
+
+// copyResponse streams the leader's response back to the client
+func copyResponse(w http.ResponseWriter, resp *http.Response) {
+	defer resp.Body.Close()
+	copyHeader(w.Header(), resp.Header)
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// replayBody keeps the first bytes read from a request body so that the
+// request can be sent again to a new leader
+type replayBody struct {
+	src io.ReadCloser
+	// buf holds what was read from src, off is where a replay reads next
+	buf   []byte
+	off   int
+	limit int
+	// overflow is set once more than limit bytes were read
+	overflow bool
+}
+
+func newReplayBody(src io.ReadCloser, limit int) *replayBody {
+	return &replayBody{src: src, limit: limit}
+}
+
+func (b *replayBody) Read(p []byte) (int, error) {
+	if b.off < len(b.buf) {
+		n := copy(p, b.buf[b.off:])
+		b.off += n
+		return n, nil
+	}
+	n, err := b.src.Read(p)
+	if !b.overflow {
+		if len(b.buf)+n > b.limit {
+			b.overflow = true
+			b.buf, b.off = nil, 0
+		} else {
+			b.buf = append(b.buf, p[:n]...)
+			b.off = len(b.buf)
+		}
+	}
+	return n, err
+}
+
+// rewind reads the body from the start again, false when it was too large
+// to be kept
+func (b *replayBody) rewind() bool {
+	if b.overflow {
+		return false
+	}
+	b.off = 0
+	return true
+}
+
+// Close is left to the server, the body is read again on a retry
+func (b *replayBody) Close() error {
+	return nil
+}
@@ -0,0 +1,176 @@
+package service
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestForwardToLeader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "depot-forward")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	raft1, raft2 := "127.0.0.1:"+freePort(t), "127.0.0.1:"+freePort(t)
+	cluster := "n1=" + raft1 + ",n2=" + raft2
+	servers := []*HTTPServer{
+		newTestServer(t, dir, "n1", raft1, freePort(t), cluster),
+		newTestServer(t, dir, "n2", raft2, freePort(t), cluster),
+	}
+	for _, s := range servers {
+		go s.Serve()
+		defer s.node.Close()
+		defer s.Shutdown(context.Background())
+	}
+	var leader, follower *HTTPServer
+	waitFor(t, func() bool {
+		for i, s := range servers {
+			if s.node.IsLeader() {
+				leader, follower = s, servers[1-i]
+				return true
+			}
+		}
+		return false
+	})
+	// the follower learns the leader's api address from the replicated record
+	if err := leader.node.RecordInfo(leader.node.Info()); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool {
+		_, err := follower.leaderAPIAddr(follower.node)
+		return err == nil
+	})
+
+	followerAddr, _ := follower.node.APIAddr(follower.node.ID())
+	req, _ := http.NewRequest("PUT", "http://"+followerAddr+"/v1/kv/a", strings.NewReader("1"))
+	req.Header.Set(requestIDHeader, "forwarded-put")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("got %s on the follower, want 204", resp.Status)
+	}
+	if got := resp.Header.Get(requestIDHeader); got != "forwarded-put" {
+		t.Fatalf("got request id %q, want forwarded-put", got)
+	}
+	if value, _ := leader.node.LookupKV("a"); value != "1" {
+		t.Fatalf("got %q on the leader, want 1", value)
+	}
+
+	// the old routes are forwarded as well
+	req, _ = http.NewRequest("PUT", "http://"+followerAddr+"/setKV", strings.NewReader(`{"b":"2"}`))
+	if resp, err = http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if value, _ := leader.node.LookupKV("b"); resp.StatusCode != http.StatusNoContent || value != "2" {
+		t.Fatalf("got %s and %q on the leader, want 204 and 2", resp.Status, value)
+	}
+
+	// a request which already passed the follower is not sent around again
+	req, _ = http.NewRequest("DELETE", "http://"+followerAddr+"/v1/kv/a", nil)
+	req.Header.Set(forwardedHeader, follower.node.ID())
+	if resp, err = http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusLoopDetected {
+		t.Fatalf("got %s for a looping request, want 508", resp.Status)
+	}
+}
+
+func TestForwardToLeaderTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "depot-forward")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caFile, certFile, keyFile := writeTestCerts(t, dir)
+
+	// the members require TLS and advertise their https port
+	raft1, raft2 := "127.0.0.1:"+freePort(t), "127.0.0.1:"+freePort(t)
+	cluster := "n1=" + raft1 + ",n2=" + raft2
+	var servers []*HTTPServer
+	for _, member := range []struct{ id, raftAddr string }{{"n1", raft1}, {"n2", raft2}} {
+		httpsPort := freePort(t)
+		node := newTestRaftNode(t, dir, member.id, member.raftAddr, httpsPort, cluster)
+		defer node.Close()
+		s, err := NewHTTPServer(node, "127.0.0.1", freePort(t), true, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.SetTLS(httpsPort, certFile, keyFile, caFile); err != nil {
+			t.Fatal(err)
+		}
+		go s.Serve()
+		defer s.Shutdown(context.Background())
+		servers = append(servers, s)
+	}
+	var leader, follower *HTTPServer
+	waitFor(t, func() bool {
+		for i, s := range servers {
+			if s.node.IsLeader() {
+				leader, follower = s, servers[1-i]
+				return true
+			}
+		}
+		return false
+	})
+	if err := leader.node.RecordInfo(leader.node.Info()); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool {
+		_, err := follower.leaderAPIAddr(follower.node)
+		return err == nil
+	})
+
+	// a client holding a certificate of the CA writes through the follower
+	client, scheme := follower.PeerClient()
+	followerAddr, _ := follower.node.APIAddr(follower.node.ID())
+	waitFor(t, func() bool {
+		conn, err := net.Dial("tcp", followerAddr)
+		if err == nil {
+			conn.Close()
+		}
+		return err == nil
+	})
+	req, _ := http.NewRequest("PUT", scheme+"://"+followerAddr+"/v1/kv/a", strings.NewReader("1"))
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("got %s on the follower, want 204", resp.Status)
+	}
+	if value, _ := leader.node.LookupKV("a"); value != "1" {
+		t.Fatalf("got %q on the leader, want 1", value)
+	}
+}
+
+func TestReplayBody(t *testing.T) {
+	body := newReplayBody(ioutil.NopCloser(strings.NewReader("hello world")), 16)
+	if data, _ := ioutil.ReadAll(body); string(data) != "hello world" {
+		t.Fatalf("got %q", data)
+	}
+	if !body.rewind() {
+		t.Fatal("expected a small body to rewind")
+	}
+	if data, _ := ioutil.ReadAll(body); string(data) != "hello world" {
+		t.Fatalf("got %q after rewind", data)
+	}
+
+	body = newReplayBody(ioutil.NopCloser(strings.NewReader("hello world")), 4)
+	ioutil.ReadAll(body)
+	if body.rewind() {
+		t.Fatal("expected a large body not to rewind")
+	}
+}
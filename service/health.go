@@ -0,0 +1,67 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/forjoin92/depot/raftnode"
+	"github.com/julienschmidt/httprouter"
+)
+
+// probePaths are answered over plain http even when tls is required, load
+// balancer probes rarely present a certificate
+var probePaths = map[string]bool{"/health": true, "/ready": true}
+
+// Readiness is the body of /ready
+type Readiness struct {
+	Ready  bool            `json:"ready"`
+	Reason string          `json:"reason,omitempty"`
+	Status raftnode.Status `json:"status"`
+}
+
+// LeaderInfo is the body of /leader
+type LeaderInfo struct {
+	Leader   string `json:"leader"`
+	LeaderID string `json:"leader_id"`
+	IsLeader bool   `json:"is_leader"`
+	Term     uint64 `json:"term"`
+}
+
+// 进程存活检查，只要能响应就返回200
+func (s *HTTPServer) health(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok", "id": s.node.ID()})
+}
+
+// 就绪检查：已知leader、没有在恢复快照且应用进度没有落后太多时返回200，否则返回503
+func (s *HTTPServer) ready(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	status, err := s.node.Ready()
+	readiness := Readiness{Ready: err == nil, Status: status}
+	code := http.StatusOK
+	if err != nil {
+		readiness.Reason = err.Error()
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, readiness)
+}
+
+// 查看当前leader，没有leader时返回503
+func (s *HTTPServer) leader(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	status := s.node.Status()
+	info := LeaderInfo{
+		Leader:   status.Leader,
+		LeaderID: status.LeaderID,
+		IsLeader: s.node.IsLeader(),
+		Term:     status.Term,
+	}
+	code := http.StatusOK
+	if info.Leader == "" {
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, info)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
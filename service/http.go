@@ -1,18 +1,25 @@
 package service
 
 import (
-	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"io/ioutil"
-	"log"
 	"net"
 	"net/http"
-	"strconv"
 	"strings"
+	"sync"
 
+	"github.com/forjoin92/depot/config"
+	"github.com/forjoin92/depot/logging"
+	"github.com/forjoin92/depot/metrics"
+	"github.com/forjoin92/depot/mux"
 	"github.com/forjoin92/depot/raftnode"
+	"github.com/forjoin92/depot/replication"
+	"github.com/forjoin92/depot/shard"
+	"github.com/forjoin92/depot/tlsutil"
 	"github.com/julienschmidt/httprouter"
 )
 
@@ -23,7 +30,27 @@ type HTTPServer struct {
 	router      http.Handler
 	addr        string
 	port        string
+	httpsPort   string
+	keyPair     *tlsutil.KeyPair
+	tlsConfig   *tls.Config
+	// peers sends the requests to other members
+	peers       *peerClient
+	mux         *mux.Mux
 	listener    net.Listener
+	server      *http.Server
+	joiner      *Joiner
+	reloader    func() (*config.ReloadResult, error)
+	shards      *shard.Host
+	replication *replication.Agent
+	metrics     *metrics.Registry
+	logger      *logging.Logger
+	// maxValueSize is the largest value accepted by the v1 api
+	maxValueSize int64
+	// maxBackupSize is the largest backup accepted by /admin/restore
+	maxBackupSize int64
+	// closing is closed on shutdown to end streaming responses
+	closing   chan struct{}
+	closeOnce sync.Once
 }
 
 func NewHTTPServer(node *raftnode.RaftNode, addr, port string, tlsEnabled bool, tlsRequired bool) (*HTTPServer, error) {
@@ -32,68 +59,224 @@ func NewHTTPServer(node *raftnode.RaftNode, addr, port string, tlsEnabled bool,
 		return nil, fmt.Errorf("Node should not be empty")
 	}
 
-	// set default http addr and port
+	// fall back to the api address the node advertises
+	if addr == "" || port == "" {
+		if apiAddr, ok := node.APIAddr(node.ID()); ok {
+			host, apiPort, err := net.SplitHostPort(apiAddr)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid api address (%s): (%v)", apiAddr, err)
+			}
+			if addr == "" {
+				addr = host
+			}
+			if port == "" {
+				port = apiPort
+			}
+		}
+	}
 	if addr == "" {
 		addr = "127.0.0.1"
 	}
 	if port == "" {
-		port = "90" + strings.Split(string(node.ID()), ":")[1][3:]
+		return nil, fmt.Errorf("api port should not be empty")
 	}
 
-	router := httprouter.New()
+	router := newRoutes()
+	router.tracer = node.Tracer()
 
 	s := &HTTPServer{
-		node:        node,
-		tlsEnabled:  tlsEnabled,
-		tlsRequired: tlsRequired,
-		router:      router,
-		addr:        addr,
-		port:        port,
+		node:          node,
+		tlsEnabled:    tlsEnabled,
+		tlsRequired:   tlsRequired,
+		router:        router,
+		addr:          addr,
+		port:          port,
+		metrics:       metrics.NewRegistry(),
+		logger:        node.Logger(),
+		maxValueSize:  defaultMaxValueSize,
+		maxBackupSize: defaultMaxBackupSize,
+		peers:         newPeerClient(nil),
+		closing:       make(chan struct{}),
+	}
+	s.metrics.Register(router.requests)
+	s.metrics.Register(router.duration)
+	s.metrics.Register(node)
+	s.server = &http.Server{
+		Handler: s,
 	}
 
+	router.GET("/v1/kv/*key", s.v1GetKV)
+	router.PUT("/v1/kv/*key", s.onLeader(s.keyGroup, s.v1PutKV))
+	router.DELETE("/v1/kv/*key", s.onLeader(s.keyGroup, s.v1DeleteKV))
+	router.GET("/v1/keys", s.onLeader(s.unshardedGroup, s.v1ListKeys))
+	router.GET("/v1/nodes", s.v1ListNodes)
+	router.POST("/v1/nodes", s.onLeader(s.mainGroup, s.v1AddNode))
+	router.DELETE("/v1/nodes/:id", s.onLeader(s.mainGroup, s.v1RemoveNode))
+
+	// verb style routes kept for older clients
 	router.GET("/getKV/:key", s.getKV)
-	router.PUT("/setKV", s.setKV)
-	router.DELETE("/deleteKV/:key", s.deleteKV)
-	router.POST("/addNode", s.addNode)
-	router.DELETE("/removeNode", s.removeNode)
+	router.PUT("/setKV", s.onLeader(s.unshardedGroup, s.setKV))
+	router.DELETE("/deleteKV/:key", s.onLeader(s.keyGroup, s.deleteKV))
+	router.POST("/addNode", s.onLeader(s.mainGroup, s.addNode))
+	router.DELETE("/removeNode", s.onLeader(s.mainGroup, s.removeNode))
+	router.GET("/joinStatus", s.joinStatus)
+	router.GET("/health", s.health)
+	router.GET("/ready", s.ready)
+	router.GET("/leader", s.leader)
+	router.GET("/metrics", s.serveMetrics)
+	router.GET("/debug/traces", s.traces)
+	router.POST("/admin/reload", s.reload)
+	// members report to the leader themselves, the reporter is checked
+	router.POST("/cluster/nodes", s.recordNode)
+	router.GET("/cluster/version", s.clusterVersion)
+	router.GET("/cluster/zones", s.clusterZones)
+	router.GET("/cluster/replication", s.onLeader(s.queryGroup, s.clusterReplication))
+	router.GET("/events", s.events)
+	router.GET("/admin/snapshots", s.listSnapshots)
+	router.POST("/admin/snapshots", s.takeSnapshot)
+	router.GET("/admin/snapshots/:id", s.downloadSnapshot)
+	router.POST("/admin/restore", s.onLeader(s.queryGroup, s.restoreSnapshot))
+	router.GET("/admin/logstore", s.logStoreStats)
+	router.GET("/replication/status", s.replicationStatus)
+	router.GET("/admin/ranges", s.listRanges)
+	router.POST("/admin/ranges/init", s.onLeader(s.mainGroup, s.initRanges))
+	router.POST("/admin/ranges/split", s.onLeader(s.mainGroup, s.splitRange))
+	router.POST("/admin/groups/:group/members", s.onLeader(s.paramGroup, s.addGroupMember))
+	router.DELETE("/admin/groups/:group/members", s.onLeader(s.paramGroup, s.removeGroupMember))
 
 	return s, nil
 }
 
+// 设置加入集群的joiner，用于/joinStatus上报进度
+func (s *HTTPServer) SetJoiner(j *Joiner) {
+	s.joiner = j
+	j.peers = s.peers
+}
+
+// 设置重新加载配置的方法，用于/admin/reload
+func (s *HTTPServer) SetReloader(fn func() (*config.ReloadResult, error)) {
+	s.reloader = fn
+}
+
+// 设置共用的raft端口，设置后api在raft端口上提供服务
+func (s *HTTPServer) SetMux(m *mux.Mux) {
+	s.mux = m
+}
+
+// 设置分片，设置后keyvalue请求按路由表发送到对应的raft组
+func (s *HTTPServer) SetShards(h *shard.Host) {
+	s.shards = h
+	for _, name := range h.Groups() {
+		if node, ok := h.Group(name); ok {
+			s.metrics.Register(metrics.WithLabels(node, metrics.Label{Name: "group", Value: name}))
+		}
+	}
+}
+
+// 设置复制到备用集群的agent，用于/replication/status上报进度
+func (s *HTTPServer) SetReplication(a *replication.Agent) {
+	s.replication = a
+}
+
 func (s *HTTPServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	if !s.tlsEnabled && s.tlsRequired {
-		resp := fmt.Sprintf(`{"message": "TLS_REQUIRED", "https_port": %s}`, s.port)
-		w.Header().Set("X-NSQ-Content-Type", "nsq; version=1.0")
-		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		w.WriteHeader(403)
-		io.WriteString(w, resp)
+	req = s.withRequestID(w, req)
+	if s.tlsRequired && req.TLS == nil && !probePaths[req.URL.Path] {
+		s.requireTLS(w, req)
 		return
 	}
 	s.router.ServeHTTP(w, req)
 }
 
 func (s *HTTPServer) Serve() {
+	if s.tlsConfig != nil {
+		go s.serveTLS()
+	}
+
 	var err error
-	s.listener, err = net.Listen("tcp", fmt.Sprintf("%s:%s", s.addr, s.port))
+	if s.mux != nil {
+		s.listener = s.mux.Default()
+	} else {
+		s.listener, err = net.Listen("tcp", fmt.Sprintf("%s:%s", s.addr, s.port))
+		if err != nil {
+			panic(err)
+		}
+	}
+	s.logger.Info("Listening", "scheme", "http", "addr", s.listener.Addr())
+
+	err = s.server.Serve(s.listener)
+	if err != nil && err != http.ErrServerClosed && err != mux.ErrClosed && !strings.Contains(err.Error(), "use of closed network connection") {
+		s.logger.Error("Failed to serve", "scheme", "http", "err", err)
+	}
+
+	s.logger.Info("Closing", "scheme", "http", "addr", s.listener.Addr())
+}
+
+// 停止接收新请求，并等待处理中的请求完成
+func (s *HTTPServer) Shutdown(ctx context.Context) error {
+	s.closeOnce.Do(func() { close(s.closing) })
+	return s.server.Shutdown(ctx)
+}
+
+// 将本节点移出集群，不是leader时通过leader移除。节点要停止了，跳过区域分布检查
+func (s *HTTPServer) Leave() error {
+	if s.node.IsLeader() {
+		return s.node.Leave()
+	}
+	apiAddr, err := s.leaderAPIAddr(s.node)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodDelete, s.peers.url(apiAddr, "/removeNode?force=true"), strings.NewReader(s.node.ID()))
+	if err != nil {
+		return err
+	}
+	resp, err := s.peers.client.Do(req)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	fmt.Printf("%s: listening on %s:%s\n", "http", s.addr, s.port)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("leave via %s failed: %s %s", apiAddr, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
 
-	server := &http.Server{
-		Handler: s,
+// 查找raft组leader通告的api地址，数据组的成员与主raft组使用相同的id
+func (s *HTTPServer) leaderAPIAddr(node *raftnode.RaftNode) (string, error) {
+	leaderID := node.Status().LeaderID
+	if leaderID == "" {
+		return "", errors.New("no known leader")
 	}
-	err = server.Serve(s.listener)
-	if err != nil && !strings.Contains(err.Error(), "use of closed network connection") {
-		fmt.Println(err)
+	if addr, ok := s.node.APIAddr(leaderID); ok {
+		return addr, nil
 	}
+	// api和raft共用端口
+	if s.mux != nil && node == s.node {
+		return string(node.Leader()), nil
+	}
+	return "", fmt.Errorf("leader %s has not advertised its api address yet", leaderID)
+}
 
-	fmt.Printf("%s: closing %s:%s\n", "http", s.addr, s.port)
+// 找到负责key的raft组，没有分片时就是本节点
+func (s *HTTPServer) route(key string, write bool) (*raftnode.RaftNode, error) {
+	if s.shards == nil {
+		return s.node, nil
+	}
+	node, _, err := s.shards.Route(key, write)
+	return node, err
 }
 
 // 获取keyvalue
 func (s *HTTPServer) getKV(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	value := s.node.GetKV(ps.ByName("key"))
+	key := ps.ByName("key")
+	node, err := s.route(key, false)
+	if err != nil {
+		logger(r).Error("Failed to route", "err", err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	value := node.GetKV(key)
 	if value == "" {
 		w.WriteHeader(http.StatusNotFound)
 		return
@@ -107,15 +290,34 @@ func (s *HTTPServer) setKV(w http.ResponseWriter, r *http.Request, _ httprouter.
 	kvs := make(map[string]string)
 	decoder := json.NewDecoder(r.Body)
 	if err := decoder.Decode(&kvs); err != nil {
-		log.Printf("Failed to read on PUT (%v)\n", err)
+		logger(r).Error("Failed to read on PUT", "err", err)
 		http.Error(w, "Failed on PUT", http.StatusBadRequest)
 		return
 	}
 	defer r.Body.Close()
 
+	// cluster metadata is written by the members only, refuse the whole batch
+	for k := range kvs {
+		if raftnode.IsInternalKey(k) {
+			http.Error(w, fmt.Sprintf("key %s is reserved for cluster metadata", k), http.StatusBadRequest)
+			return
+		}
+	}
 	for k, v := range kvs {
-		if err := s.node.SetKV(k, v); err != nil {
-			log.Printf("Failed to set (%v)\n", err)
+		node, err := s.route(k, true)
+		if err != nil {
+			logger(r).Error("Failed to route", "err", err)
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		// keys of other groups are set on their leaders
+		if node.IsLeader() {
+			err = node.SetKVContext(r.Context(), k, v)
+		} else {
+			err = s.forwardSet(r, node, k, v)
+		}
+		if err != nil {
+			logger(r).Error("Failed to set", "err", err)
 			http.Error(w, "Failed on PUT", http.StatusBadRequest)
 			return
 		}
@@ -126,8 +328,18 @@ func (s *HTTPServer) setKV(w http.ResponseWriter, r *http.Request, _ httprouter.
 // 删除keyvalue
 func (s *HTTPServer) deleteKV(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	key := ps.ByName("key")
-	if err := s.node.DeleteKV(key); err != nil {
-		log.Printf("Failed to delete (%v)\n", err)
+	if raftnode.IsInternalKey(key) {
+		http.Error(w, fmt.Sprintf("key %s is reserved for cluster metadata", key), http.StatusBadRequest)
+		return
+	}
+	node, err := s.route(key, true)
+	if err != nil {
+		logger(r).Error("Failed to route", "err", err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if err := node.DeleteKVContext(r.Context(), key); err != nil {
+		logger(r).Error("Failed to delete", "err", err)
 		http.Error(w, "Failed on POST", http.StatusBadRequest)
 		return
 	}
@@ -136,34 +348,43 @@ func (s *HTTPServer) deleteKV(w http.ResponseWriter, r *http.Request, ps httprou
 
 // 增加raft集群节点
 func (s *HTTPServer) addNode(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	id, err := ioutil.ReadAll(r.Body)
+	spec, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		log.Printf("Failed to read on POST (%v)\n", err)
+		logger(r).Error("Failed to read on POST", "err", err)
 		http.Error(w, "Failed on POST", http.StatusBadRequest)
 		return
 	}
 	defer r.Body.Close()
 
-	if s.node.IsLeader() {
-		// 接收节点为leader，直接增加节点
-		err = s.node.AddNode(string(id))
-	} else {
-		// 接收点不是leader，转发到leader节点
-		leader := s.node.Leader()
-		raftAddr := strings.Split(string(leader), ":")
-		raftPort, err := strconv.Atoi(raftAddr[1])
-		if err != nil {
-			log.Printf("Failed to get raft api port (%v)\n", err)
-			http.Error(w, "Failed on POST", http.StatusBadRequest)
-			return
-		}
-		apiPort := 9000 + raftPort%100
-		url := fmt.Sprintf("http://%s:%d/addNode", raftAddr[0], apiPort)
-		log.Println("转发ip:", url)
-		_, err = http.Post(url, "application/json", bytes.NewReader(id))
+	// 请求体为 id=address，或者只有address(id与address相同)
+	server, err := raftnode.ParseServer(string(spec))
+	if err != nil {
+		logger(r).Error("Failed to parse node", "err", err)
+		http.Error(w, "Failed on POST", http.StatusBadRequest)
+		return
+	}
+
+	// 拒绝其他集群的节点
+	opts := JoinOptions{
+		ClusterID: r.Header.Get(clusterIDHeader),
+		Zone:      r.URL.Query().Get("zone"),
+		Force:     forced(r),
+		RequestID: requestID(r),
+	}
+	if err := s.node.CheckClusterID(opts.ClusterID); err != nil {
+		logger(r).Warn("Refused node", "peer", server.ID, "err", err)
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	err = s.node.AddNode(string(server.ID), string(server.Address), opts.Zone, opts.Force)
+	if message, ok := conflict(err); ok {
+		logger(r).Warn("Refused node", "peer", server.ID, "reason", message)
+		http.Error(w, message, http.StatusConflict)
+		return
 	}
 	if err != nil {
-		log.Printf("Failed to add node (%v)\n", err)
+		logger(r).Error("Failed to add node", "err", err)
 		http.Error(w, "Failed on POST", http.StatusBadRequest)
 		return
 	}
@@ -172,16 +393,28 @@ func (s *HTTPServer) addNode(w http.ResponseWriter, r *http.Request, _ httproute
 
 // 移除raft集群节点
 func (s *HTTPServer) removeNode(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	id, err := ioutil.ReadAll(r.Body)
+	spec, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		log.Printf("Failed to read on POST (%v)\n", err)
+		logger(r).Error("Failed to read on POST", "err", err)
 		http.Error(w, "Failed on POST", http.StatusBadRequest)
 		return
 	}
 	defer r.Body.Close()
 
-	if err := s.node.RemoveNode(string(id)); err != nil {
-		log.Printf("Failed to remove node (%v)\n", err)
+	server, err := raftnode.ParseServer(string(spec))
+	if err != nil {
+		logger(r).Error("Failed to parse node", "err", err)
+		http.Error(w, "Failed on POST", http.StatusBadRequest)
+		return
+	}
+
+	err = s.node.RemoveNode(string(server.ID), forced(r))
+	if message, ok := conflict(err); ok {
+		http.Error(w, message, http.StatusConflict)
+		return
+	}
+	if err != nil {
+		logger(r).Error("Failed to remove node", "err", err)
 		http.Error(w, "Failed on POST", http.StatusBadRequest)
 		return
 	}
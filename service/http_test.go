@@ -1,13 +1,105 @@
 package service
 
 import (
-	"fmt"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
 	"strings"
 	"testing"
 )
 
-func TestParseUrl(t *testing.T) {
-	url := "127.0.0.1:30444"
-	port := "90" + strings.Split(url, ":")[1][3:]
-	fmt.Println(port)
+func TestDefaultAPIAddr(t *testing.T) {
+	dir, err := ioutil.TempDir("", "depot-http")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the port comes from the advertised api address, not the raft port
+	apiPort := freePort(t)
+	node := newTestRaftNode(t, dir, "n1", "127.0.0.1:"+freePort(t), apiPort, "")
+	defer node.Close()
+	s, err := NewHTTPServer(node, "", "", false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.addr != "127.0.0.1" || s.port != apiPort {
+		t.Fatalf("got %s:%s, want 127.0.0.1:%s", s.addr, s.port, apiPort)
+	}
+}
+
+func TestInternalKeysRefused(t *testing.T) {
+	s, cleanup := newV1Server(t)
+	defer cleanup()
+
+	for _, key := range []string{"cluster/id", "cluster/node/n1"} {
+		if rec := serve(s, "PUT", "/setKV", `{"a": "1", "`+key+`": "x"}`); rec.Code != http.StatusBadRequest {
+			t.Fatalf("got %d setting %s, want 400", rec.Code, key)
+		}
+		if rec := serve(s, "DELETE", "/v1/kv/"+key, ""); rec.Code != http.StatusBadRequest {
+			t.Fatalf("got %d on v1 DELETE of %s, want 400", rec.Code, key)
+		}
+		if rec := serve(s, "PUT", "/v1/kv/"+key, "x"); rec.Code != http.StatusBadRequest {
+			t.Fatalf("got %d on v1 PUT of %s, want 400", rec.Code, key)
+		}
+	}
+	// the batch was refused as a whole
+	if _, ok := s.node.LookupKV("a"); ok {
+		t.Fatal("expected no key of the refused batch to be set")
+	}
+}
+
+func TestRestoreLimit(t *testing.T) {
+	s, cleanup := newV1Server(t)
+	defer cleanup()
+	s.SetMaxBackupSize(16)
+
+	backup := strings.Repeat("x", 64)
+	if rec := serve(s, "POST", "/admin/restore", backup); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("got %d for a large backup, want 413", rec.Code)
+	}
+	// without a length the body is cut off while it is read
+	req := httptest.NewRequest("POST", "/admin/restore", strings.NewReader(backup))
+	req.ContentLength = -1
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("got %d for a large streamed backup, want 413", rec.Code)
+	}
+}
+
+func TestRecordNode(t *testing.T) {
+	s, cleanup := newV1Server(t)
+	defer cleanup()
+
+	report := func(id, remote string, cert *x509.Certificate) int {
+		req := httptest.NewRequest("POST", "/cluster/nodes", strings.NewReader(`{"id":"`+id+`","api_addr":"10.0.0.9:9001"}`))
+		req.RemoteAddr = remote
+		if cert != nil {
+			req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+		}
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	if code := report("n9", "127.0.0.1:5000", nil); code != http.StatusForbidden {
+		t.Fatalf("got %d for a node outside of the configuration, want 403", code)
+	}
+	// n1's raft address is on 127.0.0.1, anyone else cannot speak for it
+	if code := report("n1", "10.0.0.9:5000", nil); code != http.StatusForbidden {
+		t.Fatalf("got %d for a report from another host, want 403", code)
+	}
+	if code := report("n1", "10.0.0.9:5000", &x509.Certificate{Subject: pkix.Name{CommonName: "n2"}}); code != http.StatusForbidden {
+		t.Fatalf("got %d for a certificate of another member, want 403", code)
+	}
+	if code := report("n1", "10.0.0.9:5000", &x509.Certificate{Subject: pkix.Name{CommonName: "n1"}}); code != http.StatusNoContent {
+		t.Fatalf("got %d for the member's certificate, want 204", code)
+	}
+	if code := report("n1", "127.0.0.1:5000", nil); code != http.StatusNoContent {
+		t.Fatalf("got %d from the member's host, want 204", code)
+	}
 }
@@ -0,0 +1,228 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/forjoin92/depot/raftnode"
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	joinMinBackoff = 1 * time.Second
+	joinMaxBackoff = 30 * time.Second
+
+	// clusterIDHeader carries the cluster id of a joining node
+	clusterIDHeader = "X-Depot-Cluster-ID"
+)
+
+// JoinOptions describe a node asking to join
+type JoinOptions struct {
+	// ClusterID is the cluster the node belonged to before, empty for a new
+	// node; members of another cluster refuse it with raftnode.ErrClusterIDMismatch
+	ClusterID string
+	// Zone is the failure zone of the node
+	Zone string
+	// Force adds the node even when a zone would hold a majority of voters
+	Force bool
+	// RequestID is sent along when the request is forwarded on behalf of a client
+	RequestID string
+}
+
+// Join asks the depot member serving its API on apiAddr to add the node
+// described by spec (id=address) to the cluster. The member forwards the
+// request to the leader when it is not the leader itself.
+func Join(apiAddr, spec string, opts JoinOptions) error {
+	return join(newPeerClient(nil), apiAddr, spec, opts)
+}
+
+// join sends the join request with peers, which gives up on a hung seed
+// after peerTimeout
+func join(peers *peerClient, apiAddr, spec string, opts JoinOptions) error {
+	query := url.Values{}
+	if opts.Zone != "" {
+		query.Set("zone", opts.Zone)
+	}
+	if opts.Force {
+		query.Set("force", "true")
+	}
+	u := peers.url(apiAddr, "/addNode")
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest("POST", u, strings.NewReader(spec))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	if opts.ClusterID != "" {
+		req.Header.Set(clusterIDHeader, opts.ClusterID)
+	}
+	if opts.RequestID != "" {
+		req.Header.Set(requestIDHeader, opts.RequestID)
+	}
+	resp, err := peers.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		message := strings.TrimSpace(string(body))
+		if resp.StatusCode == http.StatusConflict && strings.HasPrefix(message, raftnode.ErrClusterIDMismatch.Error()) {
+			return raftnode.ErrClusterIDMismatch
+		}
+		return &JoinError{Addr: apiAddr, Status: resp.StatusCode, Message: message}
+	}
+	return nil
+}
+
+// SplitSeeds parses a comma separated list of seed API addresses, blanks
+// around the addresses and empty entries are dropped
+func SplitSeeds(list string) []string {
+	var seeds []string
+	for _, seed := range strings.Split(list, ",") {
+		if seed = strings.TrimSpace(seed); seed != "" {
+			seeds = append(seeds, seed)
+		}
+	}
+	return seeds
+}
+
+// JoinError is a join request refused by a member
+type JoinError struct {
+	Addr    string
+	Status  int
+	Message string
+}
+
+func (e *JoinError) Error() string {
+	return fmt.Sprintf("join via %s failed: %d %s %s", e.Addr, e.Status, http.StatusText(e.Status), e.Message)
+}
+
+// JoinStatus describes the progress of a retry join
+type JoinStatus struct {
+	State     string    `json:"state"`
+	Seeds     []string  `json:"seeds"`
+	Attempts  int       `json:"attempts"`
+	LastSeed  string    `json:"last_seed,omitempty"`
+	LastError string    `json:"last_error,omitempty"`
+	JoinedVia string    `json:"joined_via,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+const (
+	JoinStateIdle    = "idle"
+	JoinStateJoining = "joining"
+	JoinStateJoined  = "joined"
+	JoinStateStopped = "stopped"
+)
+
+// Joiner keeps trying a list of seed API addresses with backoff until one of
+// them accepts the node into the cluster.
+type Joiner struct {
+	node  *raftnode.RaftNode
+	seeds []string
+	// peers is the api client of the server, see HTTPServer.SetJoiner
+	peers *peerClient
+
+	sync.RWMutex
+	status JoinStatus
+}
+
+func NewJoiner(node *raftnode.RaftNode, seeds []string) *Joiner {
+	return &Joiner{
+		node:  node,
+		seeds: seeds,
+		peers: newPeerClient(nil),
+		status: JoinStatus{
+			State:     JoinStateIdle,
+			Seeds:     seeds,
+			UpdatedAt: time.Now(),
+		},
+	}
+}
+
+// Run tries the seeds in turn until the node is part of the cluster or stop is closed
+func (j *Joiner) Run(stop <-chan struct{}) {
+	spec := j.node.ID() + "=" + j.node.Addr()
+	zone := j.node.Info().Zone
+	backoff := joinMinBackoff
+	for {
+		for _, seed := range j.seeds {
+			// 节点已经能看到leader，说明已经被加入集群
+			if j.node.Leader() != "" {
+				j.setJoined("")
+				return
+			}
+			j.update(func(s *JoinStatus) {
+				s.State = JoinStateJoining
+				s.Attempts++
+				s.LastSeed = seed
+			})
+			if err := join(j.peers, seed, spec, JoinOptions{ClusterID: j.node.ClusterID(), Zone: zone}); err != nil {
+				j.node.Logger().Error("Failed to join cluster", "seed", seed, "err", err)
+				j.update(func(s *JoinStatus) { s.LastError = err.Error() })
+				// the seeds belong to another cluster, retrying cannot help
+				if err == raftnode.ErrClusterIDMismatch {
+					j.update(func(s *JoinStatus) { s.State = JoinStateStopped })
+					return
+				}
+				continue
+			}
+			j.node.Logger().Info("Joined cluster", "seed", seed)
+			j.setJoined(seed)
+			return
+		}
+
+		j.node.Logger().Warn("No seed accepted the node, retrying", "backoff", backoff)
+		select {
+		case <-stop:
+			j.update(func(s *JoinStatus) { s.State = JoinStateStopped })
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > joinMaxBackoff {
+			backoff = joinMaxBackoff
+		}
+	}
+}
+
+func (j *Joiner) Status() JoinStatus {
+	j.RLock()
+	defer j.RUnlock()
+	return j.status
+}
+
+func (j *Joiner) setJoined(seed string) {
+	j.update(func(s *JoinStatus) {
+		s.State = JoinStateJoined
+		s.JoinedVia = seed
+		s.LastError = ""
+	})
+}
+
+func (j *Joiner) update(fn func(s *JoinStatus)) {
+	j.Lock()
+	defer j.Unlock()
+	fn(&j.status)
+	j.status.UpdatedAt = time.Now()
+}
+
+// 获取加入集群的进度
+func (s *HTTPServer) joinStatus(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	status := JoinStatus{State: JoinStateIdle}
+	if s.joiner != nil {
+		status = s.joiner.Status()
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(status)
+}
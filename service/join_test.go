@@ -0,0 +1,44 @@
+package service
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/forjoin92/depot/raftnode"
+)
+
+func TestJoinClusterIDMismatch(t *testing.T) {
+	var clusterID string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clusterID = r.Header.Get(clusterIDHeader)
+		if clusterID != "" && clusterID != "cluster1" {
+			http.Error(w, "cluster id does not match", http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+	addr := strings.TrimPrefix(ts.URL, "http://")
+
+	if err := Join(addr, "node2=127.0.0.1:30402", JoinOptions{}); err != nil {
+		t.Fatalf("expected a new node to join, got %v", err)
+	}
+	if err := Join(addr, "node2=127.0.0.1:30402", JoinOptions{ClusterID: "cluster1"}); err != nil || clusterID != "cluster1" {
+		t.Fatalf("expected the cluster id to be sent, got %q (%v)", clusterID, err)
+	}
+	if err := Join(addr, "node2=127.0.0.1:30402", JoinOptions{ClusterID: "cluster2"}); err != raftnode.ErrClusterIDMismatch {
+		t.Fatalf("expected the mismatch to be reported, got %v", err)
+	}
+}
+
+func TestSplitSeeds(t *testing.T) {
+	seeds := SplitSeeds(" 10.0.0.1:9000, ,10.0.0.2:9000,")
+	if len(seeds) != 2 || seeds[0] != "10.0.0.1:9000" || seeds[1] != "10.0.0.2:9000" {
+		t.Fatalf("got seeds %q", seeds)
+	}
+	if seeds := SplitSeeds(""); len(seeds) != 0 {
+		t.Fatalf("got seeds %q for an empty list", seeds)
+	}
+}
@@ -0,0 +1,51 @@
+package service
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+
+	"github.com/forjoin92/depot/logging"
+	"github.com/forjoin92/depot/tracing"
+)
+
+// requestIDHeader carries the id of a request. A client may choose it, it is
+// generated otherwise, and it is sent back and on requests forwarded to other
+// members so that their log lines can be matched.
+const requestIDHeader = "X-Request-ID"
+
+// maxRequestIDLen bounds ids chosen by clients
+const maxRequestIDLen = 128
+
+// withRequestID gives the request an id and a logger tagged with it
+func (s *HTTPServer) withRequestID(w http.ResponseWriter, req *http.Request) *http.Request {
+	id := req.Header.Get(requestIDHeader)
+	if id == "" || len(id) > maxRequestIDLen {
+		id = newRequestID()
+		req.Header.Set(requestIDHeader, id)
+	}
+	w.Header().Set(requestIDHeader, id)
+	base := s.logger
+	if base == nil {
+		base = logging.Default()
+	}
+	// the request id is the trace id as well
+	ctx := tracing.NewContext(req.Context(), id)
+	return req.WithContext(logging.NewContext(ctx, base.With("request_id", id)))
+}
+
+// logger returns the logger of a request served by withRequestID
+func logger(r *http.Request) *logging.Logger {
+	return logging.FromContext(r.Context())
+}
+
+// requestID returns the id of a request served by withRequestID
+func requestID(r *http.Request) string {
+	return r.Header.Get(requestIDHeader)
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
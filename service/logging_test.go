@@ -0,0 +1,46 @@
+package service
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/forjoin92/depot/logging"
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestRequestID(t *testing.T) {
+	var buf bytes.Buffer
+	base, _ := logging.New(&buf, logging.LevelInfo, logging.FormatText)
+	router := newRoutes()
+	s := &HTTPServer{router: router, logger: base}
+	router.GET("/fail", func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		logger(r).Error("Failed on GET")
+		w.WriteHeader(http.StatusBadRequest)
+	})
+
+	// the client's id is kept
+	req := httptest.NewRequest("GET", "/fail", nil)
+	req.Header.Set(requestIDHeader, "abc")
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	if got := rec.Header().Get(requestIDHeader); got != "abc" {
+		t.Fatalf("got request id %q, want abc", got)
+	}
+	if !strings.Contains(buf.String(), "Failed on GET request_id=abc") {
+		t.Fatalf("request id missing from %q", buf.String())
+	}
+
+	// otherwise one is generated
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest("GET", "/fail", nil))
+	id := rec.Header().Get(requestIDHeader)
+	if id == "" || id == "abc" {
+		t.Fatalf("expected a generated request id, got %q", id)
+	}
+	if !strings.Contains(buf.String(), "request_id="+id) {
+		t.Fatalf("request id %s missing from %q", id, buf.String())
+	}
+}
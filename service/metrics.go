@@ -0,0 +1,98 @@
+package service
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/forjoin92/depot/metrics"
+	"github.com/forjoin92/depot/tracing"
+	"github.com/julienschmidt/httprouter"
+)
+
+// routes registers handlers on the router and counts their requests by
+// route pattern, so that keys in paths don't become labels
+type routes struct {
+	*httprouter.Router
+	requests *metrics.CounterVec
+	duration *metrics.HistogramVec
+	// tracer records a span per request, tracing is off when nil
+	tracer *tracing.Tracer
+}
+
+func newRoutes() *routes {
+	return &routes{
+		Router:   httprouter.New(),
+		requests: metrics.NewCounterVec("depot_http_requests_total", "HTTP requests by route, method and status code.", "route", "method", "code"),
+		duration: metrics.NewHistogramVec("depot_http_request_duration_seconds", "HTTP request latency by route and method.", metrics.DefaultBuckets, "route", "method"),
+	}
+}
+
+func (rt *routes) GET(path string, h httprouter.Handle) {
+	rt.Router.GET(path, rt.instrument("GET", path, h))
+}
+
+func (rt *routes) PUT(path string, h httprouter.Handle) {
+	rt.Router.PUT(path, rt.instrument("PUT", path, h))
+}
+
+func (rt *routes) POST(path string, h httprouter.Handle) {
+	rt.Router.POST(path, rt.instrument("POST", path, h))
+}
+
+func (rt *routes) DELETE(path string, h httprouter.Handle) {
+	rt.Router.DELETE(path, rt.instrument("DELETE", path, h))
+}
+
+func (rt *routes) instrument(method, route string, h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		start := time.Now()
+		span := rt.tracer.Start(tracing.IDFromContext(r.Context()), "http", "method", method, "route", route)
+		sw := &statusWriter{ResponseWriter: w}
+		h(sw, r, ps)
+		if sw.code == 0 {
+			sw.code = http.StatusOK
+		}
+		span.Set("code", strconv.Itoa(sw.code))
+		span.End(nil)
+		elapsed := time.Since(start)
+		rt.requests.Inc(route, method, strconv.Itoa(sw.code))
+		rt.duration.Observe(elapsed.Seconds(), route, method)
+		logger(r).Debug("Served request", "method", method, "route", route, "code", sw.code, "duration", elapsed)
+	}
+}
+
+// statusWriter remembers the status code of a response
+type statusWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush keeps streaming responses such as /events working
+func (w *statusWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// 以Prometheus文本格式输出监控指标
+func (s *HTTPServer) serveMetrics(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := s.metrics.WriteText(w); err != nil {
+		logger(r).Error("Failed to write metrics", "err", err)
+	}
+}
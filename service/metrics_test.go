@@ -0,0 +1,33 @@
+package service
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestRoutesInstrument(t *testing.T) {
+	rt := newRoutes()
+	rt.GET("/getKV/:key", func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if ps.ByName("key") == "missing" {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		w.Write([]byte("value"))
+	})
+
+	for _, path := range []string{"/getKV/a", "/getKV/b", "/getKV/missing"} {
+		rt.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	if got := rt.requests.Value("/getKV/:key", "GET", "200"); got != 2 {
+		t.Fatalf("got %v requests with 200, want 2", got)
+	}
+	if got := rt.requests.Value("/getKV/:key", "GET", "404"); got != 1 {
+		t.Fatalf("got %v requests with 404, want 1", got)
+	}
+	if got := rt.duration.Count("/getKV/:key", "GET"); got != 3 {
+		t.Fatalf("got %d latency observations, want 3", got)
+	}
+}
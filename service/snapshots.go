@@ -0,0 +1,136 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/forjoin92/depot/raftnode"
+	"github.com/julienschmidt/httprouter"
+)
+
+// defaultMaxBackupSize is the largest backup /admin/restore accepts unless
+// SetMaxBackupSize changes it
+const defaultMaxBackupSize = 1024 * 1024 * 1024
+
+// 设置/admin/restore接受的最大备份字节数
+func (s *HTTPServer) SetMaxBackupSize(size int64) {
+	s.maxBackupSize = size
+}
+
+// snapshotNode returns the raft group named by the group query parameter,
+// the node's own group by default
+func (s *HTTPServer) snapshotNode(r *http.Request) (*raftnode.RaftNode, error) {
+	group := r.URL.Query().Get("group")
+	if group == "" {
+		return s.node, nil
+	}
+	if s.shards == nil {
+		return nil, fmt.Errorf("Sharding not enabled")
+	}
+	node, ok := s.shards.Group(group)
+	if !ok {
+		return nil, fmt.Errorf("unknown group %s", group)
+	}
+	return node, nil
+}
+
+// 查看本节点保存的快照
+func (s *HTTPServer) listSnapshots(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	node, err := s.snapshotNode(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	snapshots, err := node.Snapshots()
+	if err != nil {
+		logger(r).Error("Failed to list snapshots", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(snapshots)
+}
+
+// 立即生成快照
+func (s *HTTPServer) takeSnapshot(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	node, err := s.snapshotNode(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	snapshot, err := node.TakeSnapshot()
+	if err != nil {
+		logger(r).Error("Failed to take snapshot", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(snapshot)
+}
+
+// 查看raft日志存储的大小和写入延迟
+func (s *HTTPServer) logStoreStats(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	node, err := s.snapshotNode(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(node.LogStoreStats())
+}
+
+// 下载快照作为备份文件
+func (s *HTTPServer) downloadSnapshot(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	node, err := s.snapshotNode(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	snapshot, rc, err := node.OpenSnapshot(ps.ByName("id"))
+	if err != nil {
+		logger(r).Error("Failed to open snapshot", "err", err)
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	defer rc.Close()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(snapshot.Size, 10))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", snapshot.ID+".snap"))
+	w.Header().Set("X-Snapshot-Index", strconv.FormatUint(snapshot.Index, 10))
+	w.Header().Set("X-Snapshot-Term", strconv.FormatUint(snapshot.Term, 10))
+	if _, err := io.Copy(w, rc); err != nil {
+		logger(r).Error("Failed to send snapshot", "snapshot", snapshot.ID, "err", err)
+	}
+}
+
+// 上传备份恢复整个集群，不是leader时转发给leader
+func (s *HTTPServer) restoreSnapshot(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	node, err := s.snapshotNode(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if r.ContentLength > s.maxBackupSize {
+		http.Error(w, fmt.Sprintf("backup of %d bytes exceeds the limit of %d bytes", r.ContentLength, s.maxBackupSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+	backup := http.MaxBytesReader(w, r.Body, s.maxBackupSize)
+	defer backup.Close()
+
+	if err := node.RestoreSnapshot(backup); err != nil {
+		logger(r).Error("Failed to restore backup", "err", err)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, fmt.Sprintf("backup exceeds the limit of %d bytes", s.maxBackupSize), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,143 @@
+package service
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/forjoin92/depot/mux"
+	"github.com/forjoin92/depot/tlsutil"
+)
+
+// 设置https监听端口和证书，clientCAFile不为空时要求客户端证书
+func (s *HTTPServer) SetTLS(httpsPort, certFile, keyFile, clientCAFile string) error {
+	keyPair, err := tlsutil.LoadKeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	config := &tls.Config{
+		GetCertificate: keyPair.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+	if clientCAFile != "" {
+		clientCAs, err := tlsutil.LoadCAPool(clientCAFile)
+		if err != nil {
+			return err
+		}
+		config.ClientCAs = clientCAs
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	s.tlsEnabled = true
+	s.httpsPort = httpsPort
+	s.keyPair = keyPair
+	s.tlsConfig = config
+	// the other members verify our certificate with the same CA
+	*s.peers = *newPeerClient(&tls.Config{
+		GetClientCertificate: keyPair.GetClientCertificate,
+		RootCAs:              config.ClientCAs,
+		MinVersion:           tls.VersionTLS12,
+	})
+	return nil
+}
+
+// peerTimeout bounds the requests a member sends to the api of another
+const peerTimeout = 10 * time.Second
+
+// peerClient sends requests to the api of other members, over https with the
+// api certificate when the api is served over TLS
+type peerClient struct {
+	scheme string
+	client *http.Client
+	// forward proxies client requests to the leader, it leaves redirects to
+	// the client and is bounded by the client's request instead of a timeout
+	forward *http.Client
+}
+
+// newPeerClient returns a plain http client when tlsConfig is nil
+func newPeerClient(tlsConfig *tls.Config) *peerClient {
+	c := &peerClient{scheme: "http"}
+	var transport http.RoundTripper = http.DefaultTransport
+	if tlsConfig != nil {
+		c.scheme = "https"
+		transport = &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			TLSClientConfig:     tlsConfig,
+			TLSHandshakeTimeout: peerTimeout,
+		}
+	}
+	c.client = &http.Client{Transport: transport, Timeout: peerTimeout}
+	c.forward = &http.Client{
+		Transport:     transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	return c
+}
+
+// url is the url of path on the member serving its api on apiAddr
+func (c *peerClient) url(apiAddr, path string) string {
+	return fmt.Sprintf("%s://%s%s", c.scheme, apiAddr, path)
+}
+
+// 访问其他成员api使用的client和scheme，配置了https时使用本节点的证书
+func (s *HTTPServer) PeerClient() (*http.Client, string) {
+	return s.peers.client, s.peers.scheme
+}
+
+// 重新加载https证书，已建立的连接继续使用旧证书
+func (s *HTTPServer) ReloadTLS() error {
+	if s.keyPair == nil {
+		return nil
+	}
+	return s.keyPair.Reload()
+}
+
+func (s *HTTPServer) serveTLS() {
+	var listener net.Listener
+	if s.mux != nil {
+		// TLS handshakes on the shared port are https
+		listener = s.mux.Handle(mux.HeaderTLS, false)
+	} else {
+		var err error
+		listener, err = net.Listen("tcp", fmt.Sprintf("%s:%s", s.addr, s.httpsPort))
+		if err != nil {
+			panic(err)
+		}
+	}
+	s.logger.Info("Listening", "scheme", "https", "addr", listener.Addr())
+
+	err := s.server.Serve(tls.NewListener(listener, s.tlsConfig))
+	if err != nil && err != http.ErrServerClosed && err != mux.ErrClosed && !strings.Contains(err.Error(), "use of closed network connection") {
+		s.logger.Error("Failed to serve", "scheme", "https", "err", err)
+	}
+
+	s.logger.Info("Closing", "scheme", "https", "addr", listener.Addr())
+}
+
+// requireTLS redirects plain GET and HEAD requests to the https port and
+// refuses the others, whose body a redirect would not carry safely
+func (s *HTTPServer) requireTLS(w http.ResponseWriter, req *http.Request) {
+	host, port, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		host = req.Host
+	}
+	// on a shared port https is served on the port of the request
+	if s.mux == nil {
+		port = s.httpsPort
+	}
+
+	if s.tlsConfig != nil && (req.Method == http.MethodGet || req.Method == http.MethodHead) {
+		if port != "" {
+			host = net.JoinHostPort(host, port)
+		}
+		http.Redirect(w, req, "https://"+host+req.URL.RequestURI(), http.StatusTemporaryRedirect)
+		return
+	}
+	resp := fmt.Sprintf(`{"message": "TLS_REQUIRED", "https_port": %q}`, port)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusForbidden)
+	io.WriteString(w, resp)
+}
@@ -0,0 +1,157 @@
+package service
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writePEM(t *testing.T, path, typ string, der []byte) {
+	data := pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der})
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeTestCerts writes a CA and a certificate for 127.0.0.1 it signed, which
+// serves as server and client certificate
+func writeTestCerts(t *testing.T, dir string) (caFile, certFile, keyFile string) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "depot test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "depot"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caFile = filepath.Join(dir, "ca.crt")
+	certFile = filepath.Join(dir, "api.crt")
+	keyFile = filepath.Join(dir, "api.key")
+	writePEM(t, caFile, "CERTIFICATE", caDER)
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+	return caFile, certFile, keyFile
+}
+
+func TestRequireTLS(t *testing.T) {
+	s := &HTTPServer{
+		tlsRequired: true,
+		router:      http.NotFoundHandler(),
+		httpsPort:   "9443",
+		tlsConfig:   &tls.Config{},
+	}
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://127.0.0.1:9001/getKV/a?x=1", nil))
+	if w.Code != http.StatusTemporaryRedirect {
+		t.Fatalf("expected redirect, got %d", w.Code)
+	}
+	if loc := w.Header().Get("Location"); loc != "https://127.0.0.1:9443/getKV/a?x=1" {
+		t.Fatalf("unexpected redirect to %s", loc)
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "http://127.0.0.1:9001/setKV", strings.NewReader(`{"a":"1"}`)))
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "TLS_REQUIRED") {
+		t.Fatalf("expected TLS_REQUIRED, got %d %s", w.Code, w.Body.String())
+	}
+
+	// requests over https reach the router
+	req := httptest.NewRequest(http.MethodGet, "https://127.0.0.1:9443/getKV/a", nil)
+	req.TLS = &tls.ConnectionState{}
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected request to be routed, got %d", w.Code)
+	}
+}
+
+func TestPeerClientTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "depot-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caFile, certFile, keyFile := writeTestCerts(t, dir)
+
+	s := &HTTPServer{peers: newPeerClient(nil)}
+	if err := s.SetTLS("", certFile, keyFile, caFile); err != nil {
+		t.Fatal(err)
+	}
+	// a member which requires client certificates
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var clientCerts int
+	ts := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientCerts = len(r.TLS.PeerCertificates)
+		w.WriteHeader(http.StatusNoContent)
+	})}
+	go ts.Serve(tls.NewListener(l, s.tlsConfig))
+	defer ts.Close()
+	addr := l.Addr().String()
+
+	if client, scheme := s.PeerClient(); client == nil || scheme != "https" {
+		t.Fatalf("got scheme %s, want https", scheme)
+	}
+	if err := join(s.peers, addr, "node2=127.0.0.1:30402", JoinOptions{}); err != nil {
+		t.Fatalf("expected the join to go over https: %v", err)
+	}
+	if clientCerts != 1 {
+		t.Fatalf("got %d client certificates, want the api certificate", clientCerts)
+	}
+	// a plain client is turned away
+	if err := Join(addr, "node2=127.0.0.1:30402", JoinOptions{}); err == nil {
+		t.Fatal("expected a plain http join to fail")
+	}
+}
@@ -0,0 +1,34 @@
+package service
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// defaultTraceLimit is the number of traces /debug/traces returns by default
+const defaultTraceLimit = 100
+
+// 返回内存中保存的请求跟踪，最近的在前。?id=只返回一个请求，?limit=限制返回数量
+func (s *HTTPServer) traces(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ring, ok := s.node.Tracer().Ring()
+	if !ok {
+		http.Error(w, "Traces are not kept in memory", http.StatusNotFound)
+		return
+	}
+	limit := defaultTraceLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	traces := ring.Traces(r.URL.Query().Get("id"))
+	if len(traces) > limit {
+		traces = traces[:limit]
+	}
+	writeJSON(w, http.StatusOK, traces)
+}
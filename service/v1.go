@@ -0,0 +1,318 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/forjoin92/depot/raftnode"
+	"github.com/forjoin92/depot/shard"
+	"github.com/hashicorp/raft"
+	"github.com/julienschmidt/httprouter"
+)
+
+// defaultMaxValueSize is the largest value the v1 api accepts unless
+// SetMaxValueSize changes it
+const defaultMaxValueSize = 1024 * 1024
+
+// Error codes of the v1 api
+const (
+	CodeNotLeader   = "NOT_LEADER"
+	CodeNotFound    = "NOT_FOUND"
+	CodeTimeout     = "TIMEOUT"
+	CodeQuota       = "QUOTA"
+	CodeConflict    = "CONFLICT"
+	CodeInvalid     = "INVALID_ARGUMENT"
+	CodeUnavailable = "UNAVAILABLE"
+	CodeInternal    = "INTERNAL"
+)
+
+// codeStatus is the http status answered with each error code
+var codeStatus = map[string]int{
+	CodeNotLeader:   http.StatusServiceUnavailable,
+	CodeNotFound:    http.StatusNotFound,
+	CodeTimeout:     http.StatusGatewayTimeout,
+	CodeQuota:       http.StatusRequestEntityTooLarge,
+	CodeConflict:    http.StatusConflict,
+	CodeInvalid:     http.StatusBadRequest,
+	CodeUnavailable: http.StatusServiceUnavailable,
+	CodeInternal:    http.StatusInternalServerError,
+}
+
+// APIError is a failed v1 request, sent as {"error": {...}}
+type APIError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// Leader and LeaderID name the leader with NOT_LEADER when it is known,
+	// Leader is its api address
+	Leader   string `json:"leader,omitempty"`
+	LeaderID string `json:"leader_id,omitempty"`
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// Status is the http status of the error
+func (e *APIError) Status() int {
+	if code, ok := codeStatus[e.Code]; ok {
+		return code
+	}
+	return http.StatusInternalServerError
+}
+
+func apiErrorf(code, format string, args ...interface{}) *APIError {
+	return &APIError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// KV is the body of GET /v1/kv/{key}
+type KV struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// NodeSpec is the body of POST /v1/nodes
+type NodeSpec struct {
+	ID      string `json:"id"`
+	Address string `json:"address"`
+	Zone    string `json:"zone,omitempty"`
+}
+
+// 设置v1 api接受的最大value字节数
+func (s *HTTPServer) SetMaxValueSize(size int64) {
+	s.maxValueSize = size
+}
+
+// toAPIError maps err to an error code, node is the raft group which failed
+// the request and names the leader of NOT_LEADER errors
+func (s *HTTPServer) toAPIError(node *raftnode.RaftNode, err error) *APIError {
+	if e, ok := err.(*APIError); ok {
+		return e
+	}
+	if message, ok := conflict(err); ok {
+		return apiErrorf(CodeConflict, "%s", message)
+	}
+	// errors may be wrapped with the details of the failure
+	is := func(targets ...error) bool {
+		for _, target := range targets {
+			if errors.Is(err, target) {
+				return true
+			}
+		}
+		return false
+	}
+	switch {
+	case is(raftnode.ErrNotLeader, raft.ErrNotLeader, raft.ErrLeadershipLost):
+		return s.notLeader(node)
+	case is(raft.ErrEnqueueTimeout, context.DeadlineExceeded):
+		return apiErrorf(CodeTimeout, "%v", err)
+	case is(shard.ErrRangeFrozen, raftnode.ErrUnsupportedCommand):
+		return apiErrorf(CodeConflict, "%v", err)
+	case is(shard.ErrNoRoute, raft.ErrRaftShutdown):
+		return apiErrorf(CodeUnavailable, "%v", err)
+	}
+	return apiErrorf(CodeInternal, "%v", err)
+}
+
+// notLeader names the leader of node's group when one is known
+func (s *HTTPServer) notLeader(node *raftnode.RaftNode) *APIError {
+	e := apiErrorf(CodeNotLeader, "%s", raftnode.ErrNotLeader)
+	if node == nil {
+		node = s.node
+	}
+	e.LeaderID = node.Status().LeaderID
+	e.Leader, _ = s.leaderAPIAddr(node)
+	return e
+}
+
+// writeAPIError answers a failed v1 request with the JSON error envelope
+func (s *HTTPServer) writeAPIError(w http.ResponseWriter, r *http.Request, node *raftnode.RaftNode, err error) {
+	e := s.toAPIError(node, err)
+	if e.Code == CodeInternal {
+		logger(r).Error("Request failed", "err", err)
+	} else {
+		logger(r).Debug("Request failed", "code", e.Code, "err", err)
+	}
+	writeJSON(w, e.Status(), struct {
+		Error *APIError `json:"error"`
+	}{e})
+}
+
+// kvKey returns the key of a /v1/kv/*key route, keys may contain slashes
+func kvKey(ps httprouter.Params) (string, error) {
+	key := strings.TrimPrefix(ps.ByName("key"), "/")
+	if key == "" {
+		return "", apiErrorf(CodeInvalid, "key should not be empty")
+	}
+	return key, nil
+}
+
+// 获取key的value
+func (s *HTTPServer) v1GetKV(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	key, err := kvKey(ps)
+	if err != nil {
+		s.writeAPIError(w, r, nil, err)
+		return
+	}
+	node, err := s.route(key, false)
+	if err != nil {
+		s.writeAPIError(w, r, node, err)
+		return
+	}
+	value, ok := node.LookupKV(key)
+	if !ok {
+		s.writeAPIError(w, r, node, apiErrorf(CodeNotFound, "key %s not found", key))
+		return
+	}
+	writeJSON(w, http.StatusOK, KV{Key: key, Value: value})
+}
+
+// 列出以prefix开头的key，分片时不支持
+func (s *HTTPServer) v1ListKeys(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if s.shards != nil {
+		s.writeAPIError(w, r, nil, apiErrorf(CodeInvalid, "listing keys is not supported when the keyspace is sharded"))
+		return
+	}
+	prefix := r.URL.Query().Get("prefix")
+	keys := []string{}
+	for k := range s.node.ScanKV(prefix, "") {
+		if strings.HasPrefix(k, prefix) && !raftnode.IsInternalKey(k) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	writeJSON(w, http.StatusOK, keys)
+}
+
+// 设置key的value，请求体就是value
+func (s *HTTPServer) v1PutKV(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	key, err := kvKey(ps)
+	if err != nil {
+		s.writeAPIError(w, r, nil, err)
+		return
+	}
+	if raftnode.IsInternalKey(key) {
+		s.writeAPIError(w, r, nil, apiErrorf(CodeInvalid, "key %s is reserved for cluster metadata", key))
+		return
+	}
+	max := s.maxValueSize
+	if max <= 0 {
+		max = defaultMaxValueSize
+	}
+	if r.ContentLength > max {
+		s.writeAPIError(w, r, nil, apiErrorf(CodeQuota, "value of %d bytes exceeds the limit of %d bytes", r.ContentLength, max))
+		return
+	}
+	value, err := ioutil.ReadAll(io.LimitReader(r.Body, max+1))
+	if err != nil {
+		s.writeAPIError(w, r, nil, apiErrorf(CodeInvalid, "Failed to read value: %v", err))
+		return
+	}
+	defer r.Body.Close()
+	if int64(len(value)) > max {
+		s.writeAPIError(w, r, nil, apiErrorf(CodeQuota, "value exceeds the limit of %d bytes", max))
+		return
+	}
+
+	node, err := s.route(key, true)
+	if err != nil {
+		s.writeAPIError(w, r, node, err)
+		return
+	}
+	if err := node.SetKVContext(r.Context(), key, string(value)); err != nil {
+		s.writeAPIError(w, r, node, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// 删除key，key不存在时同样成功
+func (s *HTTPServer) v1DeleteKV(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	key, err := kvKey(ps)
+	if err != nil {
+		s.writeAPIError(w, r, nil, err)
+		return
+	}
+	if raftnode.IsInternalKey(key) {
+		s.writeAPIError(w, r, nil, apiErrorf(CodeInvalid, "key %s is reserved for cluster metadata", key))
+		return
+	}
+	node, err := s.route(key, true)
+	if err != nil {
+		s.writeAPIError(w, r, node, err)
+		return
+	}
+	if err := node.DeleteKVContext(r.Context(), key); err != nil {
+		s.writeAPIError(w, r, node, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// 查看raft集群节点
+func (s *HTTPServer) v1ListNodes(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	members, err := s.node.Members()
+	if err != nil {
+		s.writeAPIError(w, r, s.node, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, members)
+}
+
+// 增加raft集群节点，force=true跳过区域分布检查
+func (s *HTTPServer) v1AddNode(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var spec NodeSpec
+	if err := json.NewDecoder(r.Body).Decode(&spec); err != nil {
+		s.writeAPIError(w, r, nil, apiErrorf(CodeInvalid, "Failed to decode node: %v", err))
+		return
+	}
+	defer r.Body.Close()
+	if spec.ID == "" || spec.Address == "" {
+		s.writeAPIError(w, r, nil, apiErrorf(CodeInvalid, "node id and address should not be empty"))
+		return
+	}
+	// 拒绝其他集群的节点
+	if err := s.node.CheckClusterID(r.Header.Get(clusterIDHeader)); err != nil {
+		s.writeAPIError(w, r, nil, err)
+		return
+	}
+	if err := s.node.AddNode(spec.ID, spec.Address, spec.Zone, forced(r)); err != nil {
+		s.writeAPIError(w, r, s.node, err)
+		return
+	}
+	w.Header().Set("Location", "/v1/nodes/"+spec.ID)
+	writeJSON(w, http.StatusCreated, spec)
+}
+
+// 移除raft集群节点，force=true跳过区域分布检查
+func (s *HTTPServer) v1RemoveNode(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	id := ps.ByName("id")
+	if !s.node.IsLeader() {
+		s.writeAPIError(w, r, s.node, raftnode.ErrNotLeader)
+		return
+	}
+	members, err := s.node.Members()
+	if err != nil {
+		s.writeAPIError(w, r, s.node, err)
+		return
+	}
+	found := false
+	for _, member := range members {
+		found = found || member.ID == id
+	}
+	if !found {
+		s.writeAPIError(w, r, s.node, apiErrorf(CodeNotFound, "node %s not found", id))
+		return
+	}
+	if err := s.node.RemoveNode(id, forced(r)); err != nil {
+		s.writeAPIError(w, r, s.node, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,198 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/forjoin92/depot/raftnode"
+	"github.com/hashicorp/raft"
+)
+
+func freePort(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+}
+
+// newTestServer starts a member bootstrapped with cluster, or alone when
+// cluster is empty, and returns its api on apiPort without serving it
+func newTestServer(t *testing.T, dir, id, raftAddr, apiPort, cluster string) *HTTPServer {
+	s, err := NewHTTPServer(newTestRaftNode(t, dir, id, raftAddr, apiPort, cluster), "127.0.0.1", apiPort, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// newTestRaftNode starts the raft node of a member advertising its api on
+// apiPort
+func newTestRaftNode(t *testing.T, dir, id, raftAddr, apiPort, cluster string) *raftnode.RaftNode {
+	node, err := raftnode.NewRaftNode(&raftnode.Config{
+		ID:                 id,
+		BindAddr:           raftAddr,
+		APIAddr:            "127.0.0.1:" + apiPort,
+		Cluster:            cluster,
+		Bootstrap:          true,
+		DataDir:            filepath.Join(dir, id),
+		HeartbeatTimeout:   50 * time.Millisecond,
+		ElectionTimeout:    50 * time.Millisecond,
+		LeaderLeaseTimeout: 50 * time.Millisecond,
+		CommitTimeout:      5 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return node
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func newV1Server(t *testing.T) (*HTTPServer, func()) {
+	dir, err := ioutil.TempDir("", "depot-v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(t, dir, "n1", "127.0.0.1:"+freePort(t), freePort(t), "")
+	waitFor(t, s.node.IsLeader)
+	return s, func() {
+		s.node.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func serve(s *HTTPServer, method, path, body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+	return rec
+}
+
+func errorCode(t *testing.T, rec *httptest.ResponseRecorder) string {
+	var body struct {
+		Error APIError `json:"error"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatalf("decoding error body: %v", err)
+	}
+	return body.Error.Code
+}
+
+func TestV1KV(t *testing.T) {
+	s, cleanup := newV1Server(t)
+	defer cleanup()
+	s.SetMaxValueSize(8)
+
+	if rec := serve(s, "GET", "/v1/kv/a/b", ""); rec.Code != http.StatusNotFound || errorCode(t, rec) != CodeNotFound {
+		t.Fatalf("got %d for a missing key, want 404 NOT_FOUND", rec.Code)
+	}
+	if rec := serve(s, "PUT", "/v1/kv/a/b", "value"); rec.Code != http.StatusNoContent {
+		t.Fatalf("got %d on PUT, want 204: %s", rec.Code, rec.Body)
+	}
+	rec := serve(s, "GET", "/v1/kv/a/b", "")
+	var kv KV
+	if err := json.NewDecoder(rec.Body).Decode(&kv); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("got %d on GET: %v", rec.Code, err)
+	}
+	if kv.Key != "a/b" || kv.Value != "value" {
+		t.Fatalf("got %+v, want a/b=value", kv)
+	}
+
+	// an empty value is still a value
+	serve(s, "PUT", "/v1/kv/empty", "")
+	if rec := serve(s, "GET", "/v1/kv/empty", ""); rec.Code != http.StatusOK {
+		t.Fatalf("got %d for an empty value, want 200", rec.Code)
+	}
+
+	if rec := serve(s, "PUT", "/v1/kv/big", "too large value"); rec.Code != http.StatusRequestEntityTooLarge || errorCode(t, rec) != CodeQuota {
+		t.Fatalf("got %d for a large value, want 413 QUOTA", rec.Code)
+	}
+	if rec := serve(s, "PUT", "/v1/kv/", "value"); rec.Code != http.StatusBadRequest || errorCode(t, rec) != CodeInvalid {
+		t.Fatalf("got %d for an empty key, want 400 INVALID_ARGUMENT", rec.Code)
+	}
+
+	if rec := serve(s, "DELETE", "/v1/kv/a/b", ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("got %d on DELETE, want 204", rec.Code)
+	}
+	if rec := serve(s, "GET", "/v1/kv/a/b", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("got %d after DELETE, want 404", rec.Code)
+	}
+}
+
+func TestV1Nodes(t *testing.T) {
+	s, cleanup := newV1Server(t)
+	defer cleanup()
+
+	rec := serve(s, "GET", "/v1/nodes", "")
+	var members []raftnode.Member
+	if err := json.NewDecoder(rec.Body).Decode(&members); err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 1 || members[0].ID != "n1" || !members[0].Leader {
+		t.Fatalf("got members %+v, want the leader n1", members)
+	}
+
+	if rec := serve(s, "DELETE", "/v1/nodes/missing", ""); rec.Code != http.StatusNotFound || errorCode(t, rec) != CodeNotFound {
+		t.Fatalf("got %d removing an unknown node, want 404 NOT_FOUND", rec.Code)
+	}
+	if rec := serve(s, "POST", "/v1/nodes", `{"id":"n2"}`); rec.Code != http.StatusBadRequest || errorCode(t, rec) != CodeInvalid {
+		t.Fatalf("got %d without an address, want 400 INVALID_ARGUMENT", rec.Code)
+	}
+
+	// a node of another cluster is refused with a conflict, not a failure
+	waitFor(t, func() bool { return s.node.ClusterID() != "" })
+	req := httptest.NewRequest("POST", "/v1/nodes", strings.NewReader(`{"id":"n2","address":"127.0.0.1:1"}`))
+	req.Header.Set(clusterIDHeader, "other")
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	if rec.Code != http.StatusConflict || errorCode(t, rec) != CodeConflict {
+		t.Fatalf("got %d adding a node of another cluster, want 409 CONFLICT", rec.Code)
+	}
+}
+
+func TestAPIErrorCodes(t *testing.T) {
+	s, cleanup := newV1Server(t)
+	defer cleanup()
+
+	for _, tt := range []struct {
+		err  error
+		code string
+	}{
+		{raftnode.ErrNotLeader, CodeNotLeader},
+		{raft.ErrLeadershipLost, CodeNotLeader},
+		{raft.ErrEnqueueTimeout, CodeTimeout},
+		{raftnode.ErrClusterIDMismatch, CodeConflict},
+		{fmt.Errorf("%w (details)", raftnode.ErrUnsupportedCommand), CodeConflict},
+		{&raftnode.PlacementError{Zone: "a", Count: 2, Voters: 3}, CodeConflict},
+		{raft.ErrRaftShutdown, CodeUnavailable},
+		{os.ErrPermission, CodeInternal},
+	} {
+		if e := s.toAPIError(nil, tt.err); e.Code != tt.code {
+			t.Errorf("%v: got code %s, want %s", tt.err, e.Code, tt.code)
+		}
+	}
+	// this node leads, the hint names it
+	e := s.toAPIError(nil, raftnode.ErrNotLeader)
+	if apiAddr, _ := s.node.APIAddr("n1"); e.LeaderID != "n1" || e.Leader != apiAddr {
+		t.Fatalf("got leader hint %q %q, want n1 at %s", e.LeaderID, e.Leader, apiAddr)
+	}
+}
@@ -0,0 +1,315 @@
+package shard
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/forjoin92/depot/raftnode"
+	"github.com/forjoin92/depot/store"
+)
+
+var (
+	ErrNoRoute     = errors.New("no range owns the key, initialize the routing table first")
+	ErrRangeFrozen = store.ErrRangeFrozen
+)
+
+// Host runs several raft groups in one process. The metadata group stores the
+// routing table, every other group owns the key ranges assigned to it.
+type Host struct {
+	meta   *raftnode.RaftNode
+	groups map[string]*raftnode.RaftNode
+
+	// admin operations change several keys, run them one at a time
+	adminLock sync.Mutex
+}
+
+func NewHost(meta *raftnode.RaftNode, groups map[string]*raftnode.RaftNode) (*Host, error) {
+	if meta == nil {
+		return nil, fmt.Errorf("metadata group should not be empty")
+	}
+	if len(groups) == 0 {
+		return nil, fmt.Errorf("at least one data group is required")
+	}
+	return &Host{
+		meta:   meta,
+		groups: groups,
+	}, nil
+}
+
+// 元数据raft组
+func (h *Host) Meta() *raftnode.RaftNode {
+	return h.meta
+}
+
+// 获取本进程运行的数据raft组
+func (h *Host) Group(name string) (*raftnode.RaftNode, bool) {
+	node, ok := h.groups[name]
+	return node, ok
+}
+
+// 本进程运行的数据raft组名称
+func (h *Host) Groups() []string {
+	names := make([]string, 0, len(h.groups))
+	for name := range h.groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// 从元数据组读取路由表
+func (h *Host) Table() (Table, error) {
+	return decodeTable(h.meta.ScanKV(rangePrefix, prefixEnd(rangePrefix)))
+}
+
+// Route returns the group owning key. Writes to a frozen range are refused.
+func (h *Host) Route(key string, write bool) (*raftnode.RaftNode, Range, error) {
+	table, err := h.Table()
+	if err != nil {
+		return nil, Range{}, err
+	}
+	r, ok := table.Lookup(key)
+	if !ok {
+		return nil, Range{}, ErrNoRoute
+	}
+	if write && r.Frozen {
+		return nil, r, ErrRangeFrozen
+	}
+	node, ok := h.groups[r.Group]
+	if !ok {
+		return nil, r, fmt.Errorf("group %s owning key is not hosted on this node", r.Group)
+	}
+	return node, r, nil
+}
+
+// Init assigns the whole keyspace to group, only allowed on an empty table
+func (h *Host) Init(group string) error {
+	h.adminLock.Lock()
+	defer h.adminLock.Unlock()
+
+	if _, ok := h.groups[group]; !ok {
+		return fmt.Errorf("unknown group %s", group)
+	}
+	table, err := h.Table()
+	if err != nil {
+		return err
+	}
+	if len(table) > 0 {
+		return fmt.Errorf("routing table is already initialized")
+	}
+	return h.putRange(Range{Group: group})
+}
+
+// Split splits the range containing at into [start, at) and [at, end) and
+// moves the upper half to group. Moving keys requires this node to lead the
+// metadata group and both data groups.
+func (h *Host) Split(at, group string) error {
+	h.adminLock.Lock()
+	defer h.adminLock.Unlock()
+
+	if _, ok := h.groups[group]; !ok {
+		return fmt.Errorf("unknown group %s", group)
+	}
+	table, err := h.Table()
+	if err != nil {
+		return err
+	}
+	r, ok := table.Lookup(at)
+	if !ok {
+		return ErrNoRoute
+	}
+	if r.Frozen {
+		return ErrRangeFrozen
+	}
+
+	if r.Start != at {
+		// add the upper half first, lookups prefer the range with the
+		// greatest start so keys >= at move over as soon as it exists
+		upper := Range{Start: at, End: r.End, Group: r.Group}
+		if err := h.putRange(upper); err != nil {
+			return err
+		}
+		lower := r
+		lower.End = at
+		if err := h.putRange(lower); err != nil {
+			return err
+		}
+		r = upper
+	}
+	if r.Group == group {
+		return nil
+	}
+	return h.move(r, group)
+}
+
+// move copies the keys of r to group and then hands the range over to it.
+// The range is frozen for writes while the keys are copied, in the routing
+// table and in the source group itself: members route with their own copy
+// of the table, which can be behind, so only the source group can refuse
+// every write that arrives after its keys were read.
+func (h *Host) move(r Range, group string) error {
+	srcGroup := r.Group
+	src, ok := h.groups[srcGroup]
+	if !ok {
+		return fmt.Errorf("group %s is not hosted on this node", r.Group)
+	}
+	dst := h.groups[group]
+	if !h.meta.IsLeader() || !src.IsLeader() || !dst.IsLeader() {
+		return fmt.Errorf("moving a range must run on the leader of the metadata group and groups %s and %s", r.Group, group)
+	}
+
+	r.Frozen = true
+	if err := h.putRange(r); err != nil {
+		return err
+	}
+	// dst may have owned the range before and still refuse writes to it
+	if err := thaw(dst, r.Start, r.End); err != nil {
+		h.unfreeze(r, nil)
+		return fmt.Errorf("Failed to thaw range in group %s: (%v)", group, err)
+	}
+	if err := src.SetKV(store.FrozenPrefix+r.Start, r.End); err != nil {
+		h.unfreeze(r, nil)
+		return fmt.Errorf("Failed to freeze range in group %s: (%v)", srcGroup, err)
+	}
+
+	// the leader applied the freeze, so every write accepted before it is
+	// in the scan and every later one is refused
+	kvs := src.ScanKV(r.Start, r.End)
+	for k, v := range kvs {
+		if raftnode.IsInternalKey(k) {
+			delete(kvs, k)
+			continue
+		}
+		if err := dst.SetKV(k, v); err != nil {
+			h.discard(dst, kvs)
+			h.unfreeze(r, src)
+			return fmt.Errorf("Failed to copy key %s to group %s: (%v)", k, group, err)
+		}
+	}
+
+	moved := r
+	moved.Group = group
+	moved.Frozen = false
+	if err := h.putRange(moved); err != nil {
+		// src still owns the range
+		h.discard(dst, kvs)
+		h.unfreeze(r, src)
+		return fmt.Errorf("Failed to hand range to group %s: (%v)", group, err)
+	}
+	r = moved
+
+	// the range now belongs to dst, drop the old copies. src keeps the range
+	// frozen so that writes routed with an old table are refused, not lost.
+	for k := range kvs {
+		if err := src.DeleteMovedKV(k); err != nil {
+			h.meta.Logger().Error("Failed to delete moved key", "key", k, "group", srcGroup, "err", err)
+		}
+	}
+	h.meta.Logger().Info("Moved range", "range", r, "group", group, "keys", len(kvs))
+	return nil
+}
+
+// unfreeze lets r take writes again after a failed move, src is the group
+// which froze it, nil when it did not get that far
+func (h *Host) unfreeze(r Range, src *raftnode.RaftNode) {
+	if src != nil {
+		if err := thaw(src, r.Start, r.End); err != nil {
+			h.meta.Logger().Error("Failed to thaw range", "range", r, "err", err)
+		}
+	}
+	r.Frozen = false
+	if err := h.putRange(r); err != nil {
+		h.meta.Logger().Error("Failed to unfreeze range", "range", r, "err", err)
+	}
+}
+
+// discard drops the copies a failed move left in the group it was moving to
+func (h *Host) discard(dst *raftnode.RaftNode, kvs map[string]string) {
+	for k := range kvs {
+		if err := dst.DeleteKV(k); err != nil {
+			h.meta.Logger().Error("Failed to drop copied key", "key", k, "err", err)
+		}
+	}
+}
+
+// thaw lifts the freeze of [start, end) in node, the parts of frozen ranges
+// outside of it stay frozen
+func thaw(node *raftnode.RaftNode, start, end string) error {
+	for k, e := range node.ScanKV(store.FrozenPrefix, prefixEnd(store.FrozenPrefix)) {
+		s := strings.TrimPrefix(k, store.FrozenPrefix)
+		if (end != "" && s >= end) || (e != "" && e <= start) {
+			continue
+		}
+		// freeze the part above end before shrinking or dropping the marker
+		if end != "" && (e == "" || e > end) {
+			if err := node.SetKV(store.FrozenPrefix+end, e); err != nil {
+				return err
+			}
+		}
+		var err error
+		if s < start {
+			err = node.SetKV(k, start)
+		} else {
+			err = node.DeleteKV(k)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddMember adds a member to a data group, used to rebalance group replicas
+// between nodes together with RemoveMember. force skips the zone placement check.
+func (h *Host) AddMember(group, id, addr, zone string, force bool) error {
+	node, ok := h.groups[group]
+	if !ok {
+		return fmt.Errorf("unknown group %s", group)
+	}
+	return node.AddNode(id, addr, zone, force)
+}
+
+func (h *Host) RemoveMember(group, id string, force bool) error {
+	node, ok := h.groups[group]
+	if !ok {
+		return fmt.Errorf("unknown group %s", group)
+	}
+	return node.RemoveNode(id, force)
+}
+
+// 关闭所有数据raft组，元数据组由调用方关闭
+func (h *Host) Close() error {
+	var firstErr error
+	for name, node := range h.groups {
+		if err := node.Close(); err != nil {
+			node.Logger().Error("Failed to close group", "group", name, "err", err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+func (h *Host) putRange(r Range) error {
+	value, err := encodeRange(r)
+	if err != nil {
+		return err
+	}
+	return h.meta.SetKV(rangeKey(r), value)
+}
+
+// prefixEnd returns the smallest key greater than every key with prefix
+func prefixEnd(prefix string) string {
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i]++
+			return string(b[:i+1])
+		}
+	}
+	return ""
+}
@@ -0,0 +1,130 @@
+package shard
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/forjoin92/depot/raftnode"
+)
+
+// newTestGroup bootstraps a single member raft group on loopback
+func newTestGroup(t *testing.T, dir, name string) *raftnode.RaftNode {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	node, err := raftnode.NewRaftNode(&raftnode.Config{
+		ID:                 "node1",
+		BindAddr:           addr,
+		Bootstrap:          true,
+		DataDir:            filepath.Join(dir, name),
+		HeartbeatTimeout:   50 * time.Millisecond,
+		ElectionTimeout:    50 * time.Millisecond,
+		LeaderLeaseTimeout: 50 * time.Millisecond,
+		CommitTimeout:      5 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for !node.IsLeader() {
+		if time.Now().After(deadline) {
+			t.Fatalf("group %s did not elect a leader", name)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return node
+}
+
+func TestMoveWithConcurrentWrites(t *testing.T) {
+	dir, err := ioutil.TempDir("", "depot-shard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	meta := newTestGroup(t, dir, "meta")
+	defer meta.Close()
+	g1, g2 := newTestGroup(t, dir, "g1"), newTestGroup(t, dir, "g2")
+	h, err := NewHost(meta, map[string]*raftnode.RaftNode{"g1": g1, "g2": g2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	if err := h.Init("g1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// writers keep overwriting their keys, acked holds the last value each
+	// write was acknowledged with
+	var mu sync.Mutex
+	acked := make(map[string]string)
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				key := fmt.Sprintf("k%d%d", i%10, w)
+				value := fmt.Sprintf("%d", i)
+				node, _, err := h.Route(key, true)
+				if err == nil {
+					err = node.SetKV(key, value)
+				}
+				if err == nil {
+					mu.Lock()
+					acked[key] = value
+					mu.Unlock()
+				}
+			}
+		}(w)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if err := h.Split("k5", "g2"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	// and back again, g1 has to take writes to the range once more
+	if err := h.Split("k5", "g1"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+
+	for key, value := range acked {
+		node, _, err := h.Route(key, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := node.GetKV(key); got != value {
+			t.Errorf("key %s: got %q, want the acknowledged %q", key, got, value)
+		}
+	}
+	if got := g2.ScanKV("k5", "l"); len(got) != 0 {
+		t.Fatalf("expected the moved keys to be dropped from g2, got %v", got)
+	}
+	// g2 gave the range away, writes routed with an old table are refused
+	if err := g2.SetKV("k55", "stale"); err != ErrRangeFrozen {
+		t.Fatalf("expected a write to the moved range to be refused, got %v", err)
+	}
+	if err := g1.SetKV("k55", "v"); err != nil {
+		t.Fatalf("expected g1 to take writes to the range it owns again: %v", err)
+	}
+}
@@ -0,0 +1,98 @@
+package shard
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// rangePrefix is the key prefix of the routing table in the metadata group
+const rangePrefix = "shard/range/"
+
+// Range is a key range [Start, End) owned by one raft group. An empty End
+// means the range has no upper bound.
+type Range struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+	Group string `json:"group"`
+	// Frozen ranges reject writes while their keys move to another group
+	Frozen bool `json:"frozen,omitempty"`
+}
+
+func (r Range) Contains(key string) bool {
+	return key >= r.Start && (r.End == "" || key < r.End)
+}
+
+func (r Range) String() string {
+	end := r.End
+	if end == "" {
+		end = "+inf"
+	}
+	return fmt.Sprintf("[%q, %s) -> %s", r.Start, end, r.Group)
+}
+
+// Table is the routing table, ranges sorted by start key
+type Table []Range
+
+// decodeTable builds a table from the range keys stored in the metadata group
+func decodeTable(kvs map[string]string) (Table, error) {
+	var table Table
+	for k, v := range kvs {
+		if !strings.HasPrefix(k, rangePrefix) {
+			continue
+		}
+		var r Range
+		if err := json.Unmarshal([]byte(v), &r); err != nil {
+			return nil, fmt.Errorf("bad routing entry (%s): %v", k, err)
+		}
+		table = append(table, r)
+	}
+	sort.Slice(table, func(i, j int) bool { return table[i].Start < table[j].Start })
+	return table, nil
+}
+
+func rangeKey(r Range) string {
+	return rangePrefix + r.Start
+}
+
+func encodeRange(r Range) (string, error) {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// Lookup returns the range containing key
+func (t Table) Lookup(key string) (Range, bool) {
+	// first range whose start is after key, the one before it contains key
+	i := sort.Search(len(t), func(i int) bool { return t[i].Start > key })
+	if i == 0 {
+		return Range{}, false
+	}
+	r := t[i-1]
+	if !r.Contains(key) {
+		return Range{}, false
+	}
+	return r, true
+}
+
+// Validate checks that the ranges cover the whole keyspace without overlap
+func (t Table) Validate() error {
+	if len(t) == 0 {
+		return fmt.Errorf("routing table is empty")
+	}
+	if t[0].Start != "" {
+		return fmt.Errorf("first range starts at %q instead of the empty key", t[0].Start)
+	}
+	for i := 1; i < len(t); i++ {
+		if t[i-1].End != t[i].Start {
+			return fmt.Errorf("range %s does not end where %s starts", t[i-1], t[i])
+		}
+	}
+	if t[len(t)-1].End != "" {
+		return fmt.Errorf("last range %s is bounded", t[len(t)-1])
+	}
+	return nil
+}
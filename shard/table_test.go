@@ -0,0 +1,53 @@
+package shard
+
+import (
+	"testing"
+)
+
+func TestTableLookup(t *testing.T) {
+	table, err := decodeTable(map[string]string{
+		rangePrefix:       `{"start": "", "end": "g", "group": "g1"}`,
+		rangePrefix + "g": `{"start": "g", "end": "p", "group": "g2"}`,
+		rangePrefix + "p": `{"start": "p", "end": "", "group": "g3"}`,
+		"other":           `ignored`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := table.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	for key, group := range map[string]string{"": "g1", "apple": "g1", "g": "g2", "orange": "g2", "p": "g3", "zebra": "g3"} {
+		r, ok := table.Lookup(key)
+		if !ok || r.Group != group {
+			t.Fatalf("Lookup(%q) = %v %v, want %s", key, r, ok, group)
+		}
+	}
+}
+
+func TestTableSplitInProgress(t *testing.T) {
+	// Split writes the upper half before shrinking the lower one
+	table, err := decodeTable(map[string]string{
+		rangePrefix:       `{"start": "", "end": "", "group": "g1"}`,
+		rangePrefix + "m": `{"start": "m", "end": "", "group": "g1"}`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, _ := table.Lookup("x"); r.Start != "m" {
+		t.Fatalf("expected the upper half to own x, got %v", r)
+	}
+	if err := table.Validate(); err == nil {
+		t.Fatal("expected overlapping ranges to be reported")
+	}
+}
+
+func TestPrefixEnd(t *testing.T) {
+	if got := prefixEnd("shard/range/"); got != "shard/range0" {
+		t.Fatalf("bad prefix end %q", got)
+	}
+	if got := prefixEnd("a\xff"); got != "b" {
+		t.Fatalf("bad prefix end %q", got)
+	}
+}
@@ -0,0 +1,99 @@
+package store
+
+import (
+	"sync"
+	"time"
+)
+
+// feedSize is the number of recent changes kept for ChangesSince
+const feedSize = 4096
+
+// Change is an operation applied to the store at a raft index
+type Change struct {
+	Index uint64    `json:"index"`
+	Op    Op        `json:"op"`
+	Time  time.Time `json:"time"`
+}
+
+// feed keeps the most recent changes applied to the store. Every change with
+// an index after base is in the buffer.
+type feed struct {
+	sync.Mutex
+	// changes is a ring once it holds size changes, the oldest at start
+	changes []Change
+	start   int
+	size    int
+	base    uint64
+	// changed is closed and replaced on every append
+	changed chan struct{}
+}
+
+func newFeed(size int) *feed {
+	return &feed{
+		size:    size,
+		changed: make(chan struct{}),
+	}
+}
+
+func (f *feed) append(c Change) {
+	f.Lock()
+	defer f.Unlock()
+	if len(f.changes) < f.size {
+		f.changes = append(f.changes, c)
+	} else {
+		f.base = f.changes[f.start].Index
+		f.changes[f.start] = c
+		f.start = (f.start + 1) % f.size
+	}
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+// reset drops the buffered changes, changes up to base are no longer known
+func (f *feed) reset(base uint64) {
+	f.Lock()
+	defer f.Unlock()
+	f.changes = f.changes[:0]
+	f.start = 0
+	f.base = base
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+func (f *feed) since(index uint64, max int) ([]Change, bool) {
+	f.Lock()
+	defer f.Unlock()
+	if index < f.base {
+		return nil, false
+	}
+	var changes []Change
+	for i := range f.changes {
+		c := f.changes[(f.start+i)%len(f.changes)]
+		if c.Index <= index {
+			continue
+		}
+		if max > 0 && len(changes) == max {
+			break
+		}
+		changes = append(changes, c)
+	}
+	return changes, true
+}
+
+func (f *feed) wait() <-chan struct{} {
+	f.Lock()
+	defer f.Unlock()
+	return f.changed
+}
+
+// ChangesSince returns up to max changes applied after index. It returns false
+// when changes after index are no longer buffered, the caller then has to
+// start over from Dump.
+func (s *KvStore) ChangesSince(index uint64, max int) ([]Change, bool) {
+	return s.feed.since(index, max)
+}
+
+// Changed returns a channel closed on the next change to the store
+func (s *KvStore) Changed() <-chan struct{} {
+	return s.feed.wait()
+}
@@ -0,0 +1,27 @@
+package store
+
+import "testing"
+
+func TestFeedRing(t *testing.T) {
+	f := newFeed(3)
+	for i := uint64(1); i <= 5; i++ {
+		f.append(Change{Index: i})
+	}
+	// 1 and 2 were dropped, the rest comes oldest first
+	if _, ok := f.since(1, 0); ok {
+		t.Fatal("expected changes after 1 to be gone")
+	}
+	changes, ok := f.since(2, 0)
+	if !ok || len(changes) != 3 || changes[0].Index != 3 || changes[2].Index != 5 {
+		t.Fatalf("got %+v, want 3 to 5", changes)
+	}
+	if changes, _ := f.since(3, 1); len(changes) != 1 || changes[0].Index != 4 {
+		t.Fatalf("got %+v, want only 4", changes)
+	}
+
+	f.reset(10)
+	f.append(Change{Index: 11})
+	if changes, ok := f.since(10, 0); !ok || len(changes) != 1 || changes[0].Index != 11 {
+		t.Fatalf("got %+v after reset, want 11", changes)
+	}
+}
@@ -1,19 +1,49 @@
 package store
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/forjoin92/depot/logging"
+	"github.com/forjoin92/depot/tracing"
 	"github.com/hashicorp/raft"
 )
 
+// FrozenPrefix marks frozen key ranges, FrozenPrefix+start holds the end of
+// a range whose keys refuse writes while it moves to another raft group. An
+// empty end means no upper bound.
+const FrozenPrefix = "store/frozen/"
+
+// ErrRangeFrozen is returned for writes to a frozen range
+var ErrRangeFrozen = errors.New("range is moving to another group, retry later")
+
 type KvStore struct {
 	sync.RWMutex
 	kvStore map[string]string
+	// frozen maps the start of each frozen range to its end
+	frozen map[string]string
+
+	// index is the raft index of the last applied operation
+	index uint64
+	feed  *feed
+
+	onRestore func(index uint64)
+	// restoring is set while a snapshot replaces the state
+	restoring int32
+
+	logger *logging.Logger
+	tracer *tracing.Tracer
 }
 
 func (kv *KvStore) Apply(log *raft.Log) interface{} {
@@ -21,56 +51,132 @@ func (kv *KvStore) Apply(log *raft.Log) interface{} {
 	if err := json.Unmarshal(log.Data, &op); err != nil {
 		panic(err)
 	}
-	return kv.apply(op)
+	return kv.applyAt(log.Index, op)
 }
 
 func (kv *KvStore) Snapshot() (raft.FSMSnapshot, error) {
-	snapshot := *kv
-	return &snapshot, nil
+	kv.RLock()
+	defer kv.RUnlock()
+	kvs := make(map[string]string, len(kv.kvStore))
+	for k, v := range kv.kvStore {
+		kvs[k] = v
+	}
+	return &kvSnapshot{Index: kv.index, KVs: kvs}, nil
 }
 
 func (kv *KvStore) Restore(inp io.ReadCloser) error {
-	bSizeBuf := make([]byte, 2)
-	if _, err := inp.Read(bSizeBuf); err != nil {
-		panic(err)
+	defer inp.Close()
+	atomic.StoreInt32(&kv.restoring, 1)
+	defer atomic.StoreInt32(&kv.restoring, 0)
+
+	// snapshots are decoded as they are read, only the legacy format is
+	// small enough to be read at once
+	var snapshot kvSnapshot
+	r := bufio.NewReader(inp)
+	if magic, err := r.Peek(len(snapshotMagic)); err == nil && bytes.Equal(magic, snapshotMagic) {
+		r.Discard(len(snapshotMagic))
+		if err := json.NewDecoder(r).Decode(&snapshot); err != nil {
+			return fmt.Errorf("snapshot decode error: %v", err)
+		}
+	} else {
+		buf, err := ioutil.ReadAll(r)
+		if err != nil {
+			return fmt.Errorf("snapshot read error: %v", err)
+		}
+		// legacy format: 2 byte little endian length followed by the json map
+		if len(buf) < 2 {
+			return errors.New("snapshot decode error: short snapshot")
+		}
+		bSize := int(binary.LittleEndian.Uint16(buf[:2]))
+		if len(buf) < bSize+2 {
+			return errors.New("snapshot decode error: truncated snapshot")
+		}
+		if err := json.Unmarshal(buf[2:bSize+2], &snapshot.KVs); err != nil {
+			return fmt.Errorf("snapshot decode error: %v", err)
+		}
 	}
-	bSize := int(binary.LittleEndian.Uint16(bSizeBuf))
-	buf := make([]byte, bSize)
-	if _, err := inp.Read(buf); err != nil && err != io.EOF {
-		panic("snapshot decode error:" + err.Error())
+	if snapshot.KVs == nil {
+		snapshot.KVs = make(map[string]string)
 	}
-	fmt.Println("buf:", string(buf))
-	kvs := make(map[string]string)
-	if err := json.Unmarshal(buf, &kvs); err != nil {
-		panic(err)
+
+	kv.Lock()
+	kv.kvStore = snapshot.KVs
+	kv.frozen = frozenRanges(snapshot.KVs)
+	// a restored backup can be older than the state it replaces, keep the
+	// index moving forward so that feed readers start over. The index only
+	// orders the feed and is not raft's: raft restores a snapshot at an index
+	// above everything this store applied, so kv.index+1 never passes it and
+	// the next applied entry moves the index on to its real raft index.
+	index := snapshot.Index
+	if index <= kv.index && kv.index > 0 {
+		index = kv.index + 1
 	}
-	for k, v := range kvs {
-		kv.kvStore[k] = v
+	kv.index = index
+	kv.Unlock()
+	// changes before the snapshot are unknown to the feed
+	kv.feed.reset(index)
+	kv.logger.Info("Restored snapshot", "index", index, "keys", len(snapshot.KVs))
+	if kv.onRestore != nil {
+		kv.onRestore(index)
 	}
 	return nil
 }
 
-func (kv *KvStore) Persist(sink raft.SnapshotSink) error {
-	data, err := json.Marshal(kv.kvStore)
-	if err != nil {
+// Restoring reports whether a snapshot is being restored
+func (kv *KvStore) Restoring() bool {
+	return atomic.LoadInt32(&kv.restoring) == 1
+}
+
+// OnRestore sets a callback run after a snapshot is restored, it must be set
+// before the store is handed to raft
+func (kv *KvStore) OnRestore(fn func(index uint64)) {
+	kv.onRestore = fn
+}
+
+// SetLogger sets the logger of the store, it must be set before the store is
+// handed to raft
+func (kv *KvStore) SetLogger(l *logging.Logger) {
+	kv.logger = l
+}
+
+// SetTracer records the applying of traced operations, it must be set before
+// the store is handed to raft
+func (kv *KvStore) SetTracer(t *tracing.Tracer) {
+	kv.tracer = t
+}
+
+// snapshotMagic prefixes snapshots that carry the applied index
+var snapshotMagic = []byte("DPT1")
+
+type kvSnapshot struct {
+	Index uint64            `json:"index"`
+	KVs   map[string]string `json:"kvs"`
+}
+
+func (s *kvSnapshot) Persist(sink raft.SnapshotSink) error {
+	if err := s.write(sink); err != nil {
+		sink.Cancel()
 		return err
 	}
-	bSize := uint16(len(data))
-	buf := make([]byte, bSize+2)
-	binary.LittleEndian.PutUint16(buf[:2], bSize)
-	copy(buf[2:], data)
-	if _, err = sink.Write(buf); err != nil {
+	return sink.Close()
+}
+
+func (s *kvSnapshot) write(w io.Writer) error {
+	if _, err := w.Write(snapshotMagic); err != nil {
 		return err
 	}
-	return nil
+	return json.NewEncoder(w).Encode(s)
 }
 
-func (kv *KvStore) Release() {
+func (s *kvSnapshot) Release() {
 }
 
 func NewKVStore() *KvStore {
 	return &KvStore{
 		kvStore: make(map[string]string),
+		frozen:  make(map[string]string),
+		feed:    newFeed(feedSize),
+		logger:  logging.Default(),
 	}
 }
 
@@ -80,33 +186,211 @@ func (s *KvStore) Get(key string) string {
 	return s.kvStore[key]
 }
 
-func (s *KvStore) set(key, value string) {
+// Lookup is Get telling a missing key from an empty value
+func (s *KvStore) Lookup(key string) (string, bool) {
+	s.RLock()
+	defer s.RUnlock()
+	value, ok := s.kvStore[key]
+	return value, ok
+}
+
+// Scan returns a copy of the keys in [start, end), an empty end means no upper bound
+func (s *KvStore) Scan(start, end string) map[string]string {
+	s.RLock()
+	defer s.RUnlock()
+	kvs := make(map[string]string)
+	for k, v := range s.kvStore {
+		if k >= start && (end == "" || k < end) {
+			kvs[k] = v
+		}
+	}
+	return kvs
+}
+
+func (s *KvStore) set(key, value string, moving bool) error {
 	s.Lock()
 	defer s.Unlock()
+	if !moving && s.isFrozen(key) {
+		return ErrRangeFrozen
+	}
 	s.kvStore[key] = value
+	if strings.HasPrefix(key, FrozenPrefix) {
+		s.frozen[strings.TrimPrefix(key, FrozenPrefix)] = value
+	}
+	return nil
 }
 
-func (s *KvStore) del(key string) {
+func (s *KvStore) del(key string, moving bool) error {
 	s.Lock()
 	defer s.Unlock()
+	if !moving && s.isFrozen(key) {
+		return ErrRangeFrozen
+	}
 	delete(s.kvStore, key)
+	if strings.HasPrefix(key, FrozenPrefix) {
+		delete(s.frozen, strings.TrimPrefix(key, FrozenPrefix))
+	}
+	return nil
 }
 
-func (s *KvStore) apply(op Op) interface{} {
+// isFrozen reports whether key is in a frozen range, the range markers
+// themselves are never frozen
+func (s *KvStore) isFrozen(key string) bool {
+	if strings.HasPrefix(key, FrozenPrefix) {
+		return false
+	}
+	for start, end := range s.frozen {
+		if key >= start && (end == "" || key < end) {
+			return true
+		}
+	}
+	return false
+}
+
+// frozenRanges collects the frozen ranges recorded in kvs
+func frozenRanges(kvs map[string]string) map[string]string {
+	frozen := make(map[string]string)
+	for k, v := range kvs {
+		if strings.HasPrefix(k, FrozenPrefix) {
+			frozen[strings.TrimPrefix(k, FrozenPrefix)] = v
+		}
+	}
+	return frozen
+}
+
+// WriteSnapshot writes the state in the format Restore reads
+func (s *KvStore) WriteSnapshot(w io.Writer) error {
+	s.RLock()
+	defer s.RUnlock()
+	return (&kvSnapshot{Index: s.index, KVs: s.kvStore}).write(w)
+}
+
+// Select returns a copy of the keys match selects
+func (s *KvStore) Select(match func(key string) bool) map[string]string {
+	s.RLock()
+	defer s.RUnlock()
+	kvs := make(map[string]string)
+	for k, v := range s.kvStore {
+		if match(k) {
+			kvs[k] = v
+		}
+	}
+	return kvs
+}
+
+// ReplaceKeys drops the keys match selects and sets kvs instead. It changes
+// the state outside of raft and is meant for stores that are not replicated,
+// e.g. a backup being prepared for a restore.
+func (s *KvStore) ReplaceKeys(match func(key string) bool, kvs map[string]string) {
+	s.Lock()
+	defer s.Unlock()
+	for k := range s.kvStore {
+		if match(k) {
+			delete(s.kvStore, k)
+		}
+	}
+	for k, v := range kvs {
+		s.kvStore[k] = v
+	}
+	s.frozen = frozenRanges(s.kvStore)
+}
+
+// Dump returns a copy of every key together with the index it reflects
+func (s *KvStore) Dump() (map[string]string, uint64) {
+	s.RLock()
+	defer s.RUnlock()
+	kvs := make(map[string]string, len(s.kvStore))
+	for k, v := range s.kvStore {
+		kvs[k] = v
+	}
+	return kvs, s.index
+}
+
+// Size returns the number of keys and the bytes taken by keys and values
+func (s *KvStore) Size() (int, int64) {
+	s.RLock()
+	defer s.RUnlock()
+	var bytes int64
+	for k, v := range s.kvStore {
+		bytes += int64(len(k) + len(v))
+	}
+	return len(s.kvStore), bytes
+}
+
+// AppliedIndex returns the raft index of the last applied operation
+func (s *KvStore) AppliedIndex() uint64 {
+	s.RLock()
+	defer s.RUnlock()
+	return s.index
+}
+
+// ApplyResult is the response of the state machine to a raft log entry
+type ApplyResult struct {
+	Err error
+	// Start is when the entry began to be applied, i.e. shortly after it was
+	// committed
+	Start time.Time
+}
+
+func (s *KvStore) applyAt(index uint64, op Op) interface{} {
+	start := time.Now()
+	err := s.apply(op)
+	if err == ErrRangeFrozen {
+		// the writer retries once the range moved
+		s.logger.Debug("Refused write to frozen range", "index", index, "key", op.Key)
+	} else if err != nil {
+		s.logger.Error("Failed to apply", "index", index, "op", op.Method, "err", err)
+	} else {
+		s.Lock()
+		s.index = index
+		s.Unlock()
+		s.feed.append(Change{Index: index, Op: op, Time: time.Now()})
+	}
+	if op.TraceID != "" {
+		s.tracer.Record(tracing.Span{
+			TraceID:  op.TraceID,
+			Name:     "fsm.apply",
+			Start:    start,
+			Duration: time.Since(start),
+			Attrs:    map[string]string{"index": strconv.FormatUint(index, 10), "op": op.Method},
+			Error:    errString(err),
+		})
+	}
+	return &ApplyResult{Err: err, Start: start}
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+func (s *KvStore) apply(op Op) error {
 	switch op.Method {
 	case "SET":
-		s.set(op.Key, op.Value)
+		return s.set(op.Key, op.Value, op.Moving)
 	case "DEL":
-		s.del(op.Key)
+		return s.del(op.Key, op.Moving)
 	default:
-		fmt.Printf("unknown op:%s\n", op.Method)
 		return errors.New(fmt.Sprintf("unknown op:%s", op.Method))
 	}
-	return nil
 }
 
+// Commands lists the operations this build can apply
+var Commands = []string{"DEL", "SET"}
+
+// BaseCommands are applied by every release, members that never advertised
+// their commands are assumed to support only these
+var BaseCommands = []string{"DEL", "SET"}
+
 type Op struct {
 	Method string
 	Key    string
 	Value  string
+	// TraceID is the id of the API request which proposed the operation
+	TraceID string `json:",omitempty"`
+	// Moving marks the writes of a range move, they are applied to frozen
+	// ranges too
+	Moving bool `json:",omitempty"`
 }
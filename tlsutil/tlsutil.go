@@ -0,0 +1,106 @@
+package tlsutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"sync"
+)
+
+// KeyPair is a certificate and key loaded from files which can be reloaded
+// while connections are served
+type KeyPair struct {
+	certFile string
+	keyFile  string
+
+	sync.RWMutex
+	cert *tls.Certificate
+}
+
+func LoadKeyPair(certFile, keyFile string) (*KeyPair, error) {
+	kp := &KeyPair{certFile: certFile, keyFile: keyFile}
+	if err := kp.Reload(); err != nil {
+		return nil, err
+	}
+	return kp, nil
+}
+
+// Reload reads the files again, the old certificate is kept on error
+func (kp *KeyPair) Reload() error {
+	cert, err := tls.LoadX509KeyPair(kp.certFile, kp.keyFile)
+	if err != nil {
+		return fmt.Errorf("Failed to load key pair (%s, %s): (%v)", kp.certFile, kp.keyFile, err)
+	}
+	kp.Lock()
+	kp.cert = &cert
+	kp.Unlock()
+	return nil
+}
+
+func (kp *KeyPair) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	kp.RLock()
+	defer kp.RUnlock()
+	return kp.cert, nil
+}
+
+func (kp *KeyPair) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	kp.RLock()
+	defer kp.RUnlock()
+	return kp.cert, nil
+}
+
+// LoadCAPool reads PEM encoded CA certificates
+func LoadCAPool(path string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read CA file (%s): (%v)", path, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no CA certificates found in (%s)", path)
+	}
+	return pool, nil
+}
+
+// VerifyChain verifies the peer certificate chain against roots for the given
+// key usage, without checking the host name
+func VerifyChain(rawCerts [][]byte, roots *x509.CertPool, usage x509.ExtKeyUsage) (*x509.Certificate, error) {
+	if len(rawCerts) == 0 {
+		return nil, fmt.Errorf("peer sent no certificate")
+	}
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return nil, fmt.Errorf("bad peer certificate: %v", err)
+		}
+		certs[i] = cert
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{usage},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return certs[0], nil
+}
+
+// HasName reports whether the certificate's common name or a DNS name is name
+func HasName(cert *x509.Certificate, name string) bool {
+	if cert.Subject.CommonName == name {
+		return true
+	}
+	for _, dns := range cert.DNSNames {
+		if dns == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,244 @@
+// Package tracing records timed spans of a request as it goes through the
+// API, raft and the state machine.
+//
+// The trace id is the API request id. It travels in the context on a node,
+// in the X-Request-ID header between nodes and inside the raft command to the
+// state machines, so the spans of a write can be matched across members.
+// A nil *Tracer records nothing.
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Span is a timed step of a trace
+type Span struct {
+	TraceID string    `json:"trace_id"`
+	Name    string    `json:"name"`
+	Start   time.Time `json:"start"`
+	// Duration is in nanoseconds
+	Duration time.Duration     `json:"duration_ns"`
+	Attrs    map[string]string `json:"attrs,omitempty"`
+	Error    string            `json:"error,omitempty"`
+}
+
+// Exporter receives the finished spans
+type Exporter interface {
+	Export(span Span)
+}
+
+type Tracer struct {
+	exporter Exporter
+	// attrs are added to every span, e.g. the node id
+	attrs []string
+}
+
+func New(exporter Exporter) *Tracer {
+	return &Tracer{exporter: exporter}
+}
+
+// With returns a tracer adding the key/value pairs to every span
+func (t *Tracer) With(kv ...string) *Tracer {
+	if t == nil {
+		return nil
+	}
+	attrs := make([]string, 0, len(t.attrs)+len(kv))
+	return &Tracer{exporter: t.exporter, attrs: append(append(attrs, t.attrs...), kv...)}
+}
+
+// Record exports a span measured by the caller
+func (t *Tracer) Record(span Span) {
+	if t == nil || span.TraceID == "" {
+		return
+	}
+	if len(t.attrs) > 0 {
+		attrs := make(map[string]string, len(t.attrs)/2+len(span.Attrs))
+		for i := 0; i+1 < len(t.attrs); i += 2 {
+			attrs[t.attrs[i]] = t.attrs[i+1]
+		}
+		for k, v := range span.Attrs {
+			attrs[k] = v
+		}
+		span.Attrs = attrs
+	}
+	t.exporter.Export(span)
+}
+
+// Start begins a span of the trace, End records it. Without a tracer or a
+// trace id nothing is recorded.
+func (t *Tracer) Start(traceID, name string, kv ...string) *ActiveSpan {
+	if t == nil || traceID == "" {
+		return nil
+	}
+	s := &ActiveSpan{tracer: t, span: Span{TraceID: traceID, Name: name, Start: time.Now()}}
+	s.Set(kv...)
+	return s
+}
+
+// Ring returns the ring the spans are exported to, if any
+func (t *Tracer) Ring() (*Ring, bool) {
+	if t == nil {
+		return nil, false
+	}
+	r, ok := t.exporter.(*Ring)
+	return r, ok
+}
+
+// Close closes the exporter when it holds a file
+func (t *Tracer) Close() error {
+	if t == nil {
+		return nil
+	}
+	if c, ok := t.exporter.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// ActiveSpan is a span being measured
+type ActiveSpan struct {
+	tracer *Tracer
+	span   Span
+}
+
+// Set adds key/value attributes to the span
+func (s *ActiveSpan) Set(kv ...string) {
+	if s == nil {
+		return
+	}
+	for i := 0; i+1 < len(kv); i += 2 {
+		if s.span.Attrs == nil {
+			s.span.Attrs = make(map[string]string)
+		}
+		s.span.Attrs[kv[i]] = kv[i+1]
+	}
+}
+
+// End records the span, err is the outcome of the step
+func (s *ActiveSpan) End(err error) {
+	if s == nil {
+		return
+	}
+	s.span.Duration = time.Since(s.span.Start)
+	if err != nil {
+		s.span.Error = err.Error()
+	}
+	s.tracer.Record(s.span)
+}
+
+// Trace is the spans of one trace recorded by a node, by start time
+type Trace struct {
+	ID    string `json:"id"`
+	Spans []Span `json:"spans"`
+}
+
+// Ring keeps the last spans in memory
+type Ring struct {
+	sync.Mutex
+	spans []Span
+	next  int
+	full  bool
+}
+
+func NewRing(size int) *Ring {
+	return &Ring{spans: make([]Span, size)}
+}
+
+func (r *Ring) Export(span Span) {
+	r.Lock()
+	defer r.Unlock()
+	if len(r.spans) == 0 {
+		return
+	}
+	r.spans[r.next] = span
+	r.next = (r.next + 1) % len(r.spans)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// Spans returns the spans kept, oldest first
+func (r *Ring) Spans() []Span {
+	r.Lock()
+	defer r.Unlock()
+	if !r.full {
+		return append([]Span(nil), r.spans[:r.next]...)
+	}
+	return append(append([]Span(nil), r.spans[r.next:]...), r.spans[:r.next]...)
+}
+
+// Traces groups the spans kept by trace, the most recently started first.
+// A non empty id only returns that trace.
+func (r *Ring) Traces(id string) []Trace {
+	byID := make(map[string]*Trace)
+	var traces []*Trace
+	for _, span := range r.Spans() {
+		if id != "" && span.TraceID != id {
+			continue
+		}
+		t, ok := byID[span.TraceID]
+		if !ok {
+			t = &Trace{ID: span.TraceID}
+			byID[span.TraceID] = t
+			traces = append(traces, t)
+		}
+		t.Spans = append(t.Spans, span)
+	}
+	for _, t := range traces {
+		sort.SliceStable(t.Spans, func(i, j int) bool { return t.Spans[i].Start.Before(t.Spans[j].Start) })
+	}
+	sort.SliceStable(traces, func(i, j int) bool { return traces[i].Spans[0].Start.After(traces[j].Spans[0].Start) })
+
+	result := make([]Trace, len(traces))
+	for i, t := range traces {
+		result[i] = *t
+	}
+	return result
+}
+
+// FileExporter appends spans to a file, one JSON object per line
+type FileExporter struct {
+	sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+}
+
+func OpenFile(path string) (*FileExporter, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &FileExporter{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+func (e *FileExporter) Export(span Span) {
+	e.Lock()
+	defer e.Unlock()
+	// a span lost to a full disk is not worth failing the request for
+	e.enc.Encode(span)
+}
+
+func (e *FileExporter) Close() error {
+	e.Lock()
+	defer e.Unlock()
+	return e.f.Close()
+}
+
+type contextKey struct{}
+
+// NewContext returns a context carrying the trace id
+func NewContext(ctx context.Context, traceID string) context.Context {
+	return context.WithValue(ctx, contextKey{}, traceID)
+}
+
+// IDFromContext returns the trace id of ctx, empty when it has none
+func IDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(contextKey{}).(string)
+	return id
+}
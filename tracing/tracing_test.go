@@ -0,0 +1,105 @@
+package tracing
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRing(t *testing.T) {
+	ring := NewRing(3)
+	tracer := New(ring).With("node", "n1")
+	start := time.Now()
+	for i, id := range []string{"a", "b", "a", "c"} {
+		tracer.Record(Span{TraceID: id, Name: "step", Start: start.Add(time.Duration(i) * time.Second)})
+	}
+	// spans without a trace id are dropped
+	tracer.Record(Span{Name: "step"})
+
+	spans := ring.Spans()
+	if len(spans) != 3 || spans[0].TraceID != "b" || spans[2].TraceID != "c" {
+		t.Fatalf("unexpected spans %+v", spans)
+	}
+	if spans[0].Attrs["node"] != "n1" {
+		t.Fatalf("missing tracer attributes %v", spans[0].Attrs)
+	}
+
+	traces := ring.Traces("")
+	if len(traces) != 3 || traces[0].ID != "c" || traces[1].ID != "a" || traces[2].ID != "b" {
+		t.Fatalf("unexpected traces %+v", traces)
+	}
+	if traces := ring.Traces("a"); len(traces) != 1 || len(traces[0].Spans) != 1 {
+		t.Fatalf("unexpected trace a %+v", traces)
+	}
+}
+
+func TestActiveSpan(t *testing.T) {
+	ring := NewRing(8)
+	tracer := New(ring)
+	span := tracer.Start("r1", "forward", "to", "leader")
+	span.Set("path", "/addNode")
+	span.End(errors.New("refused"))
+
+	spans := ring.Spans()
+	if len(spans) != 1 {
+		t.Fatalf("expected one span, got %+v", spans)
+	}
+	s := spans[0]
+	if s.Name != "forward" || s.Error != "refused" || s.Attrs["to"] != "leader" || s.Attrs["path"] != "/addNode" || s.Duration <= 0 {
+		t.Fatalf("unexpected span %+v", s)
+	}
+
+	// a nil tracer and untraced requests record nothing
+	var off *Tracer
+	off.With("node", "n1").Start("r1", "http").End(nil)
+	tracer.Start("", "http").End(nil)
+	if len(ring.Spans()) != 1 {
+		t.Fatalf("unexpected spans %+v", ring.Spans())
+	}
+}
+
+func TestFileExporter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "depot-trace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "trace.jsonl")
+	exporter, err := OpenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracer := New(exporter)
+	tracer.Start("r1", "http").End(nil)
+	tracer.Start("r2", "http").End(nil)
+	if _, ok := tracer.Ring(); ok {
+		t.Fatal("a file tracer has no ring")
+	}
+	if err := tracer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var ids []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var span Span
+		if err := json.Unmarshal(scanner.Bytes(), &span); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, span.TraceID)
+	}
+	if len(ids) != 2 || ids[0] != "r1" || ids[1] != "r2" {
+		t.Fatalf("unexpected spans in file %v", ids)
+	}
+}